@@ -43,6 +43,9 @@ var Cmd = &cobra.Command{
 		if cfg.Role != "server" {
 			log.Fatalf("dump command requires server configuration")
 		}
+		if cfg.Transport.Protocol == "ws" {
+			log.Fatalf("dump command needs a raw network path, but transport protocol is ws")
+		}
 
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
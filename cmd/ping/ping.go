@@ -37,6 +37,9 @@ func sendPacket() {
 	if cfg.Role != "client" {
 		log.Fatalf("ping command requires client configuration")
 	}
+	if cfg.Transport.Protocol == "ws" {
+		log.Fatalf("ping command needs a raw network path, but transport protocol is ws")
+	}
 
 	netCfg := cfg.Network
 	packetConn, err := socket.New(context.TODO(), &netCfg)
@@ -45,7 +48,11 @@ func sendPacket() {
 	}
 	defer packetConn.Close()
 
-	log.Printf("Sending packet from IPv4:%s IPv6:%s to %s via %s...", cfg.Network.IPv4.Addr, cfg.Network.IPv6.Addr, cfg.Server.Addr.String(), cfg.Network.Interface.Name)
+	via := "a UDP socket"
+	if cfg.Network.Interface != nil {
+		via = cfg.Network.Interface.Name
+	}
+	log.Printf("Sending packet from IPv4:%s IPv6:%s to %s via %s...", cfg.Network.IPv4.Addr, cfg.Network.IPv6.Addr, cfg.Server.Addr.String(), via)
 	log.Printf("Payload: \"%s\" (%d bytes)", payload, len(payload))
 
 	if _, err := packetConn.WriteTo([]byte(payload), cfg.Server.Addr); err != nil {
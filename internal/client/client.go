@@ -2,11 +2,13 @@ package client
 
 import (
 	"context"
+	"net"
 	"paqet/internal/conf"
 	"paqet/internal/flog"
 	"paqet/internal/pkg/iterator"
 	"paqet/internal/tnet"
 	"sync"
+	"sync/atomic"
 )
 
 type Client struct {
@@ -14,6 +16,7 @@ type Client struct {
 	iter    *iterator.Iterator[*timedConn]
 	udpPool *udpPool
 	mu      sync.Mutex
+	server  atomic.Pointer[net.UDPAddr]
 }
 
 func New(cfg *conf.Conf) (*Client, error) {
@@ -22,12 +25,13 @@ func New(cfg *conf.Conf) (*Client, error) {
 		iter:    &iterator.Iterator[*timedConn]{},
 		udpPool: &udpPool{strms: make(map[uint64]tnet.Strm)},
 	}
+	c.server.Store(cfg.Server.Addr)
 	return c, nil
 }
 
 func (c *Client) Start(ctx context.Context) error {
 	for i := range c.cfg.Transport.Conn {
-		tc, err := newTimedConn(ctx, c.cfg)
+		tc, err := newTimedConn(ctx, c.cfg, &c.server)
 		if err != nil {
 			flog.Errorf("failed to create connection %d: %v", i+1, err)
 			return err
@@ -36,12 +40,18 @@ func (c *Client) Start(ctx context.Context) error {
 		c.iter.Items = append(c.iter.Items, tc)
 	}
 	go c.ticker(ctx)
+	for i := range c.cfg.Reverse {
+		go c.reverse(ctx, &c.cfg.Reverse[i])
+	}
 
 	go func() {
 		<-ctx.Done()
 		for _, tc := range c.iter.Items {
 			tc.close()
 		}
+		if st := tnet.CompressionStats(); st.In > 0 {
+			flog.Infof("compression: %s", st)
+		}
 		flog.Infof("client shutdown complete")
 	}()
 
@@ -53,6 +63,10 @@ func (c *Client) Start(ctx context.Context) error {
 	if c.cfg.Network.IPv6.Addr != nil {
 		ipv6Addr = c.cfg.Network.IPv6.Addr.IP.String()
 	}
-	flog.Infof("Client started: IPv4:%s IPv6:%s -> %s (%d connections)", ipv4Addr, ipv6Addr, c.cfg.Server.Addr, len(c.iter.Items))
+	if t := c.cfg.Transport; t.Protocol == "ws" {
+		flog.Infof("Client started: -> %s (%d connections)", t.WS.URL.Redacted(), len(c.iter.Items))
+	} else {
+		flog.Infof("Client started: IPv4:%s IPv6:%s -> %s (%d connections)", ipv4Addr, ipv6Addr, c.cfg.Server.Addr, len(c.iter.Items))
+	}
 	return nil
 }
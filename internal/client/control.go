@@ -0,0 +1,98 @@
+package client
+
+import (
+	"net"
+	"paqet/internal/flog"
+	"paqet/internal/protocol"
+	"paqet/internal/socket"
+	"paqet/internal/tnet"
+	"time"
+)
+
+// drainState marks a conn the server has sent GOAWAY on. The old conn is
+// closed once the drain time is up. When the server named a new address, new
+// streams go to a fresh conn there; otherwise none are opened until then.
+type drainState struct {
+	conn     tnet.Conn
+	deadline time.Time
+	migrate  bool
+}
+
+// openControl opens the control stream of conn. Servers without control
+// streams close it, which only means there is nothing to act on.
+func (tc *timedConn) openControl(conn tnet.Conn, pConn *socket.PacketConn, ver protocol.Version) {
+	strm, err := conn.OpenStrm()
+	if err != nil {
+		flog.Debugf("failed to open control stream: %v", err)
+		return
+	}
+	p := protocol.Proto{Type: protocol.PCTRL, Version: ver}
+	if err := p.Write(strm); err != nil {
+		strm.Close()
+		flog.Debugf("failed to write control stream header: %v", err)
+		return
+	}
+	go tc.control(conn, pConn, strm)
+}
+
+func (tc *timedConn) control(conn tnet.Conn, pConn *socket.PacketConn, strm tnet.Strm) {
+	defer strm.Close()
+	server := conn.RemoteAddr()
+	migrate := false
+	var m protocol.Ctrl
+	for {
+		if err := m.Read(strm); err != nil {
+			flog.Debugf("control stream to %s ended: %v", server, err)
+			return
+		}
+		switch m.Kind {
+		case protocol.CtrlGoAway:
+			reason := ""
+			if m.Text != "" {
+				reason = ": " + m.Text
+			}
+			flog.Infof("server %s is going away%s; draining its connection for %v", server, reason, m.Drain)
+			tc.drain.Store(&drainState{conn: conn, deadline: time.Now().Add(m.Drain), migrate: migrate})
+			time.AfterFunc(m.Drain, func() { conn.Close() })
+		case protocol.CtrlMigrate:
+			migrate = tc.migrate(m.Addr)
+		case protocol.CtrlTCPF:
+			if len(m.TCPF) > 0 && pConn != nil {
+				pConn.SetTCPF(m.TCPF)
+				flog.Infof("server %s set %d TCP flag sets", server, len(m.TCPF))
+			}
+		case protocol.CtrlRate:
+			if pConn == nil {
+				flog.Debugf("ignoring rate limit from server %s: the session does not run over raw packets", server)
+				continue
+			}
+			pConn.SetRateLimit(int(m.RateKbps))
+			if m.RateKbps > 0 {
+				flog.Infof("server %s limited the sending rate to %d kbit/s", server, m.RateKbps)
+			} else {
+				flog.Infof("server %s lifted the rate limit", server)
+			}
+		case protocol.CtrlNotice:
+			flog.Warnf("notice from server %s: %s", server, m.Text)
+		}
+	}
+}
+
+// migrate points new sessions at addr, if it is an IP address of a family
+// the client has an interface for, and reports whether it did.
+func (tc *timedConn) migrate(addr *tnet.Addr) bool {
+	ip := net.ParseIP(addr.Host)
+	if ip == nil {
+		flog.Warnf("ignoring migration to %s: not an IP address", addr)
+		return false
+	}
+	if tc.cfg.Network.Mode == "raw" && (ip.To4() != nil && tc.cfg.Network.IPv4.Addr == nil || ip.To4() == nil && tc.cfg.Network.IPv6.Addr == nil) {
+		flog.Warnf("ignoring migration to %s: no interface address of that family is configured", addr)
+		return false
+	}
+	uAddr := &net.UDPAddr{IP: ip, Port: addr.Port}
+	if old := tc.server.Swap(uAddr); old.String() != uAddr.String() {
+		flog.Infof("server asked to migrate from %s to %s", old, uAddr)
+	}
+	return true
+}
@@ -1,45 +1,93 @@
 package client
 
 import (
+	"errors"
 	"fmt"
 	"paqet/internal/flog"
+	"paqet/internal/protocol"
 	"paqet/internal/tnet"
 	"time"
 )
 
-func (c *Client) newConn() (tnet.Conn, error) {
+func (c *Client) newConn() (tnet.Conn, protocol.Version, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	autoExpire := 300
 	tc := c.iter.Next()
-	go tc.sendTCPF(tc.conn)
+	if d := tc.drain.Load(); d != nil && d.conn == tc.conn {
+		switch {
+		case d.migrate:
+			if conn, ver, err := tc.createConn(); err == nil {
+				flog.Infof("replaced connection to draining server, new streams go to %s", conn.RemoteAddr())
+				tc.conn, tc.ver = conn, ver
+			} else {
+				flog.Warnf("failed to replace connection to draining server: %v", err)
+			}
+		case time.Now().Before(d.deadline):
+			// Redialing would only reach the server that is going away.
+			return nil, 0, ErrServerDraining
+		}
+	}
+	go tc.sendTCPF(tc.conn, tc.ver)
 	err := tc.conn.Ping(false)
 	if err != nil {
 		flog.Infof("connection lost, retrying....")
 		if tc.conn != nil {
 			tc.conn.Close()
 		}
-		if c, err := tc.createConn(); err == nil {
-			tc.conn = c
+		if c, ver, err := tc.createConn(); err == nil {
+			tc.conn, tc.ver = c, ver
 		}
 		tc.expire = time.Now().Add(time.Duration(autoExpire) * time.Second)
 	}
-	return tc.conn, nil
+	return tc.conn, tc.ver, nil
 }
 
-func (c *Client) newStrm() (tnet.Strm, error) {
+// ErrServerDraining is returned while the server drains a conn after GOAWAY
+// without naming another address to move to.
+var ErrServerDraining = errors.New("server is going away")
+
+// ErrServerVersion is returned for requests the server's wire protocol
+// version cannot express.
+var ErrServerVersion = errors.New("server's wire protocol version is too old")
+
+// newStrm opens a stream and sends p as its header, in the wire version
+// negotiated with the server. It also returns the conn carrying the stream.
+// Servers below minVer are refused before anything is sent.
+func (c *Client) newStrm(p *protocol.Proto, minVer protocol.Version) (tnet.Strm, tnet.Conn, error) {
+	strm, conn, ver, err := c.openStrm(minVer)
+	if err != nil {
+		return nil, nil, err
+	}
+	p.Version = ver
+	if err := p.Write(strm); err != nil {
+		strm.Close()
+		return nil, nil, fmt.Errorf("failed to write protocol header on stream %d: %w", strm.SID(), err)
+	}
+	return strm, conn, nil
+}
+
+// openStrm opens a stream without writing anything on it, and returns the
+// wire version its header must use.
+func (c *Client) openStrm(minVer protocol.Version) (tnet.Strm, tnet.Conn, protocol.Version, error) {
 	for i := 0; i < 5; i++ {
-		conn, err := c.newConn()
+		conn, ver, err := c.newConn()
+		if errors.Is(err, ErrServerDraining) {
+			return nil, nil, 0, err
+		}
 		if err != nil || conn == nil {
 			time.Sleep(200 * time.Millisecond)
 			continue
 		}
+		if ver < minVer {
+			return nil, nil, 0, fmt.Errorf("%w: v%d, need v%d", ErrServerVersion, ver, minVer)
+		}
 		strm, err := conn.OpenStrm()
 		if err != nil {
 			time.Sleep(200 * time.Millisecond)
 			continue
 		}
-		return strm, nil
+		return strm, conn, ver, nil
 	}
-	return nil, fmt.Errorf("failed to open stream after 5 attempts")
+	return nil, nil, 0, fmt.Errorf("failed to open stream after 5 attempts")
 }
@@ -0,0 +1,145 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"paqet/internal/flog"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+	"sync"
+	"time"
+)
+
+// coalesceDelay is how long an early stream holds its header back for the
+// first payload. Protocols where the server speaks first pay it once.
+const coalesceDelay = 10 * time.Millisecond
+
+// TCPEarly opens a stream relayed to addr without waiting for the server to
+// connect. The header goes out together with the first write, and the dial
+// result is read ahead of the first payload: a failed dial shows up as a
+// *DialError from Read. Compressed early streams need a v5 server, which
+// agrees to every codec it knows; with older servers, and with servers
+// before v2 that send no dial result, TCPEarly behaves like TCP.
+func (c *Client) TCPEarly(addr string, codec byte) (tnet.Strm, error) {
+	tAddr, err := tnet.NewAddr(addr)
+	if err != nil {
+		flog.Debugf("invalid TCP address %s: %v", addr, err)
+		return nil, err
+	}
+
+	strm, _, ver, err := c.openStrm(protocol.VersionGob)
+	if err != nil {
+		flog.Debugf("failed to create stream for TCP %s: %v", addr, err)
+		return nil, err
+	}
+	p := protocol.Proto{Type: protocol.PTCP, Addr: tAddr, Codec: codec, Version: ver}
+	var hdr bytes.Buffer
+	if err := p.Write(&hdr); err != nil {
+		strm.Close()
+		return nil, err
+	}
+	if ver < protocol.Version2 || codec != tnet.CodecNone && ver < protocol.Version5 {
+		if _, err := strm.Write(hdr.Bytes()); err != nil {
+			strm.Close()
+			return nil, fmt.Errorf("failed to write protocol header on stream %d: %w", strm.SID(), err)
+		}
+		flog.Debugf("TCP stream %d created for %s", strm.SID(), addr)
+		s, _, err := awaitTCP(strm, &p)
+		return s, err
+	}
+	e := &earlyStrm{Strm: strm, p: &p, hdr: hdr.Bytes()}
+	e.timer = time.AfterFunc(coalesceDelay, e.flush)
+	flog.Debugf("early TCP stream %d created for %s", strm.SID(), addr)
+	return wrapTCP(e, ver, codec), nil
+}
+
+// earlyStrm is the raw stream under an early TCP stream's payload framing.
+type earlyStrm struct {
+	tnet.Strm
+	p *protocol.Proto
+
+	wmu   sync.Mutex
+	hdr   []byte
+	timer *time.Timer
+
+	rmu  sync.Mutex
+	read bool
+	err  error
+
+	// deadline is the caller's read deadline, put back once the dial
+	// result, which has a deadline of its own, is in.
+	dmu      sync.Mutex
+	deadline time.Time
+}
+
+// flush sends the header on its own when no payload came in time.
+func (e *earlyStrm) flush() {
+	e.wmu.Lock()
+	defer e.wmu.Unlock()
+	if e.hdr != nil {
+		e.Strm.Write(e.hdr)
+		e.hdr = nil
+	}
+}
+
+func (e *earlyStrm) Write(b []byte) (int, error) {
+	e.wmu.Lock()
+	defer e.wmu.Unlock()
+	if e.hdr == nil {
+		return e.Strm.Write(b)
+	}
+	e.timer.Stop()
+	buf := append(e.hdr, b...)
+	e.hdr = nil
+	if _, err := e.Strm.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (e *earlyStrm) Read(b []byte) (int, error) {
+	e.rmu.Lock()
+	if !e.read {
+		e.read = true
+		e.dmu.Lock()
+		deadline := time.Now().Add(dialResultTimeout)
+		if !e.deadline.IsZero() && e.deadline.Before(deadline) {
+			deadline = e.deadline
+		}
+		e.Strm.SetReadDeadline(deadline)
+		e.dmu.Unlock()
+		_, e.err = readDialResult(e.Strm, e.p)
+		e.dmu.Lock()
+		e.Strm.SetReadDeadline(e.deadline)
+		e.dmu.Unlock()
+	}
+	err := e.err
+	e.rmu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return e.Strm.Read(b)
+}
+
+func (e *earlyStrm) SetReadDeadline(t time.Time) error {
+	e.dmu.Lock()
+	defer e.dmu.Unlock()
+	e.deadline = t
+	return e.Strm.SetReadDeadline(t)
+}
+
+func (e *earlyStrm) SetDeadline(t time.Time) error {
+	e.dmu.Lock()
+	defer e.dmu.Unlock()
+	e.deadline = t
+	return e.Strm.SetDeadline(t)
+}
+
+func (e *earlyStrm) Close() error {
+	e.timer.Stop()
+	return e.Strm.Close()
+}
+
+func (e *earlyStrm) String() string {
+	return fmt.Sprintf("early stream %d", e.Strm.SID())
+}
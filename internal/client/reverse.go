@@ -0,0 +1,124 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/buffer"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+	"time"
+)
+
+// reverseRetry is the pause before registering a reverse tunnel again after
+// it failed or its connection was lost.
+const reverseRetry = 5 * time.Second
+
+// reverse keeps the tunnel r registered with the server until ctx ends.
+func (c *Client) reverse(ctx context.Context, r *conf.Reverse) {
+	for {
+		err := c.bindReverse(ctx, r)
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		flog.Warnf("reverse tunnel %s -> %s: %v, retrying in %v", r.ServerListen, r.LocalTarget, err, reverseRetry)
+		select {
+		case <-time.After(reverseRetry):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// bindReverse registers r and blocks for as long as the registration lasts.
+func (c *Client) bindReverse(ctx context.Context, r *conf.Reverse) error {
+	p := protocol.Proto{Type: protocol.PRBIND, Addr: r.ServerListen}
+	strm, _, err := c.newStrm(&p, protocol.Version1)
+	if err != nil {
+		return err
+	}
+	defer strm.Close()
+
+	strm.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var res protocol.Proto
+	if err := res.Read(strm); err != nil {
+		return fmt.Errorf("failed to read bind result on stream %d: %w", strm.SID(), err)
+	}
+	strm.SetReadDeadline(time.Time{})
+	if res.Type != protocol.PRBIND {
+		return fmt.Errorf("unexpected reply type %d on stream %d", res.Type, strm.SID())
+	}
+	if res.Status != protocol.StatusOK {
+		return fmt.Errorf("server refused to listen: %s", protocol.StatusText(res.Status))
+	}
+	flog.Infof("reverse tunnel listening on server %s -> %s", res.Addr, r.LocalTarget)
+
+	go func() {
+		<-ctx.Done()
+		strm.Close()
+	}()
+	// The server never writes to the bind stream; it ends with the tunnel.
+	io.Copy(io.Discard, strm)
+	return fmt.Errorf("tunnel closed")
+}
+
+// acceptStrms serves the streams the server opens on conn, which carry
+// connections accepted on reverse tunnels.
+func (tc *timedConn) acceptStrms(conn tnet.Conn) {
+	for {
+		strm, err := conn.AcceptStrm()
+		if err != nil {
+			flog.Debugf("stopped accepting server streams on %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		go func() {
+			defer strm.Close()
+			if err := tc.handleServerStrm(strm); err != nil {
+				flog.Errorf("server stream %d closed with error: %v", strm.SID(), err)
+			} else {
+				flog.Debugf("server stream %d closed", strm.SID())
+			}
+		}()
+	}
+}
+
+func (tc *timedConn) handleServerStrm(strm tnet.Strm) error {
+	strm.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var p protocol.Proto
+	if err := p.Read(strm); err != nil {
+		return fmt.Errorf("failed to read protocol header: %w", err)
+	}
+	strm.SetReadDeadline(time.Time{})
+	if p.Type != protocol.PRCONN || p.Addr == nil {
+		return fmt.Errorf("unexpected protocol type %d", p.Type)
+	}
+
+	var r *conf.Reverse
+	for i := range tc.cfg.Reverse {
+		if tc.cfg.Reverse[i].ServerListen.String() == p.Addr.String() {
+			r = &tc.cfg.Reverse[i]
+			break
+		}
+	}
+	if r == nil {
+		return fmt.Errorf("no reverse tunnel is configured for %s", p.Addr)
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(tc.ctx, "tcp", r.LocalTarget.String())
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", r.LocalTarget, err)
+	}
+	defer conn.Close()
+	flog.Infof("accepted reverse connection on %s -> %s (stream %d)", p.Addr, r.LocalTarget, strm.SID())
+
+	if p.Version >= protocol.Version4 {
+		return buffer.RelayT(tc.ctx, conn, tnet.NewHalfStrm(strm))
+	}
+	return buffer.RelayT(tc.ctx, conn, strm)
+}
@@ -1,33 +1,91 @@
 package client
 
 import (
+	"fmt"
 	"paqet/internal/flog"
 	"paqet/internal/protocol"
 	"paqet/internal/tnet"
+	"time"
 )
 
-func (c *Client) TCP(addr string) (tnet.Strm, error) {
-	strm, err := c.newStrm()
-	if err != nil {
-		flog.Debugf("failed to create stream for TCP %s: %v", addr, err)
-		return nil, err
-	}
+// dialResultTimeout bounds the wait for the server's dial result. The server
+// gives up dialing after 10 seconds.
+const dialResultTimeout = 15 * time.Second
+
+// DialError is returned by TCP when the server could not connect to the
+// target. Status is one of the protocol.Status values.
+type DialError struct {
+	Addr   string
+	Status byte
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("server could not connect to %s: %s", e.Addr, protocol.StatusText(e.Status))
+}
 
+// TCP opens a stream relayed to addr, compressed with codec if the server
+// agrees. The returned address is where the server's connection to addr
+// originates; it is nil for servers older than wire protocol v2, which relay
+// without confirming the connection first.
+func (c *Client) TCP(addr string, codec byte) (tnet.Strm, *tnet.Addr, error) {
 	tAddr, err := tnet.NewAddr(addr)
 	if err != nil {
 		flog.Debugf("invalid TCP address %s: %v", addr, err)
-		strm.Close()
-		return nil, err
+		return nil, nil, err
+	}
+
+	p := protocol.Proto{Type: protocol.PTCP, Addr: tAddr, Codec: codec}
+	strm, _, err := c.newStrm(&p, protocol.VersionGob)
+	if err != nil {
+		flog.Debugf("failed to create stream for TCP %s: %v", addr, err)
+		return nil, nil, err
+	}
+	flog.Debugf("TCP stream %d created for %s", strm.SID(), addr)
+	return awaitTCP(strm, &p)
+}
+
+// awaitTCP waits for the dial result to the header p already sent on strm.
+func awaitTCP(strm tnet.Strm, p *protocol.Proto) (tnet.Strm, *tnet.Addr, error) {
+	if p.Version < protocol.Version2 {
+		return strm, nil, nil
 	}
 
-	p := protocol.Proto{Type: protocol.PTCP, Addr: tAddr}
-	err = p.Write(strm)
+	strm.SetReadDeadline(time.Now().Add(dialResultTimeout))
+	r, err := readDialResult(strm, p)
 	if err != nil {
-		flog.Debugf("failed to write TCP protocol header for %s on stream %d: %v", addr, strm.SID(), err)
 		strm.Close()
-		return nil, err
+		return nil, nil, err
 	}
+	strm.SetReadDeadline(time.Time{})
+	return wrapTCP(strm, p.Version, r.Codec), r.Addr, nil
+}
 
-	flog.Debugf("TCP stream %d created for %s", strm.SID(), addr)
-	return strm, nil
+// readDialResult reads the server's answer to the TCP header p.
+func readDialResult(strm tnet.Strm, p *protocol.Proto) (*protocol.Proto, error) {
+	var r protocol.Proto
+	if err := r.Read(strm); err != nil {
+		return nil, fmt.Errorf("failed to read dial result on stream %d: %w", strm.SID(), err)
+	}
+	if r.Type != protocol.PTCP {
+		return nil, fmt.Errorf("unexpected reply type %d on stream %d", r.Type, strm.SID())
+	}
+	if r.Status != protocol.StatusOK {
+		return nil, &DialError{Addr: p.Addr.String(), Status: r.Status}
+	}
+	if r.Codec != tnet.CodecNone && r.Codec != p.Codec {
+		return nil, fmt.Errorf("server chose compression 0x%02x on stream %d, asked for 0x%02x", r.Codec, strm.SID(), p.Codec)
+	}
+	return &r, nil
+}
+
+// wrapTCP adds the payload framing of ver and codec to a TCP stream. Before
+// v4 the stream cannot half-close, so the relay ends with either direction.
+func wrapTCP(strm tnet.Strm, ver protocol.Version, codec byte) tnet.Strm {
+	if ver >= protocol.Version4 {
+		strm = tnet.NewHalfStrm(strm)
+	}
+	if codec != tnet.CodecNone {
+		strm = tnet.NewCompressStrm(strm, codec)
+	}
+	return strm
 }
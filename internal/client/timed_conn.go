@@ -2,26 +2,51 @@ package client
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"paqet/internal/conf"
+	"paqet/internal/flog"
 	"paqet/internal/protocol"
 	"paqet/internal/socket"
 	"paqet/internal/tnet"
 	"paqet/internal/tnet/kcp"
+	"paqet/internal/tnet/quic"
+	"paqet/internal/tnet/ws"
+	"sync/atomic"
 	"time"
 )
 
 type timedConn struct {
 	cfg    *conf.Conf
 	conn   tnet.Conn
+	ver    protocol.Version
 	expire time.Time
 	ctx    context.Context
+
+	// server is where new sessions go, shared by all conns of the client.
+	server *atomic.Pointer[net.UDPAddr]
+	drain  atomic.Pointer[drainState]
+
+	// fallbackUntil is when the primary protocol is tried again after it
+	// failed and the fallback took over.
+	fallbackUntil time.Time
 }
 
-func newTimedConn(ctx context.Context, cfg *conf.Conf) (*timedConn, error) {
+const (
+	// healthTimeout bounds the round trip that decides whether the primary
+	// protocol reaches the server.
+	healthTimeout = 5 * time.Second
+	// fallbackHold is how long a client stays on its fallback before trying
+	// the primary protocol again.
+	fallbackHold = time.Minute
+)
+
+func newTimedConn(ctx context.Context, cfg *conf.Conf, server *atomic.Pointer[net.UDPAddr]) (*timedConn, error) {
 	var err error
-	tc := timedConn{cfg: cfg, ctx: ctx}
-	tc.conn, err = tc.createConn()
+	tc := timedConn{cfg: cfg, ctx: ctx, server: server}
+	tc.conn, tc.ver, err = tc.createConn()
 	if err != nil {
 		return nil, err
 	}
@@ -29,32 +54,201 @@ func newTimedConn(ctx context.Context, cfg *conf.Conf) (*timedConn, error) {
 	return &tc, nil
 }
 
-func (tc *timedConn) createConn() (tnet.Conn, error) {
-	netCfg := tc.cfg.Network
-	pConn, err := socket.New(tc.ctx, &netCfg)
+// createConn sets up a session over the primary protocol, or over the
+// fallback one when the primary cannot reach the server.
+func (tc *timedConn) createConn() (tnet.Conn, protocol.Version, error) {
+	t := &tc.cfg.Transport
+	if t.Fallback == "" {
+		return tc.setupConn(t.Protocol)
+	}
+	if time.Now().Before(tc.fallbackUntil) {
+		return tc.setupConn(t.Fallback)
+	}
+	conn, ver, err := tc.setupConn(t.Protocol)
+	if err == nil {
+		return conn, ver, nil
+	}
+	flog.Warnf("%s transport failed its health check: %v; falling back to %s for %v", t.Protocol, err, t.Fallback, fallbackHold)
+	tc.fallbackUntil = time.Now().Add(fallbackHold)
+	return tc.setupConn(t.Fallback)
+}
+
+func (tc *timedConn) setupConn(proto string) (tnet.Conn, protocol.Version, error) {
+	var pConn *socket.PacketConn
+	if proto != "ws" {
+		netCfg := tc.cfg.Network
+		var err error
+		pConn, err = socket.New(tc.ctx, &netCfg)
+		if err != nil {
+			return nil, 0, fmt.Errorf("could not create packet conn: %w", err)
+		}
+	}
+
+	conn, err := tc.dial(proto, pConn)
+	if err != nil {
+		if pConn != nil {
+			pConn.Close()
+		}
+		return nil, 0, err
+	}
+	ver, err := tc.negotiate(conn)
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	if t := &tc.cfg.Transport; t.Fallback != "" && proto != t.Fallback && t.Wire != "auto" {
+		// In auto mode negotiate has already made the round trip.
+		if err := tc.healthCheck(conn, ver); err != nil {
+			conn.Close()
+			return nil, 0, err
+		}
+	}
+	if tc.cfg.Auth != nil {
+		if err := tc.authenticate(conn, ver); err != nil {
+			conn.Close()
+			return nil, 0, err
+		}
+	}
+	err = tc.sendTCPF(conn, ver)
 	if err != nil {
-		return nil, fmt.Errorf("could not create packet conn: %w", err)
+		conn.Close()
+		return nil, 0, err
+	}
+	if ver != protocol.VersionGob {
+		tc.openControl(conn, pConn, ver)
+	}
+	if len(tc.cfg.Reverse) > 0 {
+		go tc.acceptStrms(conn)
 	}
+	return conn, ver, nil
+}
+
+func (tc *timedConn) dial(proto string, pConn *socket.PacketConn) (tnet.Conn, error) {
+	t := &tc.cfg.Transport
+	switch proto {
+	case "ws":
+		return ws.Dial(t.WS)
+	case "quic":
+		return quic.Dial(tc.server.Load(), t.QUIC, pConn)
+	default:
+		return kcp.Dial(tc.server.Load(), t.KCP, pConn)
+	}
+}
 
-	conn, err := kcp.Dial(tc.cfg.Server.Addr, tc.cfg.Transport.KCP, pConn)
+// healthCheck pings the server at ver and waits for the pong.
+func (tc *timedConn) healthCheck(conn tnet.Conn, ver protocol.Version) error {
+	strm, err := conn.OpenStrm()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	defer strm.Close()
+	strm.SetDeadline(time.Now().Add(healthTimeout))
+
+	p := protocol.Proto{Type: protocol.PPING, Version: ver}
+	if err := p.Write(strm); err != nil {
+		return fmt.Errorf("failed to send health check: %w", err)
+	}
+	if err := p.Read(strm); err != nil {
+		return fmt.Errorf("no reply to health check: %w", err)
 	}
-	err = tc.sendTCPF(conn)
+	if p.Type != protocol.PPONG {
+		return fmt.Errorf("unexpected reply to health check: type %d", p.Type)
+	}
+	return nil
+}
+
+// negotiate picks the header encoding for conn. In auto mode it sends a ping
+// at our highest version: a current server answers with the version to use,
+// while a gob-only server fails to decode it and closes the stream.
+func (tc *timedConn) negotiate(conn tnet.Conn) (protocol.Version, error) {
+	switch tc.cfg.Transport.Wire {
+	case "gob":
+		return protocol.VersionGob, nil
+	case "v1":
+		return protocol.Version1, nil
+	case "v2":
+		return protocol.Version2, nil
+	case "v3":
+		return protocol.Version3, nil
+	case "v4":
+		return protocol.Version4, nil
+	case "v5":
+		return protocol.Version5, nil
+	}
+
+	strm, err := conn.OpenStrm()
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	return conn, nil
+	defer strm.Close()
+	strm.SetDeadline(time.Now().Add(10 * time.Second))
+
+	p := protocol.Proto{Type: protocol.PPING, Version: protocol.MaxVersion}
+	if err := p.Write(strm); err != nil {
+		return 0, fmt.Errorf("failed to send wire version probe: %w", err)
+	}
+	if err := p.Read(strm); err != nil {
+		// Only a clean close before the first byte is a gob-only server
+		// rejecting the probe; anything else must not cost us the binary
+		// header, or an attacker who can reset the stream could force gob.
+		if !errors.Is(err, io.EOF) {
+			return 0, fmt.Errorf("wire version probe failed: %w", err)
+		}
+		flog.Infof("server at %s does not speak wire protocol v%d, falling back to gob", tc.server.Load(), protocol.MaxVersion)
+		return protocol.VersionGob, nil
+	}
+	if p.Type != protocol.PPONG || p.Version == protocol.VersionGob || p.Version > protocol.MaxVersion {
+		return 0, fmt.Errorf("unexpected reply to wire version probe: type %d, version %d", p.Type, p.Version)
+	}
+	flog.Debugf("negotiated wire protocol v%d with %s", p.Version, tc.server.Load())
+	return p.Version, nil
+}
+
+// authenticate runs the session handshake described in protocol/auth.go.
+func (tc *timedConn) authenticate(conn tnet.Conn, ver protocol.Version) error {
+	if ver == protocol.VersionGob {
+		return fmt.Errorf("server at %s does not support authentication", tc.server.Load())
+	}
+	strm, err := conn.OpenStrm()
+	if err != nil {
+		return err
+	}
+	defer strm.Close()
+	strm.SetDeadline(time.Now().Add(10 * time.Second))
+
+	user := tc.cfg.Auth.User
+	p := protocol.Proto{Type: protocol.PAUTH, User: user, Version: ver}
+	if err := p.Write(strm); err != nil {
+		return fmt.Errorf("failed to send auth request: %w", err)
+	}
+	if err := p.Read(strm); err != nil {
+		return fmt.Errorf("failed to read auth challenge: %w", err)
+	}
+	if p.Type != protocol.PAUTH || len(p.Nonce) != protocol.NonceSize {
+		return fmt.Errorf("invalid auth challenge from server")
+	}
+	resp := protocol.Proto{Type: protocol.PAUTH, Proof: protocol.AuthProof(tc.cfg.Auth.Secret, user, p.Nonce, tnet.Binding(conn)), Version: ver}
+	if err := resp.Write(strm); err != nil {
+		return fmt.Errorf("failed to send auth response: %w", err)
+	}
+	if err := p.Read(strm); err != nil {
+		return fmt.Errorf("failed to read auth result: %w", err)
+	}
+	if p.Type != protocol.PAUTH || p.Status != protocol.StatusOK {
+		return fmt.Errorf("server rejected credentials for user %q", user)
+	}
+	flog.Debugf("authenticated to %s as %s", tc.server.Load(), user)
+	return nil
 }
 
-func (tc *timedConn) sendTCPF(conn tnet.Conn) error {
+func (tc *timedConn) sendTCPF(conn tnet.Conn, ver protocol.Version) error {
 	strm, err := conn.OpenStrm()
 	if err != nil {
 		return err
 	}
 	defer strm.Close()
 
-	p := protocol.Proto{Type: protocol.PTCPF, TCPF: tc.cfg.Network.TCP.RF}
+	p := protocol.Proto{Type: protocol.PTCPF, TCPF: tc.cfg.Network.TCP.RF, Version: ver}
 	err = p.Write(strm)
 	if err != nil {
 		return err
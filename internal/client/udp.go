@@ -17,25 +17,18 @@ func (c *Client) UDP(lAddr, tAddr string) (tnet.Strm, bool, uint64, error) {
 	}
 	c.udpPool.mu.RUnlock()
 
-	strm, err := c.newStrm()
-	if err != nil {
-		flog.Debugf("failed to create stream for UDP %s -> %s: %v", lAddr, tAddr, err)
-		return nil, false, 0, err
-	}
-
 	taddr, err := tnet.NewAddr(tAddr)
 	if err != nil {
 		flog.Debugf("invalid UDP address %s: %v", tAddr, err)
-		strm.Close()
 		return nil, false, 0, err
 	}
 	p := protocol.Proto{Type: protocol.PUDP, Addr: taddr}
-	err = p.Write(strm)
+	strm, conn, err := c.newStrm(&p, protocol.VersionGob)
 	if err != nil {
-		flog.Debugf("failed to write UDP protocol header for %s -> %s on stream %d: %v", lAddr, tAddr, strm.SID(), err)
-		strm.Close()
+		flog.Debugf("failed to create stream for UDP %s -> %s: %v", lAddr, tAddr, err)
 		return nil, false, 0, err
 	}
+	strm = framedUDP(conn, strm, p.Version, c.cfg.Transport.MaxDatagram)
 
 	c.udpPool.mu.Lock()
 	if strm2, exists := c.udpPool.strms[key]; exists {
@@ -50,6 +43,55 @@ func (c *Client) UDP(lAddr, tAddr string) (tnet.Strm, bool, uint64, error) {
 	return strm, true, key, nil
 }
 
+// UDPAssociate returns the UDP association stream for lAddr, opening one if
+// needed. Each frame on it carries a datagram with its peer address, see
+// protocol.AppendDatagram. It fails with ErrServerVersion when the server
+// predates associations.
+func (c *Client) UDPAssociate(lAddr string) (tnet.Strm, bool, uint64, error) {
+	key := hash.AddrPair(lAddr, "")
+	c.udpPool.mu.RLock()
+	if strm, exists := c.udpPool.strms[key]; exists {
+		c.udpPool.mu.RUnlock()
+		flog.Debugf("reusing UDP association stream %d for %s", strm.SID(), lAddr)
+		return strm, false, key, nil
+	}
+	c.udpPool.mu.RUnlock()
+
+	p := protocol.Proto{Type: protocol.PUDPA}
+	strm, conn, err := c.newStrm(&p, protocol.Version3)
+	if err != nil {
+		flog.Debugf("failed to create UDP association stream for %s: %v", lAddr, err)
+		return nil, false, 0, err
+	}
+	strm = framedUDP(conn, strm, p.Version, c.cfg.Transport.MaxDatagram+protocol.MaxAddrSize)
+
+	c.udpPool.mu.Lock()
+	if strm2, exists := c.udpPool.strms[key]; exists {
+		c.udpPool.mu.Unlock()
+		strm.Close()
+		return strm2, false, key, nil
+	}
+	c.udpPool.strms[key] = strm
+	c.udpPool.mu.Unlock()
+
+	flog.Debugf("UDP association stream %d created for %s", strm.SID(), lAddr)
+	return strm, true, key, nil
+}
+
 func (c *Client) CloseUDP(key uint64) error {
 	return c.udpPool.delete(key)
 }
+
+// framedUDP wraps a UDP stream in datagram framing, and moves it to the
+// conn's datagram path if it has one. Servers before wire protocol v3 relay
+// UDP as a plain byte stream.
+func framedUDP(conn tnet.Conn, strm tnet.Strm, ver protocol.Version, max int) tnet.Strm {
+	if ver < protocol.Version3 {
+		return strm
+	}
+	strm = tnet.NewDgramStrm(strm, max)
+	if dc, ok := conn.(tnet.DatagramConn); ok {
+		strm, _ = dc.BindDatagrams(strm)
+	}
+	return strm
+}
@@ -0,0 +1,122 @@
+package conf
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"paqet/internal/flog"
+)
+
+// User is a client identity accepted by the server. Disabled users keep their
+// entry, so revoking a credential does not need a new name later.
+type User struct {
+	Name        string `yaml:"name"`
+	Secret      string `yaml:"secret"`
+	Enabled     *bool  `yaml:"enabled"`
+	MaxSessions int    `yaml:"max_sessions"`
+
+	// Allow lists the destinations the user may reach. Any is allowed while
+	// it is empty.
+	Allow_ []string `yaml:"allow"`
+	Allow  []Dest   `yaml:"-"`
+}
+
+// Dest is an IP prefix a user may reach, on one port or, if Port is 0, on
+// all of them.
+type Dest struct {
+	Prefix netip.Prefix
+	Port   uint16
+}
+
+// Auth is the identity a client presents in its session handshake.
+type Auth struct {
+	User   string `yaml:"user"`
+	Secret string `yaml:"secret"`
+}
+
+func (u *User) setDefaults() {
+	if u.Enabled == nil {
+		v := true
+		u.Enabled = &v
+	}
+}
+
+func (u *User) validate() []error {
+	var errors []error
+
+	if u.Name == "" || len(u.Name) > 255 {
+		errors = append(errors, fmt.Errorf("name must be between 1-255 bytes"))
+	}
+	if u.Secret == "" {
+		errors = append(errors, fmt.Errorf("secret is required"))
+	} else if len(u.Secret) < 16 {
+		flog.Warnf("user %q has a secret shorter than 16 characters", u.Name)
+	}
+	if u.MaxSessions < 0 || u.MaxSessions > 65535 {
+		errors = append(errors, fmt.Errorf("max_sessions must be between 0-65535"))
+	}
+	u.Allow = nil
+	for i, s := range u.Allow_ {
+		d, err := parseDest(s)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("allow[%d] %v", i, err))
+			continue
+		}
+		u.Allow = append(u.Allow, d)
+	}
+
+	return errors
+}
+
+// parseDest reads a prefix or address with an optional port, as in
+// "10.0.0.0/8", "192.0.2.1:443" or "[2001:db8::/32]:443".
+func parseDest(s string) (Dest, error) {
+	host, port := s, ""
+	if strings.HasPrefix(s, "[") {
+		end := strings.LastIndex(s, "]:")
+		if end < 0 {
+			return Dest{}, fmt.Errorf("%q: bracketed address needs a port", s)
+		}
+		host, port = s[1:end], s[end+2:]
+	} else if strings.Count(s, ":") == 1 {
+		host, port, _ = strings.Cut(s, ":")
+	}
+
+	var d Dest
+	if strings.Contains(host, "/") {
+		p, err := netip.ParsePrefix(host)
+		if err != nil {
+			return Dest{}, fmt.Errorf("%q: %v", s, err)
+		}
+		d.Prefix = p.Masked()
+	} else {
+		a, err := netip.ParseAddr(host)
+		if err != nil {
+			return Dest{}, fmt.Errorf("%q: %v", s, err)
+		}
+		d.Prefix = netip.PrefixFrom(a, a.BitLen())
+	}
+	if port != "" {
+		n, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || n == 0 {
+			return Dest{}, fmt.Errorf("%q: port must be between 1-65535", s)
+		}
+		d.Port = uint16(n)
+	}
+	return d, nil
+}
+
+func (a *Auth) validate() []error {
+	var errors []error
+
+	if a.User == "" || len(a.User) > 255 {
+		errors = append(errors, fmt.Errorf("auth user must be between 1-255 bytes"))
+	}
+	if a.Secret == "" {
+		errors = append(errors, fmt.Errorf("auth secret is required"))
+	}
+
+	return errors
+}
@@ -0,0 +1,25 @@
+package conf
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestParseDest(t *testing.T) {
+	for s, want := range map[string]Dest{
+		"10.1.2.3/8":          {Prefix: netip.MustParsePrefix("10.0.0.0/8")},
+		"192.0.2.10:443":      {Prefix: netip.MustParsePrefix("192.0.2.10/32"), Port: 443},
+		"2001:db8::1":         {Prefix: netip.MustParsePrefix("2001:db8::1/128")},
+		"[2001:db8::/32]:443": {Prefix: netip.MustParsePrefix("2001:db8::/32"), Port: 443},
+	} {
+		got, err := parseDest(s)
+		if err != nil || got != want {
+			t.Errorf("parseDest(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "example.com", "10.0.0.0/33", "192.0.2.1:0", "192.0.2.1:70000", "[2001:db8::1]"} {
+		if d, err := parseDest(s); err == nil {
+			t.Errorf("parseDest(%q) = %v, want an error", s, d)
+		}
+	}
+}
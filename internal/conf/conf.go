@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"paqet/internal/flog"
+	"paqet/internal/tnet"
 	"slices"
 	"strings"
 
@@ -17,9 +18,18 @@ type Conf struct {
 	Listen    Server    `yaml:"listen"`
 	SOCKS5    []SOCKS5  `yaml:"socks5"`
 	Forward   []Forward `yaml:"forward"`
+	Reverse   []Reverse `yaml:"reverse"`
 	Network   Network   `yaml:"network"`
 	Server    Server    `yaml:"server"`
 	Transport Transport `yaml:"transport"`
+	Users     []User    `yaml:"users"`
+	Auth      *Auth     `yaml:"auth"`
+	Control   Control   `yaml:"control"`
+
+	// ReverseAllow lists the addresses clients may ask the server to listen
+	// on for reverse tunnels. Reverse tunnels are disabled while it is empty.
+	ReverseAllow_ []string     `yaml:"reverse_allow"`
+	ReverseAllow  []*tnet.Addr `yaml:"-"`
 }
 
 func LoadFromFile(path string) (*Conf, error) {
@@ -27,10 +37,13 @@ func LoadFromFile(path string) (*Conf, error) {
 	if err != nil {
 		return nil, err
 	}
+	return Load(data)
+}
 
+func Load(data []byte) (*Conf, error) {
 	var conf Conf
 
-	if err := yaml.Unmarshal(data, &conf); err != nil {
+	if err := unmarshal(data, &conf); err != nil {
 		return &conf, err
 	}
 
@@ -47,6 +60,16 @@ func LoadFromFile(path string) (*Conf, error) {
 	return &conf, nil
 }
 
+// unmarshal wraps yaml.Unmarshal, which can panic on some malformed documents.
+func unmarshal(data []byte, v any) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("failed to parse configuration: %v", r)
+		}
+	}()
+	return yaml.Unmarshal(data, v)
+}
+
 func (c *Conf) setDefaults() {
 	c.Log.setDefaults()
 	c.Listen.setDefaults()
@@ -59,14 +82,20 @@ func (c *Conf) setDefaults() {
 	c.Network.setDefaults(c.Role)
 	c.Server.setDefaults()
 	c.Transport.setDefaults(c.Role)
+	for i := range c.Users {
+		c.Users[i].setDefaults()
+	}
+	if c.Role == "server" {
+		c.Control.setDefaults()
+	}
 }
 
 func (c *Conf) validate() error {
 	var allErrors []error
 
 	allErrors = append(allErrors, c.Log.validate()...)
-	if c.Role == "client" && len(c.SOCKS5) == 0 && len(c.Forward) == 0 {
-		flog.Warnf("warning: client mode enabled but no SOCKS5 or forward configurations found")
+	if c.Role == "client" && len(c.SOCKS5) == 0 && len(c.Forward) == 0 && len(c.Reverse) == 0 {
+		flog.Warnf("warning: client mode enabled but no SOCKS5, forward or reverse configurations found")
 	}
 	for i := range c.SOCKS5 {
 		errs := c.SOCKS5[i].validate()
@@ -82,17 +111,73 @@ func (c *Conf) validate() error {
 		}
 	}
 
-	allErrors = append(allErrors, c.Network.validate()...)
-	allErrors = append(allErrors, c.Transport.validate()...)
+	for i := range c.Reverse {
+		errs := c.Reverse[i].validate()
+		for _, err := range errs {
+			allErrors = append(allErrors, fmt.Errorf("reverse[%d] %v", i, err))
+		}
+	}
+
+	// A WebSocket-only peer never touches the raw network.
+	wsOnly := c.Transport.Protocol == "ws"
+	if !wsOnly {
+		allErrors = append(allErrors, c.Network.validate()...)
+	}
+	allErrors = append(allErrors, c.Transport.validate(c.Role)...)
 	if c.Role == "server" {
-		allErrors = append(allErrors, c.Listen.validate()...)
+		if !wsOnly {
+			allErrors = append(allErrors, c.Listen.validate()...)
+		}
+		if c.Network.Mode == "socket" && c.Network.Port == 0 && c.Listen.Addr != nil {
+			c.Network.Port = c.Listen.Addr.Port
+		}
+		allErrors = append(allErrors, c.Control.validate()...)
+		names := make(map[string]bool, len(c.Users))
+		for i := range c.Users {
+			errs := c.Users[i].validate()
+			for _, err := range errs {
+				allErrors = append(allErrors, fmt.Errorf("users[%d] %v", i, err))
+			}
+			if names[c.Users[i].Name] {
+				allErrors = append(allErrors, fmt.Errorf("users[%d] duplicate name %q", i, c.Users[i].Name))
+			}
+			names[c.Users[i].Name] = true
+		}
+		if len(c.Users) > 0 && c.Transport.Wire == "gob" {
+			allErrors = append(allErrors, fmt.Errorf("users are not supported with transport wire gob"))
+		}
+		c.ReverseAllow = nil
+		for i, addr := range c.ReverseAllow_ {
+			a, err := validateListen(addr)
+			if err != nil {
+				allErrors = append(allErrors, fmt.Errorf("reverse_allow[%d] %v", i, err))
+				continue
+			}
+			c.ReverseAllow = append(c.ReverseAllow, a)
+		}
+		if len(c.ReverseAllow_) > 0 && c.Transport.Wire == "gob" {
+			allErrors = append(allErrors, fmt.Errorf("reverse tunnels are not supported with transport wire gob"))
+		}
 	} else {
-		allErrors = append(allErrors, c.Server.validate()...)
-		if c.Server.Addr.IP.To4() != nil && c.Network.IPv4.Addr == nil {
-			allErrors = append(allErrors, fmt.Errorf("server address is IPv4, but the IPv4 interface is not configured"))
+		if !wsOnly {
+			allErrors = append(allErrors, c.Server.validate()...)
+		}
+		if c.Server.Addr != nil && c.Network.Mode == "raw" && !wsOnly {
+			if c.Server.Addr.IP.To4() != nil && c.Network.IPv4.Addr == nil {
+				allErrors = append(allErrors, fmt.Errorf("server address is IPv4, but the IPv4 interface is not configured"))
+			}
+			if c.Server.Addr.IP.To4() == nil && c.Network.IPv6.Addr == nil {
+				allErrors = append(allErrors, fmt.Errorf("server address is IPv6, but the IPv6 interface is not configured"))
+			}
+		}
+		if c.Auth != nil {
+			allErrors = append(allErrors, c.Auth.validate()...)
+			if c.Transport.Wire == "gob" {
+				allErrors = append(allErrors, fmt.Errorf("auth is not supported with transport wire gob"))
+			}
 		}
-		if c.Server.Addr.IP.To4() == nil && c.Network.IPv6.Addr == nil {
-			allErrors = append(allErrors, fmt.Errorf("server address is IPv6, but the IPv6 interface is not configured"))
+		if len(c.Reverse) > 0 && c.Transport.Wire == "gob" {
+			allErrors = append(allErrors, fmt.Errorf("reverse tunnels are not supported with transport wire gob"))
 		}
 		if c.Transport.Conn > 1 && c.Network.Port != 0 {
 			allErrors = append(allErrors, fmt.Errorf("only one connection is allowed when a client port is explicitly set"))
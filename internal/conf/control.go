@@ -0,0 +1,62 @@
+package conf
+
+import (
+	"fmt"
+	"net"
+	"paqet/internal/tnet"
+)
+
+// Control holds what the server tells clients over their control streams:
+// settings pushed when a session starts, and where to go when it shuts down.
+type Control struct {
+	DrainMs  int      `yaml:"drain_ms"`
+	Migrate_ string   `yaml:"migrate"`
+	Notice   string   `yaml:"notice"`
+	RateKbps int      `yaml:"rate_kbps"`
+	TCPF_    []string `yaml:"tcp_flags"`
+
+	Migrate *tnet.Addr `yaml:"-"`
+	TCPF    []TCPF     `yaml:"-"`
+}
+
+func (c *Control) setDefaults() {
+	if c.DrainMs == 0 {
+		c.DrainMs = 10000
+	}
+}
+
+func (c *Control) validate() []error {
+	var errors []error
+
+	if c.DrainMs < 0 || c.DrainMs > 3600*1000 {
+		errors = append(errors, fmt.Errorf("control drain_ms must be between 0-3600000"))
+	}
+	c.Migrate = nil
+	if c.Migrate_ != "" {
+		a, err := tnet.NewAddr(c.Migrate_)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("control migrate %v", err))
+		} else if net.ParseIP(a.Host) == nil || a.Port < 1 || a.Port > 65535 {
+			errors = append(errors, fmt.Errorf("control migrate must be an IP address and port"))
+		} else {
+			c.Migrate = a
+		}
+	}
+	if len(c.Notice) > 1024 {
+		errors = append(errors, fmt.Errorf("control notice must be at most 1024 bytes"))
+	}
+	if c.RateKbps < 0 {
+		errors = append(errors, fmt.Errorf("control rate_kbps must be >= 0 (0 = no limit)"))
+	}
+	c.TCPF = nil
+	for _, s := range c.TCPF_ {
+		f, err := strTCPF(s)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("control tcp_flags %v", err))
+			continue
+		}
+		c.TCPF = append(c.TCPF, f)
+	}
+
+	return errors
+}
@@ -0,0 +1,85 @@
+package conf
+
+import (
+	"fmt"
+	"slices"
+)
+
+// FEC selects how KCP adds forward error correction. Static mode uses the
+// fixed dshard and pshard of the KCP block; adaptive mode sizes the parity to
+// the loss the peer reports, within the bounds below.
+type FEC struct {
+	Mode string `yaml:"mode"`
+
+	MinDshard int `yaml:"min_dshard"`
+	MaxDshard int `yaml:"max_dshard"`
+	MinPshard int `yaml:"min_pshard"`
+	MaxPshard int `yaml:"max_pshard"`
+
+	// OnLoss and OffLoss are loss rates in percent. Parity starts above the
+	// first and stops below the second.
+	OnLoss  float64 `yaml:"on_loss"`
+	OffLoss float64 `yaml:"off_loss"`
+
+	IntervalMs int `yaml:"interval_ms"`
+	Hold       int `yaml:"hold"`
+}
+
+func (f *FEC) setDefaults() {
+	if f.Mode == "" {
+		f.Mode = "static"
+	}
+	if f.MinDshard == 0 {
+		f.MinDshard = 4
+	}
+	if f.MaxDshard == 0 {
+		f.MaxDshard = 16
+	}
+	if f.MinPshard == 0 {
+		f.MinPshard = 1
+	}
+	if f.MaxPshard == 0 {
+		f.MaxPshard = 8
+	}
+	if f.OnLoss == 0 {
+		f.OnLoss = 1
+	}
+	if f.OffLoss == 0 {
+		f.OffLoss = 0.3
+	}
+	if f.IntervalMs == 0 {
+		f.IntervalMs = 1000
+	}
+	if f.Hold == 0 {
+		f.Hold = 5
+	}
+}
+
+func (f *FEC) validate() []error {
+	var errors []error
+
+	validModes := []string{"static", "adaptive"}
+	if !slices.Contains(validModes, f.Mode) {
+		errors = append(errors, fmt.Errorf("KCP fec mode must be one of: %v", validModes))
+	}
+	if f.Mode != "adaptive" {
+		return errors
+	}
+	if f.MinDshard < 1 || f.MaxDshard > 128 || f.MinDshard > f.MaxDshard {
+		errors = append(errors, fmt.Errorf("KCP fec min_dshard and max_dshard must be between 1-128, min not above max"))
+	}
+	if f.MinPshard < 1 || f.MaxPshard > 64 || f.MinPshard > f.MaxPshard {
+		errors = append(errors, fmt.Errorf("KCP fec min_pshard and max_pshard must be between 1-64, min not above max"))
+	}
+	if f.OffLoss <= 0 || f.OnLoss > 50 || f.OffLoss >= f.OnLoss {
+		errors = append(errors, fmt.Errorf("KCP fec off_loss and on_loss must be between 0-50 percent, off below on"))
+	}
+	if f.IntervalMs < 100 || f.IntervalMs > 60000 {
+		errors = append(errors, fmt.Errorf("KCP fec interval_ms must be between 100-60000"))
+	}
+	if f.Hold < 1 || f.Hold > 100 {
+		errors = append(errors, fmt.Errorf("KCP fec hold must be between 1-100 reports"))
+	}
+
+	return errors
+}
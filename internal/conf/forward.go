@@ -1,6 +1,7 @@
 package conf
 
 import (
+	"fmt"
 	"net"
 	"paqet/internal/tnet"
 )
@@ -9,13 +10,31 @@ type Forward struct {
 	Listen_  string       `yaml:"listen"`
 	Target_  string       `yaml:"target"`
 	Protocol string       `yaml:"protocol"`
+	Compress string       `yaml:"compress"`
+	ZeroRTT  bool         `yaml:"zero_rtt"`
 	Listen   *net.UDPAddr `yaml:"-"`
 	Target   *tnet.Addr   `yaml:"-"`
+	Codec    byte         `yaml:"-"`
 }
 
-func (c *Forward) setDefaults() {}
+func (c *Forward) setDefaults() {
+	if c.Compress == "" {
+		c.Compress = "none"
+	}
+}
 func (c *Forward) validate() []error {
 	var errors []error
+
+	codec, err := validateCodec(c.Compress)
+	if err != nil {
+		errors = append(errors, err)
+	} else if codec != tnet.CodecNone && c.Protocol != "tcp" {
+		errors = append(errors, fmt.Errorf("compress only applies to tcp forwards"))
+	}
+	c.Codec = codec
+	if c.ZeroRTT && c.Protocol != "tcp" {
+		errors = append(errors, fmt.Errorf("zero_rtt only applies to tcp forwards"))
+	}
 	l, err := validateAddr(c.Listen_, true)
 	if err != nil {
 		errors = append(errors, err)
@@ -30,3 +49,11 @@ func (c *Forward) validate() []error {
 
 	return errors
 }
+
+func validateCodec(name string) (byte, error) {
+	codec, ok := tnet.Codecs[name]
+	if !ok {
+		return 0, fmt.Errorf("compress must be one of: none, zstd, snappy")
+	}
+	return codec, nil
+}
@@ -0,0 +1,86 @@
+package conf
+
+import (
+	"strings"
+	"testing"
+)
+
+func FuzzStrTCPF(f *testing.F) {
+	for _, s := range []string{"PA", "S", "SA", "A", "FPU", "RA", "NCE", "", "X", "PAZ"} {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		flags, err := strTCPF(s)
+		if err != nil {
+			return
+		}
+		for _, ch := range s {
+			if !strings.ContainsRune("FSRPAUECN", ch) {
+				t.Fatalf("accepted invalid flag %q in %q", ch, s)
+			}
+		}
+
+		// The canonical spelling must parse back to the same flag set.
+		var canon strings.Builder
+		for _, fl := range []struct {
+			set bool
+			ch  byte
+		}{
+			{flags.FIN, 'F'}, {flags.SYN, 'S'}, {flags.RST, 'R'}, {flags.PSH, 'P'}, {flags.ACK, 'A'},
+			{flags.URG, 'U'}, {flags.ECE, 'E'}, {flags.CWR, 'C'}, {flags.NS, 'N'},
+		} {
+			if fl.set {
+				canon.WriteByte(fl.ch)
+			}
+		}
+		again, err := strTCPF(canon.String())
+		if err != nil || again != flags {
+			t.Fatalf("%q -> %+v, canonical %q -> %+v (%v)", s, flags, canon.String(), again, err)
+		}
+	})
+}
+
+func FuzzLoad(f *testing.F) {
+	f.Add([]byte(`role: "client"
+socks5:
+  - listen: "127.0.0.1:1080"
+network:
+  interface: "lo"
+  ipv4:
+    addr: "127.0.0.1:0"
+    router_mac: "aa:bb:cc:dd:ee:ff"
+server:
+  addr: "127.0.0.1:9999"
+transport:
+  protocol: "kcp"
+  kcp:
+    block: "none"
+`))
+	f.Add([]byte(`role: "server"
+listen:
+  addr: ":9999"
+network:
+  interface: "lo"
+  ipv4:
+    addr: "127.0.0.1:9999"
+    router_mac: "aa:bb:cc:dd:ee:ff"
+  tcp:
+    local_flag: ["PA", "S"]
+transport:
+  protocol: "kcp"
+  kcp:
+    block: "null"
+`))
+	f.Add([]byte(`role: "server"
+transport:
+  protocol: "kcp"
+`))
+	f.Add([]byte("role: [}"))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Only panics matter here; invalid configurations must come back as errors.
+		Load(data)
+	})
+}
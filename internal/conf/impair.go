@@ -0,0 +1,87 @@
+package conf
+
+import (
+	"fmt"
+)
+
+// Impair describes synthetic network impairment applied to outgoing packets.
+// Percentages are in the range 0-100, like netem.
+type Impair struct {
+	Loss      float64        `yaml:"loss"`
+	Burst     GilbertElliott `yaml:"burst"`
+	DelayMs   int            `yaml:"delay_ms"`
+	JitterMs  int            `yaml:"jitter_ms"`
+	Reorder   float64        `yaml:"reorder"`
+	ReorderMs int            `yaml:"reorder_ms"`
+	Duplicate float64        `yaml:"duplicate"`
+	RateKbps  int            `yaml:"rate_kbps"`
+	QueueMs   int            `yaml:"queue_ms"`
+	Seed      int64          `yaml:"seed"`
+}
+
+// GilbertElliott is a two-state burst loss model. P is the chance of moving
+// from the good to the bad state per packet, R the chance of moving back.
+type GilbertElliott struct {
+	P        float64 `yaml:"p"`
+	R        float64 `yaml:"r"`
+	LossGood float64 `yaml:"loss_good"`
+	LossBad  float64 `yaml:"loss_bad"`
+}
+
+func (i *Impair) setDefaults() {
+	if i.ReorderMs == 0 {
+		i.ReorderMs = 10
+	}
+	if i.QueueMs == 0 {
+		i.QueueMs = 1000
+	}
+	if i.Burst.P > 0 && i.Burst.R == 0 {
+		i.Burst.R = 25
+	}
+	if i.Burst.P > 0 && i.Burst.LossBad == 0 {
+		i.Burst.LossBad = 100
+	}
+}
+
+// WithDefaults returns a copy of i with unset fields at their defaults, for
+// impairment set up outside a loaded configuration.
+func (i Impair) WithDefaults() *Impair {
+	i.setDefaults()
+	return &i
+}
+
+func (i *Impair) validate() []error {
+	var errors []error
+
+	percents := map[string]float64{
+		"loss":            i.Loss,
+		"reorder":         i.Reorder,
+		"duplicate":       i.Duplicate,
+		"burst.p":         i.Burst.P,
+		"burst.r":         i.Burst.R,
+		"burst.loss_good": i.Burst.LossGood,
+		"burst.loss_bad":  i.Burst.LossBad,
+	}
+	for name, v := range percents {
+		if v < 0 || v > 100 {
+			errors = append(errors, fmt.Errorf("impair %s must be between 0-100 percent", name))
+		}
+	}
+	if i.DelayMs < 0 || i.DelayMs > 60000 {
+		errors = append(errors, fmt.Errorf("impair delay_ms must be between 0-60000"))
+	}
+	if i.JitterMs < 0 || i.JitterMs > i.DelayMs {
+		errors = append(errors, fmt.Errorf("impair jitter_ms must be between 0 and delay_ms"))
+	}
+	if i.ReorderMs < 1 || i.ReorderMs > 60000 {
+		errors = append(errors, fmt.Errorf("impair reorder_ms must be between 1-60000"))
+	}
+	if i.RateKbps < 0 {
+		errors = append(errors, fmt.Errorf("impair rate_kbps must be >= 0"))
+	}
+	if i.QueueMs < 1 || i.QueueMs > 60000 {
+		errors = append(errors, fmt.Errorf("impair queue_ms must be between 1-60000"))
+	}
+
+	return errors
+}
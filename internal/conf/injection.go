@@ -0,0 +1,50 @@
+package conf
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Injection configures detection of packets forged by middleboxes, based on
+// header fields that an on-path injector rarely gets right.
+type Injection struct {
+	Action       string `yaml:"action"`
+	TTLTolerance int    `yaml:"ttl_tolerance"`
+	LearnPackets int    `yaml:"learn_packets"`
+	Checksum     *bool  `yaml:"checksum"`
+}
+
+func (i *Injection) setDefaults() {
+	if i.Action == "" {
+		i.Action = "flag"
+	}
+	if i.TTLTolerance == 0 {
+		i.TTLTolerance = 2
+	}
+	if i.LearnPackets == 0 {
+		i.LearnPackets = 32
+	}
+	if i.Checksum == nil {
+		// Checksum offload hands over frames with partial checksums on many
+		// NICs, so verification is opt-in.
+		v := false
+		i.Checksum = &v
+	}
+}
+
+func (i *Injection) validate() []error {
+	var errors []error
+
+	validActions := []string{"flag", "drop"}
+	if !slices.Contains(validActions, i.Action) {
+		errors = append(errors, fmt.Errorf("injection action must be one of: %v", validActions))
+	}
+	if i.TTLTolerance < 0 || i.TTLTolerance > 255 {
+		errors = append(errors, fmt.Errorf("injection ttl_tolerance must be between 0-255"))
+	}
+	if i.LearnPackets < 1 || i.LearnPackets > 65535 {
+		errors = append(errors, fmt.Errorf("injection learn_packets must be between 1-65535"))
+	}
+
+	return errors
+}
@@ -3,6 +3,7 @@ package conf
 import (
 	"fmt"
 	"slices"
+	"time"
 
 	"github.com/xtaci/kcp-go/v5"
 )
@@ -21,17 +22,35 @@ type KCP struct {
 	Sndwnd int `yaml:"sndwnd"`
 	Dshard int `yaml:"dshard"`
 	Pshard int `yaml:"pshard"`
+	FEC    FEC `yaml:"fec"`
 
-	Block_ string `yaml:"block"`
-	Key    string `yaml:"key"`
+	Block_       string `yaml:"block"`
+	Key          string `yaml:"key"`
+	Keys_        []Key  `yaml:"keys"`
+	KDF          KDF    `yaml:"kdf"`
+	Handshake    string `yaml:"handshake"`
+	ReplayWindow int    `yaml:"replay_window"`
+
+	UDPPath string `yaml:"udp_path"`
 
 	Smuxbuf   int `yaml:"smuxbuf"`
 	Streambuf int `yaml:"streambuf"`
 
+	// Mux is the stream multiplexer a client asks for; servers run whichever
+	// one the client picked.
+	Mux                string `yaml:"mux"`
+	SmuxVersion        int    `yaml:"smux_version"`
+	KeepaliveMs        int    `yaml:"keepalive_ms"`
+	KeepaliveTimeoutMs int    `yaml:"keepalive_timeout_ms"`
+	MaxFrame           int    `yaml:"max_frame"`
+
 	MaxSessions          int `yaml:"max_sessions"`
 	MaxStreamsPerSession int `yaml:"max_streams_per_session"`
 
+	// Keys is keys, or key as a rotation list of one, with every key derived.
+	Keys  []Key          `yaml:"-"`
 	Block kcp.BlockCrypt `yaml:"-"`
+	PSK   []byte         `yaml:"-"`
 }
 
 func (k *KCP) setDefaults(role string) {
@@ -55,10 +74,23 @@ func (k *KCP) setDefaults(role string) {
 	// if k.Pshard == 0 {
 	// 	k.Pshard = 3
 	// }
+	k.FEC.setDefaults()
 
 	if k.Block_ == "" {
 		k.Block_ = "aes"
 	}
+	if k.Handshake == "" {
+		// Peers without the handshake send bare block-encrypted KCP, so it
+		// stays opt-in; warnStatic points out what none leaves open.
+		k.Handshake = "none"
+	}
+	k.KDF.setDefaults()
+	if k.UDPPath == "" {
+		k.UDPPath = "stream"
+	}
+	if k.ReplayWindow == 0 {
+		k.ReplayWindow = 4096
+	}
 
 	if k.Smuxbuf == 0 {
 		k.Smuxbuf = 4 * 1024 * 1024
@@ -66,6 +98,21 @@ func (k *KCP) setDefaults(role string) {
 	if k.Streambuf == 0 {
 		k.Streambuf = 256 * 1024
 	}
+	if k.Mux == "" {
+		k.Mux = "smux"
+	}
+	if k.SmuxVersion == 0 {
+		k.SmuxVersion = 2
+	}
+	if k.KeepaliveMs == 0 {
+		k.KeepaliveMs = 2000
+	}
+	if k.KeepaliveTimeoutMs == 0 {
+		k.KeepaliveTimeoutMs = 8000
+	}
+	if k.MaxFrame == 0 {
+		k.MaxFrame = 65535
+	}
 	if k.MaxSessions == 0 {
 		k.MaxSessions = 128
 	}
@@ -93,18 +140,32 @@ func (k *KCP) validate() []error {
 		errors = append(errors, fmt.Errorf("KCP sndwnd must be between 1-32768"))
 	}
 
-	validBlocks := []string{"aes", "aes-128", "aes-128-gcm", "aes-192", "salsa20", "blowfish", "twofish", "cast5", "3des", "tea", "xtea", "xor", "sm4", "none", "null"}
+	errors = append(errors, k.FEC.validate()...)
+	if k.FEC.Mode == "adaptive" && (k.Dshard != 0 || k.Pshard != 0) {
+		errors = append(errors, fmt.Errorf("KCP dshard and pshard must be unset with fec mode adaptive"))
+	}
+
+	validBlocks := []string{"aes", "aes-128", "aes-128-gcm", "chacha20-poly1305", "xchacha20-poly1305", "aes-192", "salsa20", "blowfish", "twofish", "cast5", "3des", "tea", "xtea", "xor", "sm4", "none", "null"}
 	if !slices.Contains(validBlocks, k.Block_) {
 		errors = append(errors, fmt.Errorf("KCP encryption block must be one of: %v", validBlocks))
 	}
-	if !slices.Contains([]string{"none", "null"}, k.Block_) && len(k.Key) == 0 {
-		errors = append(errors, fmt.Errorf("KCP encryption key is required"))
+	validHandshakes := []string{"none", "x25519"}
+	if !slices.Contains(validHandshakes, k.Handshake) {
+		errors = append(errors, fmt.Errorf("KCP handshake must be one of: %v", validHandshakes))
+	}
+	if k.Handshake == "x25519" && (k.ReplayWindow < 64 || k.ReplayWindow > 1<<20) {
+		errors = append(errors, fmt.Errorf("KCP replay_window must be between 64-1048576 packets"))
 	}
-	b, err := newBlock(k.Block_, k.Key)
-	if err != nil {
-		errors = append(errors, err)
+	kdfErrors := k.KDF.validate()
+	errors = append(errors, kdfErrors...)
+	if len(kdfErrors) == 0 && slices.Contains(validBlocks, k.Block_) {
+		errors = append(errors, k.validateKeys()...)
+	}
+
+	validUDPPaths := []string{"stream", "datagram"}
+	if !slices.Contains(validUDPPaths, k.UDPPath) {
+		errors = append(errors, fmt.Errorf("KCP udp_path must be one of: %v", validUDPPaths))
 	}
-	k.Block = b
 
 	if k.Smuxbuf < 1024 {
 		errors = append(errors, fmt.Errorf("KCP smuxbuf must be >= 1024 bytes"))
@@ -112,6 +173,25 @@ func (k *KCP) validate() []error {
 	if k.Streambuf < 1024 {
 		errors = append(errors, fmt.Errorf("KCP streambuf must be >= 1024 bytes"))
 	}
+	validMuxes := []string{"smux", "yamux"}
+	if !slices.Contains(validMuxes, k.Mux) {
+		errors = append(errors, fmt.Errorf("KCP mux must be one of: %v", validMuxes))
+	}
+	if k.Mux == "yamux" && k.Streambuf < 256*1024 {
+		errors = append(errors, fmt.Errorf("KCP streambuf must be >= 262144 bytes with mux yamux"))
+	}
+	if k.SmuxVersion != 1 && k.SmuxVersion != 2 {
+		errors = append(errors, fmt.Errorf("KCP smux_version must be 1 or 2"))
+	}
+	if k.KeepaliveMs < 100 || k.KeepaliveMs > 300000 {
+		errors = append(errors, fmt.Errorf("KCP keepalive_ms must be between 100-300000"))
+	}
+	if k.KeepaliveTimeoutMs < k.KeepaliveMs || k.KeepaliveTimeoutMs > 3600000 {
+		errors = append(errors, fmt.Errorf("KCP keepalive_timeout_ms must be between keepalive_ms and 3600000"))
+	}
+	if k.MaxFrame < 1024 || k.MaxFrame > 65535 {
+		errors = append(errors, fmt.Errorf("KCP max_frame must be between 1024-65535 bytes"))
+	}
 	if k.MaxSessions < 1 || k.MaxSessions > 65535 {
 		errors = append(errors, fmt.Errorf("KCP max_sessions must be between 1-65535"))
 	}
@@ -121,3 +201,78 @@ func (k *KCP) validate() []error {
 
 	return errors
 }
+
+// validateKeys derives every configured key. A single key is treated as a
+// rotation list of one; Block and PSK are set from the first key valid now,
+// which is the one a client uses.
+func (k *KCP) validateKeys() []error {
+	var errors []error
+
+	if k.Key != "" && len(k.Keys_) > 0 {
+		return append(errors, fmt.Errorf("KCP key and keys are mutually exclusive"))
+	}
+	unencrypted := slices.Contains([]string{"none", "null"}, k.Block_) && k.Handshake != "x25519"
+	if len(k.Keys_) > 0 && unencrypted {
+		errors = append(errors, fmt.Errorf("KCP keys require an encryption block or the x25519 handshake"))
+	}
+	k.Keys = slices.Clone(k.Keys_)
+	if len(k.Keys) == 0 {
+		if k.Key == "" && !unencrypted {
+			if k.Handshake == "x25519" {
+				return append(errors, fmt.Errorf("KCP handshake x25519 requires a key"))
+			}
+			return append(errors, fmt.Errorf("KCP encryption key is required"))
+		}
+		k.Keys = []Key{{Name: "default", Key: k.Key}}
+	}
+
+	seen := make(map[string]bool)
+	for i := range k.Keys {
+		key := &k.Keys[i]
+		for _, err := range key.validate() {
+			errors = append(errors, fmt.Errorf("KCP keys[%d]: %w", i, err))
+		}
+		if seen[key.Name] {
+			errors = append(errors, fmt.Errorf("KCP keys[%d]: duplicate name %q", i, key.Name))
+		}
+		seen[key.Name] = true
+		if key.Key == "" && !unencrypted {
+			errors = append(errors, fmt.Errorf("KCP keys[%d]: key is required", i))
+			continue
+		}
+
+		dkey, err := k.KDF.derive(key.Key)
+		if err != nil {
+			errors = append(errors, err)
+			continue
+		}
+		if k.Handshake == "x25519" {
+			// Sessions are encrypted with their own keys; the shared key only
+			// authenticates the handshake.
+			key.PSK = dkey
+		} else if key.Block, err = newBlock(k.Block_, dkey); err != nil {
+			errors = append(errors, err)
+		}
+	}
+	if len(errors) > 0 {
+		return errors
+	}
+
+	now := time.Now()
+	for i := range k.Keys {
+		if k.Keys[i].Valid(now) {
+			k.Block, k.PSK = k.Keys[i].Block, k.Keys[i].PSK
+			return nil
+		}
+	}
+	return append(errors, fmt.Errorf("KCP keys: no key is valid at %s", now.Format(time.RFC3339)))
+}
+
+// Rotating reports whether the server has to pick a key per client rather
+// than use one fixed key.
+func (k *KCP) Rotating() bool {
+	if len(k.Keys) > 1 {
+		return true
+	}
+	return len(k.Keys) == 1 && (!k.Keys[0].NotBefore.IsZero() || !k.Keys[0].NotAfter.IsZero())
+}
@@ -1,11 +1,11 @@
 package conf
 
 import (
-	"crypto/sha256"
+	"crypto/cipher"
 	"fmt"
 
 	"github.com/xtaci/kcp-go/v5"
-	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 type blockCrypt struct {
@@ -14,26 +14,35 @@ type blockCrypt struct {
 }
 
 var blockCrypts = map[string]blockCrypt{
-	"aes":         {0, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewAESBlockCrypt(key) }},
-	"aes-128":     {16, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewAESBlockCrypt(key) }},
-	"aes-128-gcm": {16, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewAESGCMCrypt(key) }},
-	"aes-192":     {24, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewAESBlockCrypt(key) }},
-	"salsa20":     {0, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewSalsa20BlockCrypt(key) }},
-	"blowfish":    {0, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewBlowfishBlockCrypt(key) }},
-	"twofish":     {0, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewTwofishBlockCrypt(key) }},
-	"cast5":       {16, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewCast5BlockCrypt(key) }},
-	"3des":        {24, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewTripleDESBlockCrypt(key) }},
-	"tea":         {16, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewTEABlockCrypt(key) }},
-	"xtea":        {16, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewXTEABlockCrypt(key) }},
-	"xor":         {0, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewSimpleXORBlockCrypt(key) }},
-	"sm4":         {16, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewSM4BlockCrypt(key) }},
-	"none":        {0, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewNoneBlockCrypt(key) }},
-	"null":        {0, func(key []byte) (kcp.BlockCrypt, error) { return nil, nil }},
+	"aes":                {0, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewAESBlockCrypt(key) }},
+	"aes-128":            {16, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewAESBlockCrypt(key) }},
+	"aes-128-gcm":        {16, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewAESGCMCrypt(key) }},
+	"chacha20-poly1305":  {32, func(key []byte) (kcp.BlockCrypt, error) { return newAEADBlock(chacha20poly1305.New(key)) }},
+	"xchacha20-poly1305": {32, func(key []byte) (kcp.BlockCrypt, error) { return newAEADBlock(chacha20poly1305.NewX(key)) }},
+	"aes-192":            {24, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewAESBlockCrypt(key) }},
+	"salsa20":            {0, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewSalsa20BlockCrypt(key) }},
+	"blowfish":           {0, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewBlowfishBlockCrypt(key) }},
+	"twofish":            {0, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewTwofishBlockCrypt(key) }},
+	"cast5":              {16, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewCast5BlockCrypt(key) }},
+	"3des":               {24, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewTripleDESBlockCrypt(key) }},
+	"tea":                {16, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewTEABlockCrypt(key) }},
+	"xtea":               {16, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewXTEABlockCrypt(key) }},
+	"xor":                {0, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewSimpleXORBlockCrypt(key) }},
+	"sm4":                {16, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewSM4BlockCrypt(key) }},
+	"none":               {0, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewNoneBlockCrypt(key) }},
+	"null":               {0, func(key []byte) (kcp.BlockCrypt, error) { return nil, nil }},
 }
 
-func newBlock(block, key string) (kcp.BlockCrypt, error) {
-	dkey := pbkdf2.Key([]byte(key), []byte("paqet"), 100_000, 32, sha256.New)
+// newAEADBlock wraps aead in kcp-go's AEAD framing: a random nonce, then the
+// sealed packet. Packets that fail to open are dropped and counted by kcp-go.
+func newAEADBlock(aead cipher.AEAD, err error) (kcp.BlockCrypt, error) {
+	if err != nil {
+		return nil, err
+	}
+	return kcp.NewAEADCrypt(aead), nil
+}
 
+func newBlock(block string, dkey []byte) (kcp.BlockCrypt, error) {
 	if b, ok := blockCrypts[block]; ok {
 		bkey := dkey
 		if b.keySize > 0 && len(bkey) >= b.keySize {
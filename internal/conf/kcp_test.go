@@ -0,0 +1,50 @@
+package conf
+
+import (
+	"testing"
+
+	"github.com/goccy/go-yaml"
+)
+
+func TestKCPKeysRevalidate(t *testing.T) {
+	for _, kcp := range []string{`
+    key: "secret"`, `
+    keys:
+      - name: "a"
+        key: "old"
+      - name: "b"
+        key: "new"`} {
+		data := []byte(`role: "server"
+listen:
+  addr: ":9999"
+network:
+  mode: "socket"
+transport:
+  protocol: "kcp"
+  kcp:` + kcp + "\n")
+		cfg, err := Load(data)
+		if err != nil {
+			t.Fatalf("load: %v", err)
+		}
+		want := len(cfg.Transport.KCP.Keys)
+
+		if errs := cfg.Transport.KCP.validate(); len(errs) > 0 {
+			t.Fatalf("second validation: %v", errs)
+		}
+		if got := len(cfg.Transport.KCP.Keys); got != want {
+			t.Fatalf("second validation resolved %d keys, want %d", got, want)
+		}
+
+		out, err := yaml.Marshal(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := Load(out)
+		if err != nil {
+			t.Fatalf("load of re-marshalled config: %v", err)
+		}
+		if got := len(again.Transport.KCP.Keys); got != want {
+			t.Fatalf("re-marshalled config resolved %d keys, want %d", got, want)
+		}
+	}
+}
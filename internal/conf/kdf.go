@@ -0,0 +1,52 @@
+package conf
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"slices"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// KDF stretches configured keys into cipher keys. Both ends must use the same
+// algorithm and salt; the defaults match releases without this setting.
+type KDF struct {
+	Algorithm string `yaml:"algorithm"`
+	Salt      string `yaml:"salt"`
+}
+
+func (k *KDF) setDefaults() {
+	if k.Algorithm == "" {
+		k.Algorithm = "pbkdf2"
+	}
+	if k.Salt == "" {
+		k.Salt = "paqet"
+	}
+}
+
+func (k *KDF) validate() []error {
+	var errors []error
+
+	validAlgorithms := []string{"pbkdf2", "argon2id", "scrypt"}
+	if !slices.Contains(validAlgorithms, k.Algorithm) {
+		errors = append(errors, fmt.Errorf("KDF algorithm must be one of: %v", validAlgorithms))
+	}
+
+	return errors
+}
+
+// derive returns the 32-byte key for the block cipher, or for authenticating
+// the session handshake.
+func (k *KDF) derive(key string) ([]byte, error) {
+	switch k.Algorithm {
+	case "pbkdf2":
+		return pbkdf2.Key([]byte(key), []byte(k.Salt), 100_000, 32, sha256.New), nil
+	case "argon2id":
+		return argon2.IDKey([]byte(key), []byte(k.Salt), 3, 64*1024, 4, 32), nil
+	case "scrypt":
+		return scrypt.Key([]byte(key), []byte(k.Salt), 1<<15, 8, 1, 32)
+	}
+	return nil, fmt.Errorf("unsupported KDF algorithm: %s", k.Algorithm)
+}
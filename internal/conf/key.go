@@ -0,0 +1,52 @@
+package conf
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// Key is one entry of a key rotation list. NotBefore and NotAfter bound when
+// it may open new sessions; sessions already running keep their key.
+type Key struct {
+	Name       string `yaml:"name"`
+	Key        string `yaml:"key"`
+	NotBefore_ string `yaml:"not_before"`
+	NotAfter_  string `yaml:"not_after"`
+
+	NotBefore time.Time      `yaml:"-"`
+	NotAfter  time.Time      `yaml:"-"`
+	Block     kcp.BlockCrypt `yaml:"-"`
+	PSK       []byte         `yaml:"-"`
+}
+
+// Valid reports whether the key may open a session at t.
+func (k *Key) Valid(t time.Time) bool {
+	return (k.NotBefore.IsZero() || !t.Before(k.NotBefore)) &&
+		(k.NotAfter.IsZero() || t.Before(k.NotAfter))
+}
+
+func (k *Key) validate() []error {
+	var errors []error
+
+	if k.Name == "" {
+		errors = append(errors, fmt.Errorf("name is required"))
+	}
+	var err error
+	if k.NotBefore_ != "" {
+		if k.NotBefore, err = time.Parse(time.RFC3339, k.NotBefore_); err != nil {
+			errors = append(errors, fmt.Errorf("not_before must be an RFC 3339 time: %v", err))
+		}
+	}
+	if k.NotAfter_ != "" {
+		if k.NotAfter, err = time.Parse(time.RFC3339, k.NotAfter_); err != nil {
+			errors = append(errors, fmt.Errorf("not_after must be an RFC 3339 time: %v", err))
+		}
+	}
+	if !k.NotBefore.IsZero() && !k.NotAfter.IsZero() && !k.NotBefore.Before(k.NotAfter) {
+		errors = append(errors, fmt.Errorf("not_before must be earlier than not_after"))
+	}
+
+	return errors
+}
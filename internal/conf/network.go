@@ -14,24 +14,49 @@ type Addr struct {
 }
 
 type Network struct {
+	Mode       string         `yaml:"mode"`
 	Interface_ string         `yaml:"interface"`
 	GUID       string         `yaml:"guid"`
 	IPv4       Addr           `yaml:"ipv4"`
 	IPv6       Addr           `yaml:"ipv6"`
 	PCAP       PCAP           `yaml:"pcap"`
 	TCP        TCP            `yaml:"tcp"`
+	VLAN       *VLAN          `yaml:"vlan"`
+	Impair     *Impair        `yaml:"impair"`
+	Injection  *Injection     `yaml:"injection"`
+	Pacing     *Pacing        `yaml:"pacing"`
 	Interface  *net.Interface `yaml:"-"`
 	Port       int            `yaml:"-"`
 }
 
 func (n *Network) setDefaults(role string) {
+	if n.Mode == "" {
+		n.Mode = "raw"
+	}
 	n.PCAP.setDefaults(role)
 	n.TCP.setDefaults()
+	if n.Impair != nil {
+		n.Impair.setDefaults()
+	}
+	if n.Injection != nil {
+		n.Injection.setDefaults()
+	}
+	if n.Pacing != nil {
+		n.Pacing.setDefaults()
+	}
 }
 
 func (n *Network) validate() []error {
 	var errors []error
 
+	switch n.Mode {
+	case "raw":
+	case "socket":
+		return n.validateSocket()
+	default:
+		return append(errors, fmt.Errorf("network mode must be one of: [raw socket]"))
+	}
+
 	if n.Interface_ == "" {
 		errors = append(errors, fmt.Errorf("network interface is required"))
 	}
@@ -74,6 +99,59 @@ func (n *Network) validate() []error {
 
 	errors = append(errors, n.PCAP.validate()...)
 	errors = append(errors, n.TCP.validate()...)
+	if n.VLAN != nil {
+		errors = append(errors, n.VLAN.validate()...)
+	}
+	if n.Impair != nil {
+		errors = append(errors, n.Impair.validate()...)
+	}
+	if n.Injection != nil {
+		errors = append(errors, n.Injection.validate()...)
+	}
+	if n.Pacing != nil {
+		errors = append(errors, n.Pacing.validate()...)
+	}
+
+	return errors
+}
+
+// validateSocket checks the settings of socket mode, where packets travel in
+// ordinary UDP datagrams. Addresses are optional and only pick what to bind.
+func (n *Network) validateSocket() []error {
+	var errors []error
+
+	for _, a := range []*Addr{&n.IPv4, &n.IPv6} {
+		if a.Addr_ == "" {
+			continue
+		}
+		l, err := validateAddr(a.Addr_, false)
+		if err != nil {
+			errors = append(errors, err)
+		}
+		a.Addr = l
+	}
+	if n.IPv4.Addr != nil && n.IPv6.Addr != nil && n.IPv4.Addr.Port != n.IPv6.Addr.Port {
+		errors = append(errors, fmt.Errorf("IPv4 port (%d) and IPv6 port (%d) must match when both are configured", n.IPv4.Addr.Port, n.IPv6.Addr.Port))
+	}
+	if n.IPv4.Addr != nil {
+		n.Port = n.IPv4.Addr.Port
+	}
+	if n.IPv6.Addr != nil {
+		n.Port = n.IPv6.Addr.Port
+	}
+
+	if n.VLAN != nil {
+		errors = append(errors, fmt.Errorf("network vlan requires network mode raw"))
+	}
+	if n.Injection != nil {
+		errors = append(errors, fmt.Errorf("network injection requires network mode raw"))
+	}
+	if n.Impair != nil {
+		errors = append(errors, n.Impair.validate()...)
+	}
+	if n.Pacing != nil {
+		errors = append(errors, n.Pacing.validate()...)
+	}
 
 	return errors
 }
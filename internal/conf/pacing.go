@@ -0,0 +1,60 @@
+package conf
+
+import (
+	"fmt"
+)
+
+// Pacing spreads outgoing packets over time, per destination, instead of
+// handing whole KCP windows to the NIC at once.
+type Pacing struct {
+	RateKbps int     `yaml:"rate_kbps"`
+	MinKbps  int     `yaml:"min_kbps"`
+	Gain     float64 `yaml:"gain"`
+	Burst    int     `yaml:"burst"`
+	Queue    int     `yaml:"queue"`
+}
+
+func (p *Pacing) setDefaults() {
+	if p.MinKbps == 0 {
+		p.MinKbps = 1000
+	}
+	if p.Gain == 0 {
+		p.Gain = 1.25
+	}
+	if p.Burst == 0 {
+		p.Burst = 16 * 1500
+	}
+	if p.Queue == 0 {
+		p.Queue = 4096
+	}
+}
+
+// DefaultPacing returns the settings used when pacing is started only to
+// enforce a rate limit.
+func DefaultPacing() *Pacing {
+	p := &Pacing{}
+	p.setDefaults()
+	return p
+}
+
+func (p *Pacing) validate() []error {
+	var errors []error
+
+	if p.RateKbps < 0 {
+		errors = append(errors, fmt.Errorf("pacing rate_kbps must be >= 0 (0 estimates the rate from traffic)"))
+	}
+	if p.MinKbps < 1 {
+		errors = append(errors, fmt.Errorf("pacing min_kbps must be >= 1"))
+	}
+	if p.Gain < 1 || p.Gain > 10 {
+		errors = append(errors, fmt.Errorf("pacing gain must be between 1-10"))
+	}
+	if p.Burst < 1500 {
+		errors = append(errors, fmt.Errorf("pacing burst must be >= 1500 bytes"))
+	}
+	if p.Queue < 1 || p.Queue > 65536 {
+		errors = append(errors, fmt.Errorf("pacing queue must be between 1-65536 packets"))
+	}
+
+	return errors
+}
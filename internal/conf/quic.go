@@ -0,0 +1,99 @@
+package conf
+
+import (
+	"fmt"
+	"slices"
+)
+
+// QUIC runs sessions over quic-go instead of KCP and smux. Peers prove they
+// hold the key through TLS 1.3 certificates derived from it.
+type QUIC struct {
+	Key string `yaml:"key"`
+	KDF KDF    `yaml:"kdf"`
+
+	MTU         int `yaml:"mtu"`
+	IdleMs      int `yaml:"idle_ms"`
+	KeepaliveMs int `yaml:"keepalive_ms"`
+
+	Streambuf int `yaml:"streambuf"`
+	Connbuf   int `yaml:"connbuf"`
+
+	UDPPath string `yaml:"udp_path"`
+
+	MaxSessions          int `yaml:"max_sessions"`
+	MaxStreamsPerSession int `yaml:"max_streams_per_session"`
+
+	PSK []byte `yaml:"-"`
+}
+
+func (q *QUIC) setDefaults() {
+	q.KDF.setDefaults()
+	if q.MTU == 0 {
+		q.MTU = 1350
+	}
+	if q.IdleMs == 0 {
+		q.IdleMs = 30000
+	}
+	if q.KeepaliveMs == 0 {
+		q.KeepaliveMs = 5000
+	}
+	if q.Streambuf == 0 {
+		q.Streambuf = 4 * 1024 * 1024
+	}
+	if q.Connbuf == 0 {
+		q.Connbuf = 16 * 1024 * 1024
+	}
+	if q.UDPPath == "" {
+		q.UDPPath = "stream"
+	}
+	if q.MaxSessions == 0 {
+		q.MaxSessions = 128
+	}
+	if q.MaxStreamsPerSession == 0 {
+		q.MaxStreamsPerSession = 4096
+	}
+}
+
+func (q *QUIC) validate() []error {
+	var errors []error
+
+	if q.MTU < 1200 || q.MTU > 1500 {
+		errors = append(errors, fmt.Errorf("QUIC mtu must be between 1200-1500 bytes"))
+	}
+	if q.IdleMs < 1000 || q.IdleMs > 600000 {
+		errors = append(errors, fmt.Errorf("QUIC idle_ms must be between 1000-600000"))
+	}
+	if q.KeepaliveMs < 0 || q.KeepaliveMs >= q.IdleMs {
+		errors = append(errors, fmt.Errorf("QUIC keepalive_ms must be >= 0 and below idle_ms"))
+	}
+	if q.Streambuf < 64*1024 {
+		errors = append(errors, fmt.Errorf("QUIC streambuf must be >= 65536 bytes"))
+	}
+	if q.Connbuf < q.Streambuf {
+		errors = append(errors, fmt.Errorf("QUIC connbuf must be >= streambuf"))
+	}
+	validUDPPaths := []string{"stream", "datagram"}
+	if !slices.Contains(validUDPPaths, q.UDPPath) {
+		errors = append(errors, fmt.Errorf("QUIC udp_path must be one of: %v", validUDPPaths))
+	}
+	if q.MaxSessions < 1 || q.MaxSessions > 65535 {
+		errors = append(errors, fmt.Errorf("QUIC max_sessions must be between 1-65535"))
+	}
+	if q.MaxStreamsPerSession < 1 || q.MaxStreamsPerSession > 65535 {
+		errors = append(errors, fmt.Errorf("QUIC max_streams_per_session must be between 1-65535"))
+	}
+
+	kdfErrors := q.KDF.validate()
+	errors = append(errors, kdfErrors...)
+	if q.Key == "" {
+		errors = append(errors, fmt.Errorf("QUIC key is required"))
+	} else if len(kdfErrors) == 0 {
+		psk, err := q.KDF.derive(q.Key)
+		if err != nil {
+			errors = append(errors, err)
+		}
+		q.PSK = psk
+	}
+
+	return errors
+}
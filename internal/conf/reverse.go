@@ -0,0 +1,58 @@
+package conf
+
+import (
+	"fmt"
+	"net"
+	"paqet/internal/tnet"
+)
+
+// Reverse exposes a service reachable from the client on a port the server
+// listens on. The server must list ServerListen in its reverse_allow.
+type Reverse struct {
+	ServerListen_ string     `yaml:"server_listen"`
+	LocalTarget_  string     `yaml:"local_target"`
+	ServerListen  *tnet.Addr `yaml:"-"`
+	LocalTarget   *tnet.Addr `yaml:"-"`
+}
+
+func (r *Reverse) validate() []error {
+	var errors []error
+
+	l, err := validateListen(r.ServerListen_)
+	if err != nil {
+		errors = append(errors, fmt.Errorf("server_listen %v", err))
+	}
+	r.ServerListen = l
+
+	t, err := tnet.NewAddr(r.LocalTarget_)
+	if err != nil {
+		errors = append(errors, fmt.Errorf("local_target %v", err))
+	}
+	r.LocalTarget = t
+
+	return errors
+}
+
+// validateListen checks a TCP listen address given as host:port with a
+// literal (or empty) host, as the server would open it. The host comes back
+// in canonical form, so addresses can be compared as strings.
+func validateListen(addr string) (*tnet.Addr, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("address is required")
+	}
+	a, err := tnet.NewAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if a.Port < 1 || a.Port > 65535 {
+		return nil, fmt.Errorf("port must be between 1-65535")
+	}
+	if a.Host != "" {
+		ip := net.ParseIP(a.Host)
+		if ip == nil {
+			return nil, fmt.Errorf("host %q must be an IP address", a.Host)
+		}
+		a.Host = ip.String()
+	}
+	return a, nil
+}
@@ -1,20 +1,44 @@
 package conf
 
 import (
+	"fmt"
 	"net"
+	"slices"
 )
 
 type SOCKS5 struct {
 	Listen_  string       `yaml:"listen"`
 	Username string       `yaml:"username"`
 	Password string       `yaml:"password"`
+	UDP      string       `yaml:"udp"`
+	Compress string       `yaml:"compress"`
+	ZeroRTT  bool         `yaml:"zero_rtt"`
 	Listen   *net.UDPAddr `yaml:"-"`
+	Codec    byte         `yaml:"-"`
 }
 
-func (c *SOCKS5) setDefaults() {}
+func (c *SOCKS5) setDefaults() {
+	if c.UDP == "" {
+		c.UDP = "per-target"
+	}
+	if c.Compress == "" {
+		c.Compress = "none"
+	}
+}
 func (c *SOCKS5) validate() []error {
 	var errors []error
 
+	validUDP := []string{"per-target", "full-cone"}
+	if !slices.Contains(validUDP, c.UDP) {
+		errors = append(errors, fmt.Errorf("SOCKS5 udp must be one of: %v", validUDP))
+	}
+
+	codec, err := validateCodec(c.Compress)
+	if err != nil {
+		errors = append(errors, fmt.Errorf("SOCKS5 %v", err))
+	}
+	c.Codec = codec
+
 	addr, err := validateAddr(c.Listen_, true)
 	if err != nil {
 		errors = append(errors, err)
@@ -11,7 +11,16 @@ type Transport struct {
 	Conn     int    `yaml:"conn"`
 	TCPBuf   int    `yaml:"tcpbuf"`
 	UDPBuf   int    `yaml:"udpbuf"`
+	Wire     string `yaml:"wire"`
 	KCP      *KCP   `yaml:"kcp"`
+	QUIC     *QUIC  `yaml:"quic"`
+	WS       *WS    `yaml:"ws"`
+
+	// Fallback is the protocol a client switches to when the primary one
+	// cannot reach the server.
+	Fallback string `yaml:"fallback"`
+
+	MaxDatagram int `yaml:"max_datagram"`
 }
 
 func (t *Transport) setDefaults(role string) {
@@ -39,28 +48,91 @@ func (t *Transport) setDefaults(role string) {
 		t.UDPBuf = 2 * 1024
 	}
 
+	if t.Wire == "" {
+		t.Wire = "auto"
+	}
+	if t.MaxDatagram == 0 {
+		t.MaxDatagram = min(t.UDPBuf, 65507)
+	}
+
 	switch t.Protocol {
 	case "kcp":
+		if t.KCP == nil {
+			t.KCP = &KCP{}
+		}
 		t.KCP.setDefaults(role)
+	case "quic":
+		if t.QUIC == nil {
+			t.QUIC = &QUIC{}
+		}
+		t.QUIC.setDefaults()
+	}
+	if t.Protocol == "ws" || t.Fallback == "ws" {
+		if t.WS == nil {
+			t.WS = &WS{}
+		}
+	}
+	if t.WS != nil {
+		t.WS.setDefaults()
 	}
 }
 
-func (t *Transport) validate() []error {
+func (t *Transport) validate(role string) []error {
 	var errors []error
 
-	validProtocols := []string{"kcp"}
+	validProtocols := []string{"kcp", "quic", "ws"}
 	if !slices.Contains(validProtocols, t.Protocol) {
 		errors = append(errors, fmt.Errorf("transport protocol must be one of: %v", validProtocols))
 	}
 
 	if t.Conn < 1 || t.Conn > 256 {
-		errors = append(errors, fmt.Errorf("KCP conn must be between 1-256 connections"))
+		errors = append(errors, fmt.Errorf("transport conn must be between 1-256 connections"))
+	}
+
+	validWires := []string{"auto", "v1", "v2", "v3", "v4", "v5", "gob"}
+	if !slices.Contains(validWires, t.Wire) {
+		errors = append(errors, fmt.Errorf("transport wire must be one of: %v", validWires))
+	}
+
+	if t.MaxDatagram < 512 || t.MaxDatagram > 65507 {
+		errors = append(errors, fmt.Errorf("transport max_datagram must be between 512-65507 bytes"))
+	}
+	if t.MaxDatagram > t.UDPBuf {
+		errors = append(errors, fmt.Errorf("transport max_datagram must not exceed udpbuf (%d bytes)", t.UDPBuf))
 	}
 
 	switch t.Protocol {
 	case "kcp":
 		errors = append(errors, t.KCP.validate()...)
+	case "quic":
+		errors = append(errors, t.QUIC.validate()...)
+	}
+
+	switch {
+	case t.Fallback == "":
+	case role != "client":
+		errors = append(errors, fmt.Errorf("transport fallback is only supported on clients"))
+	case t.Fallback != "ws":
+		errors = append(errors, fmt.Errorf("transport fallback must be ws"))
+	case t.Protocol == "ws":
+		errors = append(errors, fmt.Errorf("transport fallback must differ from protocol"))
+	}
+	if t.WS != nil {
+		errors = append(errors, t.WS.validate(role)...)
 	}
 
 	return errors
 }
+
+// Limits returns the server's session and per-session stream limits for the
+// configured protocol.
+func (t *Transport) Limits() (sessions, streams int) {
+	switch t.Protocol {
+	case "quic":
+		return t.QUIC.MaxSessions, t.QUIC.MaxStreamsPerSession
+	case "ws":
+		return t.WS.MaxSessions, t.WS.MaxStreamsPerSession
+	default:
+		return t.KCP.MaxSessions, t.KCP.MaxStreamsPerSession
+	}
+}
@@ -0,0 +1,33 @@
+package conf
+
+import (
+	"fmt"
+)
+
+// VLAN tags outgoing frames with an 802.1Q tag, optionally wrapped in an
+// 802.1ad (QinQ) outer tag, and restricts capture to frames carrying them.
+type VLAN struct {
+	ID            int `yaml:"id"`
+	Priority      int `yaml:"priority"`
+	OuterID       int `yaml:"outer_id"`
+	OuterPriority int `yaml:"outer_priority"`
+}
+
+func (v *VLAN) validate() []error {
+	var errors []error
+
+	if v.ID < 1 || v.ID > 4094 {
+		errors = append(errors, fmt.Errorf("VLAN id must be between 1-4094"))
+	}
+	if v.Priority < 0 || v.Priority > 7 {
+		errors = append(errors, fmt.Errorf("VLAN priority must be between 0-7"))
+	}
+	if v.OuterID < 0 || v.OuterID > 4094 {
+		errors = append(errors, fmt.Errorf("VLAN outer_id must be between 1-4094, or 0 for no outer tag"))
+	}
+	if v.OuterPriority < 0 || v.OuterPriority > 7 {
+		errors = append(errors, fmt.Errorf("VLAN outer_priority must be between 0-7"))
+	}
+
+	return errors
+}
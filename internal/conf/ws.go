@@ -0,0 +1,110 @@
+package conf
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"paqet/internal/tnet"
+)
+
+// WS carries sessions as smux over a WebSocket, so they can pass through a
+// CDN or reverse proxy where raw packets cannot. Clients dial url; servers
+// accept upgrades on listen, with TLS when cert and key are given and in
+// plain HTTP when a proxy in front terminates it.
+type WS struct {
+	URL_     string   `yaml:"url"`
+	URL      *url.URL `yaml:"-"`
+	Host     string   `yaml:"host"`
+	SNI      string   `yaml:"sni"`
+	Insecure bool     `yaml:"insecure"`
+
+	Listen_ string     `yaml:"listen"`
+	Listen  *tnet.Addr `yaml:"-"`
+	Path    string     `yaml:"path"`
+	Cert    string     `yaml:"cert"`
+	CertKey string     `yaml:"key"`
+
+	Smuxbuf   int `yaml:"smuxbuf"`
+	Streambuf int `yaml:"streambuf"`
+
+	MaxSessions          int `yaml:"max_sessions"`
+	MaxStreamsPerSession int `yaml:"max_streams_per_session"`
+}
+
+func (w *WS) setDefaults() {
+	if w.Path == "" {
+		w.Path = "/"
+	}
+	if w.Smuxbuf == 0 {
+		w.Smuxbuf = 4 * 1024 * 1024
+	}
+	if w.Streambuf == 0 {
+		w.Streambuf = 256 * 1024
+	}
+	if w.MaxSessions == 0 {
+		w.MaxSessions = 128
+	}
+	if w.MaxStreamsPerSession == 0 {
+		w.MaxStreamsPerSession = 4096
+	}
+}
+
+func (w *WS) validate(role string) []error {
+	var errors []error
+
+	if role == "client" {
+		u, err := url.Parse(w.URL_)
+		switch {
+		case w.URL_ == "":
+			errors = append(errors, fmt.Errorf("WS url is required"))
+		case err != nil:
+			errors = append(errors, fmt.Errorf("WS url is invalid: %v", err))
+		case u.Scheme != "ws" && u.Scheme != "wss":
+			errors = append(errors, fmt.Errorf("WS url scheme must be ws or wss"))
+		case u.Host == "":
+			errors = append(errors, fmt.Errorf("WS url has no host"))
+		default:
+			w.URL = u
+		}
+	} else {
+		addr, err := validateListen(w.Listen_)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("WS listen %v", err))
+		}
+		w.Listen = addr
+		if !strings.HasPrefix(w.Path, "/") {
+			errors = append(errors, fmt.Errorf("WS path must start with /"))
+		}
+		if (w.Cert == "") != (w.CertKey == "") {
+			errors = append(errors, fmt.Errorf("WS cert and key must be set together"))
+		}
+		for _, f := range []string{w.Cert, w.CertKey} {
+			if f == "" {
+				continue
+			}
+			if _, err := os.Stat(f); err != nil {
+				errors = append(errors, fmt.Errorf("WS %v", err))
+			}
+		}
+		if w.MaxSessions < 1 || w.MaxSessions > 65535 {
+			errors = append(errors, fmt.Errorf("WS max_sessions must be between 1-65535"))
+		}
+		if w.MaxStreamsPerSession < 1 || w.MaxStreamsPerSession > 65535 {
+			errors = append(errors, fmt.Errorf("WS max_streams_per_session must be between 1-65535"))
+		}
+	}
+
+	if w.Smuxbuf < 1024 {
+		errors = append(errors, fmt.Errorf("WS smuxbuf must be >= 1024 bytes"))
+	}
+	if w.Streambuf < 1024 {
+		errors = append(errors, fmt.Errorf("WS streambuf must be >= 1024 bytes"))
+	}
+	if w.Streambuf > w.Smuxbuf {
+		errors = append(errors, fmt.Errorf("WS streambuf must not exceed smuxbuf"))
+	}
+
+	return errors
+}
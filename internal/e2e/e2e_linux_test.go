@@ -0,0 +1,292 @@
+//go:build linux
+
+package e2e
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/txthinking/socks5"
+)
+
+const (
+	serverPort = 9999
+	clientPort = 40000
+	echoTCP    = "127.0.0.1:7000"
+	echoUDP    = "127.0.0.1:7001"
+	socksAddr  = "127.0.0.1:1080"
+	fwdTCPAddr = "127.0.0.1:8080"
+	fwdUDPAddr = "127.0.0.1:8081"
+)
+
+var (
+	binDir    string
+	buildOnce sync.Once
+	buildErr  error
+)
+
+func TestMain(m *testing.M) {
+	// The test binary doubles as the echo target and the probe client; they
+	// have to run as separate processes inside the namespaces.
+	switch os.Getenv("PAQET_E2E_HELPER") {
+	case "echo":
+		runEcho()
+		return
+	case "probe":
+		os.Exit(runProbe())
+	}
+
+	code := m.Run()
+	if binDir != "" {
+		os.RemoveAll(binDir)
+	}
+	os.Exit(code)
+}
+
+func paqetBinary(t *testing.T) string {
+	t.Helper()
+	buildOnce.Do(func() {
+		binDir, buildErr = os.MkdirTemp("", "paqet-e2e-")
+		if buildErr != nil {
+			return
+		}
+		out, err := exec.Command("go", "build", "-o", filepath.Join(binDir, "paqet"), "paqet/cmd").CombinedOutput()
+		if err != nil {
+			buildErr = fmt.Errorf("%v\n%s", err, out)
+		}
+	})
+	if buildErr != nil {
+		t.Fatalf("failed to build paqet: %v", buildErr)
+	}
+	return filepath.Join(binDir, "paqet")
+}
+
+func TestNetnsEndToEnd(t *testing.T) {
+	requireRoot(t)
+	bin := paqetBinary(t)
+
+	topologies := []struct {
+		name, family, vlan string
+	}{
+		{"ipv4", "ipv4", ""},
+		{"ipv6", "ipv6", ""},
+		// Neither kernel has a VLAN interface, so tagged frames only reach paqet.
+		{"ipv4-vlan", "ipv4", "  vlan:\n    id: 100\n    priority: 5\n"},
+		{"ipv6-qinq", "ipv6", "  vlan:\n    id: 100\n    outer_id: 200\n"},
+	}
+	for _, tc := range topologies {
+		t.Run(tc.name, func(t *testing.T) {
+			topo := newTopology(t)
+			topo.server.protectPort(t, serverPort)
+			topo.client.protectPort(t, clientPort)
+
+			dir := t.TempDir()
+			srvCfg := filepath.Join(dir, "server.yaml")
+			cliCfg := filepath.Join(dir, "client.yaml")
+			writeFile(t, srvCfg, serverConfig(topo, tc.vlan))
+			writeFile(t, cliCfg, clientConfig(topo, tc.family, tc.vlan))
+
+			self, err := os.Executable()
+			if err != nil {
+				t.Fatal(err)
+			}
+			topo.server.ns.start(t, []string{"PAQET_E2E_HELPER=echo"}, self)
+			topo.server.ns.start(t, nil, bin, "run", "-c", srvCfg)
+			topo.client.ns.start(t, nil, bin, "run", "-c", cliCfg)
+
+			cases := []struct {
+				mode, addr, target string
+			}{
+				{"socks-tcp", socksAddr, echoTCP},
+				{"socks-udp", socksAddr, echoUDP},
+				{"forward-tcp", fwdTCPAddr, ""},
+				{"forward-udp", fwdUDPAddr, ""},
+			}
+			for _, c := range cases {
+				t.Run(c.mode, func(t *testing.T) {
+					cmd := exec.Command("ip", "netns", "exec", topo.client.ns.name, self)
+					cmd.Env = append(os.Environ(),
+						"PAQET_E2E_HELPER=probe",
+						"PAQET_E2E_MODE="+c.mode,
+						"PAQET_E2E_ADDR="+c.addr,
+						"PAQET_E2E_TARGET="+c.target,
+					)
+					if out, err := cmd.CombinedOutput(); err != nil {
+						t.Fatalf("probe failed: %v\n%s", err, out)
+					}
+				})
+			}
+		})
+	}
+}
+
+func serverConfig(topo *topology, vlan string) string {
+	return fmt.Sprintf(`role: "server"
+log:
+  level: "debug"
+listen:
+  addr: ":%[1]d"
+network:
+  interface: "%[2]s"
+  ipv4:
+    addr: "%[3]s:%[1]d"
+    router_mac: "%[5]s"
+  ipv6:
+    addr: "[%[4]s]:%[1]d"
+    router_mac: "%[5]s"
+%[6]stransport:
+  protocol: "kcp"
+  conn: 1
+  kcp:
+    key: "paqet-e2e"
+`, serverPort, topo.server.name, topo.server.ipv4, topo.server.ipv6, topo.client.mac, vlan)
+}
+
+func clientConfig(topo *topology, family, vlan string) string {
+	local := fmt.Sprintf("%s:%d", topo.client.ipv4, clientPort)
+	server := fmt.Sprintf("%s:%d", topo.server.ipv4, serverPort)
+	if family == "ipv6" {
+		local = fmt.Sprintf("[%s]:%d", topo.client.ipv6, clientPort)
+		server = fmt.Sprintf("[%s]:%d", topo.server.ipv6, serverPort)
+	}
+	return fmt.Sprintf(`role: "client"
+log:
+  level: "debug"
+socks5:
+  - listen: "%[1]s"
+forward:
+  - listen: "%[2]s"
+    target: "%[4]s"
+    protocol: "tcp"
+  - listen: "%[3]s"
+    target: "%[5]s"
+    protocol: "udp"
+network:
+  interface: "%[6]s"
+  %[7]s:
+    addr: "%[8]s"
+    router_mac: "%[9]s"
+%[11]sserver:
+  addr: "%[10]s"
+transport:
+  protocol: "kcp"
+  conn: 1
+  kcp:
+    key: "paqet-e2e"
+`, socksAddr, fwdTCPAddr, fwdUDPAddr, echoTCP, echoUDP, topo.client.name, family, local, topo.server.mac, server, vlan)
+}
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func runEcho() {
+	tl, err := net.Listen("tcp", echoTCP)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	ul, err := net.ListenPacket("udp", echoUDP)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := ul.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			ul.WriteTo(buf[:n], addr)
+		}
+	}()
+	for {
+		conn, err := tl.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+func runProbe() int {
+	mode := os.Getenv("PAQET_E2E_MODE")
+	addr := os.Getenv("PAQET_E2E_ADDR")
+	target := os.Getenv("PAQET_E2E_TARGET")
+
+	// paqet needs a moment to bring up its listeners and KCP sessions.
+	err := waitFor(20*time.Second, func() error {
+		return probe(mode, addr, target)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s via %s: %v\n", mode, addr, err)
+		return 1
+	}
+	return 0
+}
+
+func probe(mode, addr, target string) error {
+	var conn net.Conn
+	var err error
+	switch mode {
+	case "socks-tcp", "socks-udp":
+		var c *socks5.Client
+		c, err = socks5.NewClient(addr, "", "", 10, 10)
+		if err != nil {
+			return err
+		}
+		conn, err = c.Dial(strings.TrimPrefix(mode, "socks-"), target)
+	case "forward-tcp":
+		conn, err = net.DialTimeout("tcp", addr, 5*time.Second)
+	case "forward-udp":
+		conn, err = net.Dial("udp", addr)
+	default:
+		return fmt.Errorf("unknown probe mode %q", mode)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	size := 256 * 1024
+	if strings.HasSuffix(mode, "udp") {
+		size = 512
+	}
+	payload := make([]byte, size)
+	rand.Read(payload)
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(payload)
+		errCh <- err
+	}()
+	got := make([]byte, size)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return fmt.Errorf("read echo: %w", err)
+	}
+	if err := <-errCh; err != nil {
+		return fmt.Errorf("write payload: %w", err)
+	}
+	if !bytes.Equal(got, payload) {
+		return fmt.Errorf("echoed payload does not match")
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+//go:build linux
+
+package e2e
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// netns is a throwaway network namespace managed through iproute2.
+type netns struct {
+	name string
+}
+
+func newNetns(t *testing.T, prefix string) *netns {
+	t.Helper()
+	b := make([]byte, 3)
+	rand.Read(b)
+	ns := &netns{name: fmt.Sprintf("paqet-%s-%s", prefix, hex.EncodeToString(b))}
+	mustRun(t, "ip", "netns", "add", ns.name)
+	t.Cleanup(func() {
+		exec.Command("ip", "netns", "del", ns.name).Run()
+	})
+	ns.run(t, "ip", "link", "set", "lo", "up")
+	return ns
+}
+
+func (ns *netns) run(t *testing.T, args ...string) string {
+	t.Helper()
+	return mustRun(t, append([]string{"ip", "netns", "exec", ns.name}, args...)...)
+}
+
+// start launches a long-running process inside the namespace. Its output is
+// captured and logged when the test finishes, and the process is killed.
+func (ns *netns) start(t *testing.T, env []string, args ...string) *exec.Cmd {
+	t.Helper()
+	cmd := exec.Command("ip", append([]string{"netns", "exec", ns.name}, args...)...)
+	cmd.Env = append(os.Environ(), env...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start %v in %s: %v", args, ns.name, err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if t.Failed() {
+			t.Logf("output of %v in %s:\n%s", args, ns.name, out.String())
+		}
+	})
+	return cmd
+}
+
+// link is one end of a veth pair placed inside a namespace.
+type link struct {
+	ns   *netns
+	name string
+	mac  string
+	ipv4 string
+	ipv6 string
+}
+
+// topology is a server and a client namespace joined by a single veth pair.
+// Each side uses the other side's MAC as its router MAC, which is exactly what
+// a point-to-point deployment looks like to paqet.
+type topology struct {
+	server link
+	client link
+}
+
+func newTopology(t *testing.T) *topology {
+	t.Helper()
+	srv := newNetns(t, "s")
+	cli := newNetns(t, "c")
+
+	// veth names are global until moved, so keep them unique per test.
+	sfx := strings.TrimPrefix(srv.name, "paqet-s-")
+	sIf, cIf := "vs"+sfx, "vc"+sfx
+	mustRun(t, "ip", "link", "add", sIf, "netns", srv.name, "type", "veth", "peer", "name", cIf, "netns", cli.name)
+
+	topo := &topology{
+		server: link{ns: srv, name: sIf, ipv4: "10.99.0.1", ipv6: "fd99::1"},
+		client: link{ns: cli, name: cIf, ipv4: "10.99.0.2", ipv6: "fd99::2"},
+	}
+	for _, l := range []*link{&topo.server, &topo.client} {
+		l.ns.run(t, "ip", "addr", "add", l.ipv4+"/24", "dev", l.name)
+		l.ns.run(t, "ip", "-6", "addr", "add", l.ipv6+"/64", "dev", l.name, "nodad")
+		l.ns.run(t, "ip", "link", "set", l.name, "up")
+		l.mac = strings.TrimSpace(l.ns.run(t, "cat", "/sys/class/net/"+l.name+"/address"))
+	}
+	return topo
+}
+
+// protectPort installs the firewall rules paqet requires: no conntrack for
+// the raw port and no kernel RSTs in reply to packets it knows nothing about.
+func (l *link) protectPort(t *testing.T, port int) {
+	t.Helper()
+	p := fmt.Sprint(port)
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		l.ns.run(t, bin, "-t", "raw", "-A", "PREROUTING", "-p", "tcp", "--dport", p, "-j", "NOTRACK")
+		l.ns.run(t, bin, "-t", "raw", "-A", "OUTPUT", "-p", "tcp", "--sport", p, "-j", "NOTRACK")
+		l.ns.run(t, bin, "-t", "mangle", "-A", "OUTPUT", "-p", "tcp", "--sport", p, "--tcp-flags", "RST", "RST", "-j", "DROP")
+	}
+}
+
+func requireRoot(t *testing.T) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("network namespace tests require root")
+	}
+	for _, bin := range []string{"ip", "iptables", "ip6tables"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("network namespace tests require %s: %v", bin, err)
+		}
+	}
+}
+
+func mustRun(t *testing.T, args ...string) string {
+	t.Helper()
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return string(out)
+}
+
+// waitFor polls fn until it succeeds or the timeout expires.
+func waitFor(timeout time.Duration, fn func() error) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := fn()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
@@ -12,14 +12,18 @@ type Forward struct {
 	client     *client.Client
 	listenAddr string
 	targetAddr string
+	codec      byte
+	zeroRTT    bool
 	wg         sync.WaitGroup
 }
 
-func New(client *client.Client, listenAddr, targetAddr string) (*Forward, error) {
+func New(client *client.Client, listenAddr, targetAddr string, codec byte, zeroRTT bool) (*Forward, error) {
 	return &Forward{
 		client:     client,
 		listenAddr: listenAddr,
 		targetAddr: targetAddr,
+		codec:      codec,
+		zeroRTT:    zeroRTT,
 	}, nil
 }
 
@@ -2,9 +2,12 @@ package forward
 
 import (
 	"context"
+	"errors"
 	"net"
+	"paqet/internal/client"
 	"paqet/internal/flog"
 	"paqet/internal/pkg/buffer"
+	"paqet/internal/tnet"
 )
 
 func (f *Forward) listenTCP(ctx context.Context) error {
@@ -44,9 +47,10 @@ func (f *Forward) listenTCP(ctx context.Context) error {
 }
 
 func (f *Forward) handleTCPConn(ctx context.Context, conn net.Conn) error {
-	strm, err := f.client.TCP(f.targetAddr)
+	strm, err := f.openStrm()
 	if err != nil {
 		flog.Errorf("failed to establish stream for %s -> %s: %v", conn.RemoteAddr(), f.targetAddr, err)
+		resetOnDialError(conn, err)
 		return err
 	}
 	defer func() {
@@ -55,24 +59,31 @@ func (f *Forward) handleTCPConn(ctx context.Context, conn net.Conn) error {
 	}()
 	flog.Infof("accepted TCP connection %s -> %s", conn.RemoteAddr(), f.targetAddr)
 
-	errCh := make(chan error, 2)
-	go func() {
-		err := buffer.CopyT(conn, strm)
-		errCh <- err
-	}()
-	go func() {
-		err := buffer.CopyT(strm, conn)
-		errCh <- err
-	}()
+	if err := buffer.RelayT(ctx, conn, strm); err != nil {
+		flog.Errorf("TCP stream %d failed for %s -> %s: %v", strm.SID(), conn.RemoteAddr(), f.targetAddr, err)
+		resetOnDialError(conn, err)
+		return err
+	}
+	return nil
+}
 
-	select {
-	case err := <-errCh:
-		if err != nil {
-			flog.Errorf("TCP stream %d failed for %s -> %s: %v", strm.SID(), conn.RemoteAddr(), f.targetAddr, err)
-			return err
-		}
-	case <-ctx.Done():
+func (f *Forward) openStrm() (tnet.Strm, error) {
+	if f.zeroRTT {
+		return f.client.TCPEarly(f.targetAddr, f.codec)
 	}
+	strm, _, err := f.client.TCP(f.targetAddr, f.codec)
+	return strm, err
+}
 
-	return nil
+// resetOnDialError resets conn rather than closing it when the server could
+// not connect, so the local peer sees a failed connect instead of an empty
+// reply. With zero_rtt the failure only shows up once relaying has started.
+func resetOnDialError(conn net.Conn, err error) {
+	var de *client.DialError
+	if !errors.As(err, &de) {
+		return
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
 }
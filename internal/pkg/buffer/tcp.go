@@ -1,6 +1,7 @@
 package buffer
 
 import (
+	"context"
 	"io"
 )
 
@@ -12,3 +13,51 @@ func CopyT(dst io.Writer, src io.Reader) error {
 	_, err := io.CopyBuffer(dst, src, buf)
 	return err
 }
+
+// CloseWriter is a connection that can end its sending direction alone.
+type CloseWriter interface {
+	CloseWrite() error
+}
+
+// RelayT copies between a and b in both directions. When both can close
+// their write side alone, a direction that ends cleanly is passed on as a
+// half-close and the relay goes on until the other one ends too; otherwise
+// the first direction to end ends the relay. It returns the first error, and
+// nil when ctx is done. Callers close a and b to stop what is still running.
+//
+// Mux streams cannot close one direction by themselves: only a
+// tnet.HalfStrm, on wire v4 and later, gives them CloseWrite, so with older
+// peers a half-close is a full close.
+func RelayT(ctx context.Context, a, b io.ReadWriter) error {
+	aw, aok := a.(CloseWriter)
+	bw, bok := b.(CloseWriter)
+	half := aok && bok
+
+	errCh := make(chan error, 2)
+	go func() {
+		err := CopyT(a, b)
+		if err == nil && half {
+			err = aw.CloseWrite()
+		}
+		errCh <- err
+	}()
+	go func() {
+		err := CopyT(b, a)
+		if err == nil && half {
+			err = bw.CloseWrite()
+		}
+		errCh <- err
+	}()
+
+	for range 2 {
+		select {
+		case err := <-errCh:
+			if err != nil || !half {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return nil
+}
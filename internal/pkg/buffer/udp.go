@@ -1,14 +1,30 @@
 package buffer
 
 import (
+	"errors"
 	"io"
+	"paqet/internal/tnet"
 )
 
+// CopyU relays datagrams from src to dst, one Read at a time. Datagrams that
+// dst rejects as too large are dropped, as a router would.
 func CopyU(dst io.Writer, src io.Reader) error {
 	bufp := UPool.Get().(*[]byte)
 	defer UPool.Put(bufp)
 	buf := *bufp
 
-	_, err := io.CopyBuffer(dst, src, buf)
-	return err
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil && !errors.Is(werr, tnet.ErrDatagramTooLarge) {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
 }
@@ -0,0 +1,46 @@
+package protocol
+
+import (
+	"fmt"
+	"paqet/internal/tnet"
+)
+
+// A PUDPA stream is a UDP association: one stream for datagrams to and from
+// any number of hosts, served from a single unconnected socket. It needs
+// Version3, whose framing it builds on. Each frame starts with the peer's
+// address, encoded as in a header:
+//
+//	ATYP | ADDRESS | PAYLOAD
+//
+// Towards the server the address is the destination; towards the client it
+// is the source of the reply.
+
+// MaxAddrSize is the longest encoded address: a 255-byte host name.
+const MaxAddrSize = 1 + 1 + 255 + 2
+
+// AppendDatagram appends an association frame body to b.
+func AppendDatagram(b []byte, addr *tnet.Addr, payload []byte) ([]byte, error) {
+	if addr == nil {
+		return nil, fmt.Errorf("datagram without an address")
+	}
+	b, err := appendAddr(b, addr)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, payload...), nil
+}
+
+// ParseDatagram splits an association frame body into address and payload.
+func ParseDatagram(b []byte) (*tnet.Addr, []byte, error) {
+	if len(b) < 1 {
+		return nil, nil, fmt.Errorf("empty datagram")
+	}
+	addr, payload, err := decodeAddr(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if addr == nil {
+		return nil, nil, fmt.Errorf("datagram without an address")
+	}
+	return addr, payload, nil
+}
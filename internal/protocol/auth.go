@@ -0,0 +1,38 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+// Session handshake, run on one PAUTH stream before any relay stream:
+//
+//	client -> server  PAUTH{User}
+//	server -> client  PAUTH{Nonce}
+//	client -> server  PAUTH{Proof}
+//	server -> client  PAUTH{Status}
+//
+// The secret never crosses the wire, and the nonce is fresh for every
+// session, so a captured proof is useless on another one. The proof also
+// covers the binding of the transport session when it has one (see
+// tnet.Binder), which ties it to the keys of that session: a relay between
+// client and server cannot pass the proof on over a session of its own.
+
+const NonceSize = 32
+
+const (
+	StatusOK     byte = 0x00
+	StatusDenied byte = 0x01
+)
+
+// AuthProof returns the proof a client holding secret sends for user on the
+// transport session with the given binding, which may be nil.
+func AuthProof(secret, user string, nonce, binding []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("paqet auth v2"))
+	mac.Write(nonce)
+	mac.Write([]byte{byte(len(user))})
+	mac.Write([]byte(user))
+	mac.Write(binding)
+	return mac.Sum(nil)
+}
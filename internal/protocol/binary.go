@@ -0,0 +1,297 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"paqet/internal/conf"
+	"paqet/internal/tnet"
+)
+
+// Magic starts every binary header. gob streams open with a uvarint message
+// length, whose first byte is either below 0x80 or 0xF8 and above.
+const Magic byte = 0xB7
+
+const maxBody = 0xFFFF
+
+// Address types, numbered as in SOCKS5.
+const (
+	atypNone   byte = 0x00
+	atypIPv4   byte = 0x01
+	atypDomain byte = 0x03
+	atypIPv6   byte = 0x04
+)
+
+// Option codes. Receivers skip unknown options unless OptCritical is set.
+const (
+	OptTCPF   byte = 0x01
+	OptUser   byte = 0x02
+	OptNonce  byte = 0x03
+	OptProof  byte = 0x04
+	OptStatus byte = 0x05
+	OptCodec  byte = 0x06
+
+	OptCritical byte = 0x80
+)
+
+var ErrVersion = errors.New("unsupported wire protocol version")
+
+// TCP flag bits in an OptTCPF entry.
+const (
+	flagFIN uint16 = 1 << iota
+	flagSYN
+	flagRST
+	flagPSH
+	flagACK
+	flagURG
+	flagECE
+	flagCWR
+	flagNS
+
+	flagMask = flagNS<<1 - 1
+)
+
+// readBinary reads the rest of a binary header after its magic byte. An
+// unsupported version is reported as ErrVersion with p.Version set, once the
+// whole frame has been consumed.
+func (p *Proto) readBinary(r io.Reader) error {
+	var hdr [3]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[1:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+
+	switch v := hdr[0]; v {
+	case Version1, Version2, Version3, Version4, Version5:
+		return p.decodeV1(body, v)
+	default:
+		*p = Proto{Version: v}
+		return fmt.Errorf("%w %d", ErrVersion, v)
+	}
+}
+
+func (p *Proto) writeBinary(w io.Writer) error {
+	if p.Version < Version1 || p.Version > MaxVersion {
+		return fmt.Errorf("%w %d", ErrVersion, p.Version)
+	}
+
+	buf := make([]byte, 4, 64)
+	buf[0] = Magic
+	buf[1] = p.Version
+	buf, err := p.appendV1(buf)
+	if err != nil {
+		return err
+	}
+	if len(buf)-4 > maxBody {
+		return fmt.Errorf("header too long: %d bytes", len(buf)-4)
+	}
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(buf)-4))
+
+	// One write, so the header never straddles stream frames on its own.
+	_, err = w.Write(buf)
+	return err
+}
+
+func (p *Proto) appendV1(b []byte) ([]byte, error) {
+	b = append(b, p.Type)
+	b, err := appendAddr(b, p.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(p.TCPF) > 0 {
+		n := 2 * len(p.TCPF)
+		if n > maxBody {
+			return nil, fmt.Errorf("too many TCP flag sets: %d", len(p.TCPF))
+		}
+		b = append(b, OptTCPF)
+		b = binary.BigEndian.AppendUint16(b, uint16(n))
+		for _, f := range p.TCPF {
+			b = binary.BigEndian.AppendUint16(b, tcpfBits(f))
+		}
+	}
+	for _, o := range []struct {
+		code byte
+		val  []byte
+	}{
+		{OptUser, []byte(p.User)},
+		{OptNonce, p.Nonce},
+		{OptProof, p.Proof},
+	} {
+		if len(o.val) == 0 {
+			continue
+		}
+		if len(o.val) > maxBody {
+			return nil, fmt.Errorf("option 0x%02x too long: %d bytes", o.code, len(o.val))
+		}
+		b = append(b, o.code)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(o.val)))
+		b = append(b, o.val...)
+	}
+	if p.Status != 0 {
+		b = append(b, OptStatus, 0x00, 0x01, p.Status)
+	}
+	if p.Codec != 0 {
+		b = append(b, OptCodec, 0x00, 0x01, p.Codec)
+	}
+	return b, nil
+}
+
+// decodeV1 decodes a body in the v1 layout, which later versions share.
+func (p *Proto) decodeV1(b []byte, v Version) error {
+	if len(b) < 2 {
+		return io.ErrUnexpectedEOF
+	}
+	*p = Proto{Type: b[0], Version: v}
+
+	addr, rest, err := decodeAddr(b[1:])
+	if err != nil {
+		return err
+	}
+	p.Addr = addr
+
+	for b = rest; len(b) > 0; {
+		if len(b) < 3 {
+			return fmt.Errorf("truncated option header")
+		}
+		code, n := b[0], int(binary.BigEndian.Uint16(b[1:3]))
+		b = b[3:]
+		if len(b) < n {
+			return fmt.Errorf("option 0x%02x truncated: %d of %d bytes", code, len(b), n)
+		}
+		val := b[:n]
+		b = b[n:]
+
+		switch code {
+		case OptTCPF:
+			if n%2 != 0 {
+				return fmt.Errorf("TCP flags option has odd length %d", n)
+			}
+			for i := 0; i < n; i += 2 {
+				bits := binary.BigEndian.Uint16(val[i:])
+				if bits&^flagMask != 0 {
+					return fmt.Errorf("reserved TCP flag bits set: 0x%04x", bits)
+				}
+				p.TCPF = append(p.TCPF, tcpfFromBits(bits))
+			}
+		case OptUser:
+			p.User = string(val)
+		case OptNonce:
+			p.Nonce = append([]byte(nil), val...)
+		case OptProof:
+			p.Proof = append([]byte(nil), val...)
+		case OptStatus:
+			if n != 1 {
+				return fmt.Errorf("status option has length %d", n)
+			}
+			p.Status = val[0]
+		case OptCodec:
+			if n != 1 {
+				return fmt.Errorf("codec option has length %d", n)
+			}
+			p.Codec = val[0]
+		default:
+			if code&OptCritical != 0 {
+				return fmt.Errorf("unknown critical option 0x%02x", code)
+			}
+		}
+	}
+	return nil
+}
+
+// appendAddr encodes IP literals in binary form only when that reproduces the
+// host string exactly; anything else travels as a domain name.
+func appendAddr(b []byte, a *tnet.Addr) ([]byte, error) {
+	if a == nil {
+		return append(b, atypNone), nil
+	}
+	if a.Port < 0 || a.Port > 0xFFFF {
+		return nil, fmt.Errorf("invalid port %d", a.Port)
+	}
+
+	ip, err := netip.ParseAddr(a.Host)
+	switch {
+	case err == nil && ip.Is4() && ip.String() == a.Host:
+		b = append(b, atypIPv4)
+		b = append(b, ip.AsSlice()...)
+	case err == nil && ip.Is6() && ip.Zone() == "" && ip.String() == a.Host:
+		b = append(b, atypIPv6)
+		b = append(b, ip.AsSlice()...)
+	default:
+		if len(a.Host) > 0xFF {
+			return nil, fmt.Errorf("host name too long: %d bytes", len(a.Host))
+		}
+		b = append(b, atypDomain, byte(len(a.Host)))
+		b = append(b, a.Host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(a.Port)), nil
+}
+
+func decodeAddr(b []byte) (*tnet.Addr, []byte, error) {
+	atyp, b := b[0], b[1:]
+	var host string
+	switch atyp {
+	case atypNone:
+		return nil, b, nil
+	case atypIPv4:
+		if len(b) < 4 {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		host = netip.AddrFrom4([4]byte(b[:4])).String()
+		b = b[4:]
+	case atypIPv6:
+		if len(b) < 16 {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		host = netip.AddrFrom16([16]byte(b[:16])).String()
+		b = b[16:]
+	case atypDomain:
+		if len(b) < 1 || len(b) < 1+int(b[0]) {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		host = string(b[1 : 1+b[0]])
+		b = b[1+b[0]:]
+	default:
+		return nil, nil, fmt.Errorf("unknown address type 0x%02x", atyp)
+	}
+	if len(b) < 2 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	return &tnet.Addr{Host: host, Port: int(binary.BigEndian.Uint16(b))}, b[2:], nil
+}
+
+func tcpfBits(f conf.TCPF) uint16 {
+	var bits uint16
+	for _, fl := range []struct {
+		set bool
+		bit uint16
+	}{
+		{f.FIN, flagFIN}, {f.SYN, flagSYN}, {f.RST, flagRST},
+		{f.PSH, flagPSH}, {f.ACK, flagACK}, {f.URG, flagURG},
+		{f.ECE, flagECE}, {f.CWR, flagCWR}, {f.NS, flagNS},
+	} {
+		if fl.set {
+			bits |= fl.bit
+		}
+	}
+	return bits
+}
+
+func tcpfFromBits(bits uint16) conf.TCPF {
+	return conf.TCPF{
+		FIN: bits&flagFIN != 0,
+		SYN: bits&flagSYN != 0,
+		RST: bits&flagRST != 0,
+		PSH: bits&flagPSH != 0,
+		ACK: bits&flagACK != 0,
+		URG: bits&flagURG != 0,
+		ECE: bits&flagECE != 0,
+		CWR: bits&flagCWR != 0,
+		NS:  bits&flagNS != 0,
+	}
+}
@@ -0,0 +1,138 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"paqet/internal/conf"
+	"paqet/internal/tnet"
+	"time"
+)
+
+// A PCTRL stream is the control channel of a session. The client opens it
+// right after authenticating and keeps it for the life of the session; after
+// the header, either side may send control messages:
+//
+//	KIND (1) | LENGTH (2) | BODY
+//
+// Receivers skip kinds they do not know.
+const (
+	// CtrlGoAway: no new streams on this session. Existing ones may run
+	// until the drain time, a 4-byte millisecond count, has passed; any
+	// bytes after it are a reason.
+	CtrlGoAway byte = 0x01
+	// CtrlMigrate: open new sessions at the address in the body, encoded as
+	// ATYP | ADDRESS.
+	CtrlMigrate byte = 0x02
+	// CtrlTCPF: TCP flag sets to send with, encoded as in OptTCPF.
+	CtrlTCPF byte = 0x03
+	// CtrlRate: cap on the sending rate of the session, a 4-byte count of
+	// kbit/s. Zero lifts the cap.
+	CtrlRate byte = 0x04
+	// CtrlNotice: a message for the operator, in UTF-8.
+	CtrlNotice byte = 0x05
+)
+
+// Ctrl is one control message. Only the fields of its Kind are used.
+type Ctrl struct {
+	Kind     byte
+	Drain    time.Duration
+	Text     string
+	Addr     *tnet.Addr
+	TCPF     []conf.TCPF
+	RateKbps uint32
+}
+
+func (c *Ctrl) Write(w io.Writer) error {
+	buf := make([]byte, 3, 64)
+	buf[0] = c.Kind
+	switch c.Kind {
+	case CtrlGoAway:
+		ms := c.Drain.Milliseconds()
+		if ms < 0 || ms > 0xFFFFFFFF {
+			return fmt.Errorf("drain time out of range: %v", c.Drain)
+		}
+		buf = binary.BigEndian.AppendUint32(buf, uint32(ms))
+		buf = append(buf, c.Text...)
+	case CtrlMigrate:
+		if c.Addr == nil {
+			return fmt.Errorf("migrate without an address")
+		}
+		var err error
+		if buf, err = appendAddr(buf, c.Addr); err != nil {
+			return err
+		}
+	case CtrlTCPF:
+		for _, f := range c.TCPF {
+			buf = binary.BigEndian.AppendUint16(buf, tcpfBits(f))
+		}
+	case CtrlRate:
+		buf = binary.BigEndian.AppendUint32(buf, c.RateKbps)
+	case CtrlNotice:
+		buf = append(buf, c.Text...)
+	default:
+		return fmt.Errorf("unknown control message kind 0x%02x", c.Kind)
+	}
+	if len(buf)-3 > maxBody {
+		return fmt.Errorf("control message too long: %d bytes", len(buf)-3)
+	}
+	binary.BigEndian.PutUint16(buf[1:], uint16(len(buf)-3))
+	_, err := w.Write(buf)
+	return err
+}
+
+// Read decodes the next control message of a kind it knows.
+func (c *Ctrl) Read(r io.Reader) error {
+	for {
+		var hdr [3]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return err
+		}
+		body := make([]byte, binary.BigEndian.Uint16(hdr[1:]))
+		if _, err := io.ReadFull(r, body); err != nil {
+			return err
+		}
+		*c = Ctrl{Kind: hdr[0]}
+		switch c.Kind {
+		case CtrlGoAway:
+			if len(body) < 4 {
+				return fmt.Errorf("goaway message has length %d", len(body))
+			}
+			c.Drain = time.Duration(binary.BigEndian.Uint32(body)) * time.Millisecond
+			c.Text = string(body[4:])
+		case CtrlMigrate:
+			if len(body) < 1 {
+				return io.ErrUnexpectedEOF
+			}
+			addr, rest, err := decodeAddr(body)
+			if err != nil {
+				return err
+			}
+			if addr == nil || len(rest) != 0 {
+				return fmt.Errorf("malformed migrate address")
+			}
+			c.Addr = addr
+		case CtrlTCPF:
+			if len(body)%2 != 0 {
+				return fmt.Errorf("TCP flags message has odd length %d", len(body))
+			}
+			for i := 0; i < len(body); i += 2 {
+				bits := binary.BigEndian.Uint16(body[i:])
+				if bits&^flagMask != 0 {
+					return fmt.Errorf("reserved TCP flag bits set: 0x%04x", bits)
+				}
+				c.TCPF = append(c.TCPF, tcpfFromBits(bits))
+			}
+		case CtrlRate:
+			if len(body) != 4 {
+				return fmt.Errorf("rate message has length %d", len(body))
+			}
+			c.RateKbps = binary.BigEndian.Uint32(body)
+		case CtrlNotice:
+			c.Text = string(body)
+		default:
+			continue
+		}
+		return nil
+	}
+}
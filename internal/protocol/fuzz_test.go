@@ -0,0 +1,104 @@
+package protocol
+
+import (
+	"bytes"
+	"paqet/internal/conf"
+	"paqet/internal/tnet"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func FuzzProtoRead(f *testing.F) {
+	seeds := []Proto{
+		{Type: PPING},
+		{Type: PPONG},
+		{Type: PTCPF, TCPF: []conf.TCPF{{PSH: true, ACK: true}, {SYN: true}}},
+		{Type: PTCP, Addr: &tnet.Addr{Host: "example.com", Port: 443}},
+		{Type: PUDP, Addr: &tnet.Addr{Host: "2001:db8::1", Port: 53}},
+		{Type: PUDP, Addr: &tnet.Addr{Host: "192.0.2.1", Port: 53}},
+		{Type: PTCP, Addr: &tnet.Addr{Host: "fe80::1%eth0", Port: 80}},
+		{Type: PTCP, Addr: &tnet.Addr{Host: "198.51.100.7", Port: 40000}},
+		{Type: PTCP, Status: StatusRefused},
+		{Type: PTCP, Addr: &tnet.Addr{Host: "example.com", Port: 80}, Codec: 0x01},
+		{Type: PUDPA},
+		{Type: PRBIND, Addr: &tnet.Addr{Host: "0.0.0.0", Port: 2222}},
+		{Type: PRCONN, Addr: &tnet.Addr{Host: "", Port: 2222}},
+		{Type: PCTRL},
+	}
+	for _, p := range seeds {
+		for _, v := range []Version{VersionGob, Version1, Version2, Version3, Version4, Version5} {
+			p.Version = v
+			var buf bytes.Buffer
+			if err := p.Write(&buf); err != nil {
+				f.Fatal(err)
+			}
+			f.Add(buf.Bytes())
+		}
+	}
+	f.Add([]byte{})
+	// A future version, and an unknown option with and without the critical bit.
+	f.Add([]byte{Magic, MaxVersion + 1, 0x00, 0x01, PPING})
+	f.Add([]byte{Magic, Version1, 0x00, 0x06, PPING, 0x00, 0x7f, 0x00, 0x01, 0xff})
+	f.Add([]byte{Magic, Version1, 0x00, 0x06, PPING, 0x00, 0xff, 0x00, 0x01, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var p Proto
+		if err := p.Read(bytes.NewReader(data)); err != nil {
+			return
+		}
+
+		// Anything we accept must survive a round trip unchanged.
+		var buf bytes.Buffer
+		if err := p.Write(&buf); err != nil {
+			t.Fatalf("failed to re-encode %+v: %v", p, err)
+		}
+		var q Proto
+		if err := q.Read(&buf); err != nil {
+			t.Fatalf("failed to decode re-encoded %+v: %v", p, err)
+		}
+		if !reflect.DeepEqual(p, q) {
+			t.Fatalf("round trip mismatch: %+v != %+v", p, q)
+		}
+	})
+}
+
+func FuzzCtrlRead(f *testing.F) {
+	seeds := []Ctrl{
+		{Kind: CtrlGoAway, Drain: 30 * time.Second, Text: "restarting"},
+		{Kind: CtrlGoAway},
+		{Kind: CtrlMigrate, Addr: &tnet.Addr{Host: "203.0.113.7", Port: 9999}},
+		{Kind: CtrlMigrate, Addr: &tnet.Addr{Host: "2001:db8::7", Port: 9999}},
+		{Kind: CtrlTCPF, TCPF: []conf.TCPF{{PSH: true, ACK: true}}},
+		{Kind: CtrlRate, RateKbps: 20000},
+		{Kind: CtrlNotice, Text: "maintenance at 02:00 UTC"},
+	}
+	for _, c := range seeds {
+		var buf bytes.Buffer
+		if err := c.Write(&buf); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes())
+	}
+	// An unknown kind followed by a notice.
+	f.Add([]byte{0x7f, 0x00, 0x01, 0xff, CtrlNotice, 0x00, 0x02, 'h', 'i'})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var c Ctrl
+		if err := c.Read(bytes.NewReader(data)); err != nil {
+			return
+		}
+
+		var buf bytes.Buffer
+		if err := c.Write(&buf); err != nil {
+			t.Fatalf("failed to re-encode %+v: %v", c, err)
+		}
+		var d Ctrl
+		if err := d.Read(&buf); err != nil {
+			t.Fatalf("failed to decode re-encoded %+v: %v", c, err)
+		}
+		if !reflect.DeepEqual(c, d) {
+			t.Fatalf("round trip mismatch: %+v != %+v", c, d)
+		}
+	})
+}
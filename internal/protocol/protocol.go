@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"bytes"
 	"encoding/gob"
 	"io"
 	"paqet/internal/conf"
@@ -15,25 +16,87 @@ const (
 	PTCPF PType = 0x03
 	PTCP  PType = 0x04
 	PUDP  PType = 0x05
+	PAUTH PType = 0x06
+	PUDPA PType = 0x07
+	// PRBIND asks the server to listen on Addr for a reverse tunnel; the
+	// tunnel lasts as long as the stream. PRCONN opens a server-initiated
+	// stream for a connection accepted on the tunnel listening on Addr.
+	PRBIND PType = 0x08
+	PRCONN PType = 0x09
+	// PCTRL opens the session's control channel, see control.go.
+	PCTRL PType = 0x0A
+)
+
+// Version selects the encoding of a stream header. VersionGob is the legacy
+// gob encoding, which carries no version on the wire.
+type Version = byte
+
+const (
+	VersionGob Version = 0x00
+	Version1   Version = 0x01
+	// Version2 keeps the v1 body and adds the server's reply to PTCP, see
+	// result.go.
+	Version2 Version = 0x02
+	// Version3 frames the payload of PUDP streams as length-prefixed
+	// datagrams; earlier versions relay it as a plain byte stream.
+	Version3 Version = 0x03
+	// Version4 carries the payload of TCP streams in chunks, so that either
+	// direction can end on its own, see tnet.HalfStrm.
+	Version4 Version = 0x04
+	// Version5 servers agree to every codec they know, so clients may send
+	// compressed payload before the dial result arrives.
+	Version5 Version = 0x05
+
+	MaxVersion = Version5
 )
 
 type Proto struct {
 	Type PType
 	Addr *tnet.Addr
 	TCPF []conf.TCPF
+
+	// Session handshake fields, see auth.go.
+	User   string
+	Nonce  []byte
+	Proof  []byte
+	Status byte
+
+	// Codec is the compression a TCP stream asks for, and the one the
+	// server's dial result agrees to; see tnet.Codecs.
+	Codec byte
+
+	// Version is the encoding used by Write, and the one Read found on the wire.
+	Version Version
 }
 
+// Read decodes a header in whichever encoding the peer used. Binary headers
+// start with Magic, which can never be the first byte of a gob stream.
 func (p *Proto) Read(r io.Reader) error {
-	dec := gob.NewDecoder(r)
+	var first [1]byte
+	if _, err := io.ReadFull(r, first[:]); err != nil {
+		return err
+	}
+	if first[0] == Magic {
+		return p.readBinary(r)
+	}
 
+	// gob buffers any reader that is not an io.ByteReader, which would swallow
+	// payload bytes following the header.
+	dec := gob.NewDecoder(byteReader{io.MultiReader(bytes.NewReader(first[:]), r)})
+	*p = Proto{}
 	err := dec.Decode(p)
 	if err != nil {
 		return err
 	}
+	p.Version = VersionGob
 	return nil
 }
 
 func (p *Proto) Write(w io.Writer) error {
+	if p.Version != VersionGob {
+		return p.writeBinary(w)
+	}
+
 	enc := gob.NewEncoder(w)
 
 	err := enc.Encode(p)
@@ -43,3 +106,13 @@ func (p *Proto) Write(w io.Writer) error {
 
 	return nil
 }
+
+type byteReader struct {
+	io.Reader
+}
+
+func (b byteReader) ReadByte() (byte, error) {
+	var buf [1]byte
+	_, err := io.ReadFull(b.Reader, buf[:])
+	return buf[0], err
+}
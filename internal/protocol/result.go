@@ -0,0 +1,73 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// From Version2 on, the server answers a PTCP header before relaying any
+// bytes:
+//
+//	client -> server  PTCP{Addr: target}
+//	server -> client  PTCP{Status, Addr: bound address}
+//
+// The bound address is the server's local end of the connection to the
+// target, and is only set on success. The stream is closed after a failure.
+const (
+	StatusRefused     byte = 0x02
+	StatusUnreachable byte = 0x03
+	StatusDNS         byte = 0x04
+	StatusTimeout     byte = 0x05
+	StatusFailed      byte = 0x06
+)
+
+// ErrDenied is the dial error for a destination the server's policy does not
+// allow. DialStatus reports it as StatusDenied.
+var ErrDenied = errors.New("denied by server policy")
+
+// StatusText describes a status byte.
+func StatusText(status byte) string {
+	switch status {
+	case StatusOK:
+		return "ok"
+	case StatusDenied:
+		return "denied by server policy"
+	case StatusRefused:
+		return "connection refused"
+	case StatusUnreachable:
+		return "network unreachable"
+	case StatusDNS:
+		return "name resolution failed"
+	case StatusTimeout:
+		return "timed out"
+	default:
+		return "dial failed"
+	}
+}
+
+// DialStatus classifies a dial error into the status reported to clients.
+func DialStatus(err error) byte {
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil:
+		return StatusOK
+	case errors.Is(err, ErrDenied):
+		return StatusDenied
+	case errors.As(err, &dnsErr) && !dnsErr.IsTimeout:
+		return StatusDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return StatusRefused
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return StatusUnreachable
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return StatusTimeout
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return StatusTimeout
+	}
+	return StatusFailed
+}
@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDialStatus(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := closed.Addr().String()
+	closed.Close()
+
+	deny := func(context.Context, string, string, syscall.RawConn) error { return ErrDenied }
+	for _, tc := range []struct {
+		name   string
+		dialer *net.Dialer
+		addr   string
+		want   byte
+	}{
+		{"denied", &net.Dialer{ControlContext: deny}, addr, StatusDenied},
+		{"refused", &net.Dialer{}, addr, StatusRefused},
+		{"dns", &net.Dialer{}, "nonexistent.invalid:80", StatusDNS},
+		{"timeout", &net.Dialer{Timeout: time.Nanosecond}, "192.0.2.1:80", StatusTimeout},
+	} {
+		_, err := tc.dialer.Dial("tcp", tc.addr)
+		if got := DialStatus(err); got != tc.want {
+			t.Errorf("%s: DialStatus(%v) = %s, want %s", tc.name, err, StatusText(got), StatusText(tc.want))
+		}
+	}
+	if got := DialStatus(nil); got != StatusOK {
+		t.Errorf("DialStatus(nil) = %s", StatusText(got))
+	}
+}
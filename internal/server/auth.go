@@ -0,0 +1,81 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+)
+
+const authTimeout = 10 * time.Second
+
+func (s *Server) handleAuth(sess *session, strm tnet.Strm, p *protocol.Proto) error {
+	if sess.user.Load() != nil {
+		return fmt.Errorf("session %s is already authenticated as %s", sess.conn.RemoteAddr(), sess.name())
+	}
+	strm.SetDeadline(time.Now().Add(authTimeout))
+
+	name := p.User
+	nonce := make([]byte, protocol.NonceSize)
+	rand.Read(nonce)
+	challenge := protocol.Proto{Type: protocol.PAUTH, Nonce: nonce, Version: p.Version}
+	if err := challenge.Write(strm); err != nil {
+		return fmt.Errorf("failed to send auth challenge: %w", err)
+	}
+	var resp protocol.Proto
+	if err := resp.Read(strm); err != nil {
+		return fmt.Errorf("failed to read auth response: %w", err)
+	}
+
+	// Unknown and disabled users get the same challenge and the same denial.
+	u := s.users[name]
+	ok := resp.Type == protocol.PAUTH && u != nil && *u.Enabled &&
+		hmac.Equal(resp.Proof, protocol.AuthProof(u.Secret, name, nonce, tnet.Binding(sess.conn)))
+	limited := ok && !s.claimUser(sess, u)
+
+	result := protocol.Proto{Type: protocol.PAUTH, Status: protocol.StatusOK, Version: p.Version}
+	if !ok || limited {
+		result.Status = protocol.StatusDenied
+	}
+	if err := result.Write(strm); err != nil {
+		return fmt.Errorf("failed to send auth result: %w", err)
+	}
+	if !ok || limited {
+		if limited {
+			flog.Warnf("denying session %s for user %s: max_sessions limit reached (%d)", sess.conn.RemoteAddr(), name, u.MaxSessions)
+		} else {
+			flog.Warnf("authentication failed for user %q from %s", name, sess.conn.RemoteAddr())
+		}
+		// Give the denial a moment to reach the client before tearing down.
+		time.AfterFunc(time.Second, func() { sess.conn.Close() })
+		return nil
+	}
+
+	flog.Infof("session %s authenticated as %s", sess.conn.RemoteAddr(), name)
+	return nil
+}
+
+// claimUser makes u the user of sess, unless u already has max_sessions
+// sessions.
+func (s *Server) claimUser(sess *session, u *conf.User) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u.MaxSessions > 0 {
+		n := 0
+		for other := range s.sessions {
+			if other.user.Load() == u {
+				n++
+			}
+		}
+		if n >= u.MaxSessions {
+			return false
+		}
+	}
+	sess.user.Store(u)
+	return true
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"paqet/internal/flog"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+	"sync"
+	"time"
+)
+
+// control is the server end of a session's control stream.
+type control struct {
+	strm tnet.Strm
+	mu   sync.Mutex
+}
+
+func (c *control) send(m *protocol.Ctrl) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.strm.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	defer c.strm.SetWriteDeadline(time.Time{})
+	return m.Write(c.strm)
+}
+
+// handleControl keeps the session's control stream for as long as the
+// client holds it open, starting with the settings it should use.
+func (s *Server) handleControl(sess *session, strm tnet.Strm, p *protocol.Proto) error {
+	if p.Version == protocol.VersionGob {
+		return fmt.Errorf("control stream %d needs a binary header", strm.SID())
+	}
+	c := &control{strm: strm}
+	if !sess.ctrl.CompareAndSwap(nil, c) {
+		return fmt.Errorf("session %s already has a control stream", strm.RemoteAddr())
+	}
+	defer sess.ctrl.CompareAndSwap(c, nil)
+
+	for _, m := range s.settings() {
+		if err := c.send(&m); err != nil {
+			return fmt.Errorf("failed to send control message on stream %d: %w", strm.SID(), err)
+		}
+	}
+	flog.Debugf("control stream %d opened for %s", strm.SID(), strm.RemoteAddr())
+
+	var m protocol.Ctrl
+	for {
+		if err := m.Read(strm); err != nil {
+			flog.Debugf("control stream %d for %s ended: %v", strm.SID(), strm.RemoteAddr(), err)
+			return nil
+		}
+		flog.Debugf("ignoring control message 0x%02x from %s", m.Kind, strm.RemoteAddr())
+	}
+}
+
+// settings returns the messages every new control stream starts with.
+func (s *Server) settings() []protocol.Ctrl {
+	cfg := &s.cfg.Control
+	var msgs []protocol.Ctrl
+	if len(cfg.TCPF) > 0 {
+		msgs = append(msgs, protocol.Ctrl{Kind: protocol.CtrlTCPF, TCPF: cfg.TCPF})
+	}
+	if cfg.RateKbps > 0 {
+		msgs = append(msgs, protocol.Ctrl{Kind: protocol.CtrlRate, RateKbps: uint32(cfg.RateKbps)})
+	}
+	if cfg.Notice != "" {
+		msgs = append(msgs, protocol.Ctrl{Kind: protocol.CtrlNotice, Text: cfg.Notice})
+	}
+	return msgs
+}
+
+// goAway tells every session with a control stream to stop opening streams,
+// and to reconnect at control.migrate when that is set. It returns how many
+// sessions were told.
+func (s *Server) goAway(drain time.Duration) int {
+	msgs := []protocol.Ctrl{{Kind: protocol.CtrlGoAway, Drain: drain, Text: "server shutting down"}}
+	if addr := s.cfg.Control.Migrate; addr != nil {
+		msgs = append([]protocol.Ctrl{{Kind: protocol.CtrlMigrate, Addr: addr}}, msgs...)
+	}
+
+	s.mu.Lock()
+	var ctrls []*control
+	for sess := range s.sessions {
+		if c := sess.ctrl.Load(); c != nil {
+			ctrls = append(ctrls, c)
+		}
+	}
+	s.mu.Unlock()
+
+	n := 0
+	for _, c := range ctrls {
+		ok := true
+		for _, m := range msgs {
+			if err := c.send(&m); err != nil {
+				flog.Debugf("failed to send GOAWAY to %s: %v", c.strm.RemoteAddr(), err)
+				ok = false
+				break
+			}
+		}
+		if ok {
+			n++
+		}
+	}
+	return n
+}
+
+// drain stops taking sessions, sends GOAWAY and waits for the drain time to
+// pass, for all sessions to end, or for another signal, whichever comes
+// first. Sessions are closed as soon as only their control stream is left.
+func (s *Server) drain(ctx context.Context, sig <-chan os.Signal) {
+	s.draining.Store(true)
+	drain := time.Duration(s.cfg.Control.DrainMs) * time.Millisecond
+	n := s.goAway(drain)
+	if n == 0 || drain == 0 {
+		return
+	}
+	flog.Infof("sent GOAWAY to %d sessions, draining for up to %v", n, drain)
+
+	timer := time.NewTimer(drain)
+	defer timer.Stop()
+	tick := time.NewTicker(200 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return
+		case <-sig:
+			flog.Infof("second signal received, skipping the drain")
+			return
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			s.closeIdle()
+			if s.activeSessions.Load() == 0 {
+				return
+			}
+		}
+	}
+}
+
+// closeIdle closes the sessions that have no streams open besides their
+// control stream.
+func (s *Server) closeIdle() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sess := range s.sessions {
+		n := sess.streams.Load()
+		if sess.ctrl.Load() != nil {
+			n--
+		}
+		if n <= 0 {
+			flog.Debugf("closing drained session %s", sess.conn.RemoteAddr())
+			sess.conn.Close()
+		}
+	}
+}
@@ -2,8 +2,9 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"sync/atomic"
+	"time"
 
 	"paqet/internal/flog"
 	"paqet/internal/protocol"
@@ -11,7 +12,24 @@ import (
 )
 
 func (s *Server) handleConn(ctx context.Context, conn tnet.Conn) {
-	var activeStreams atomic.Int64
+	sess := &session{conn: conn}
+	s.mu.Lock()
+	s.sessions[sess] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.sessions, sess)
+		s.mu.Unlock()
+	}()
+	if len(s.users) > 0 {
+		t := time.AfterFunc(authTimeout, func() {
+			if sess.user.Load() == nil {
+				flog.Warnf("closing session %s: no authentication within %v", conn.RemoteAddr(), authTimeout)
+				conn.Close()
+			}
+		})
+		defer t.Stop()
+	}
 	for {
 		select {
 		case <-ctx.Done():
@@ -24,16 +42,16 @@ func (s *Server) handleConn(ctx context.Context, conn tnet.Conn) {
 			flog.Errorf("failed to accept stream on %s: %v", conn.RemoteAddr(), err)
 			return
 		}
-		if max := int64(s.cfg.Transport.KCP.MaxStreamsPerSession); max > 0 && activeStreams.Load() >= max {
+		if _, max := s.cfg.Transport.Limits(); max > 0 && sess.streams.Load() >= int64(max) {
 			flog.Warnf("rejecting stream %d on %s: max_streams_per_session limit reached (%d)", strm.SID(), conn.RemoteAddr(), max)
 			strm.Close()
 			continue
 		}
-		activeStreams.Add(1)
+		sess.streams.Add(1)
 		s.wg.Go(func() {
-			defer activeStreams.Add(-1)
+			defer sess.streams.Add(-1)
 			defer strm.Close()
-			if err := s.handleStrm(ctx, strm); err != nil {
+			if err := s.handleStrm(ctx, sess, strm); err != nil {
 				flog.Errorf("stream %d from %s closed with error: %v", strm.SID(), strm.RemoteAddr(), err)
 			} else {
 				flog.Debugf("stream %d from %s closed", strm.SID(), strm.RemoteAddr())
@@ -42,26 +60,61 @@ func (s *Server) handleConn(ctx context.Context, conn tnet.Conn) {
 	}
 }
 
-func (s *Server) handleStrm(ctx context.Context, strm tnet.Strm) error {
+func (s *Server) handleStrm(ctx context.Context, sess *session, strm tnet.Strm) error {
 	var p protocol.Proto
 	err := p.Read(strm)
+	if errors.Is(err, protocol.ErrVersion) && s.cfg.Transport.Wire != "gob" {
+		// A newer client probing for its version; answer with ours so it can step down.
+		flog.Debugf("stream %d from %s uses wire version %d, offering %d", strm.SID(), strm.RemoteAddr(), p.Version, protocol.MaxVersion)
+		return s.handlePing(strm, protocol.MaxVersion)
+	}
 	if err != nil {
 		flog.Errorf("failed to read protocol message from stream %d: %v", strm.SID(), err)
 		return err
 	}
+	switch wire := s.cfg.Transport.Wire; {
+	case wire != "auto" && wire != "gob" && p.Version == protocol.VersionGob:
+		return fmt.Errorf("rejected legacy gob header on stream %d (transport.wire is %s)", strm.SID(), wire)
+	case wire == "gob" && p.Version != protocol.VersionGob:
+		return fmt.Errorf("rejected binary header on stream %d (transport.wire is gob)", strm.SID())
+	}
+
+	if len(s.users) > 0 && sess.user.Load() == nil && p.Type != protocol.PPING && p.Type != protocol.PAUTH {
+		return fmt.Errorf("protocol type %d on stream %d before authentication", p.Type, strm.SID())
+	}
+	if (p.Type == protocol.PTCP || p.Type == protocol.PUDP || p.Type == protocol.PRBIND) && p.Addr == nil {
+		return fmt.Errorf("protocol type %d on stream %d carries no address", p.Type, strm.SID())
+	}
 
 	switch p.Type {
 	case protocol.PPING:
-		return s.handlePing(strm)
+		return s.handlePing(strm, p.Version)
 	case protocol.PTCPF:
-		if len(p.TCPF) != 0 {
+		if len(p.TCPF) != 0 && s.pConn != nil {
 			s.pConn.SetClientTCPF(strm.RemoteAddr(), p.TCPF)
 		}
 		return nil
 	case protocol.PTCP:
-		return s.handleTCPProtocol(ctx, strm, &p)
+		return s.handleTCPProtocol(ctx, sess, strm, &p)
 	case protocol.PUDP:
-		return s.handleUDPProtocol(ctx, strm, &p)
+		return s.handleUDPProtocol(ctx, sess, strm, &p)
+	case protocol.PUDPA:
+		if p.Version < protocol.Version3 {
+			return fmt.Errorf("UDP association on stream %d needs wire protocol v%d, got v%d", strm.SID(), protocol.Version3, p.Version)
+		}
+		return s.handleUDPAssociation(ctx, sess, strm)
+	case protocol.PRBIND:
+		if p.Version == protocol.VersionGob {
+			return fmt.Errorf("reverse tunnel on stream %d needs a binary header", strm.SID())
+		}
+		return s.handleReverseBind(ctx, sess, strm, &p)
+	case protocol.PCTRL:
+		return s.handleControl(sess, strm, &p)
+	case protocol.PAUTH:
+		if len(s.users) == 0 {
+			return fmt.Errorf("authentication requested on stream %d, but no users are configured", strm.SID())
+		}
+		return s.handleAuth(sess, strm, &p)
 	default:
 		flog.Errorf("unknown protocol type %d on stream %d", p.Type, strm.SID())
 		return fmt.Errorf("unknown protocol type: %d", p.Type)
@@ -6,9 +6,9 @@ import (
 	"paqet/internal/tnet"
 )
 
-func (s *Server) handlePing(strm tnet.Strm) error {
+func (s *Server) handlePing(strm tnet.Strm, ver protocol.Version) error {
 	flog.Debugf("accepted ping on stream %d from %s", strm.SID(), strm.RemoteAddr())
-	p := protocol.Proto{Type: protocol.PPONG}
+	p := protocol.Proto{Type: protocol.PPONG, Version: ver}
 	if err := p.Write(strm); err != nil {
 		flog.Errorf("failed to send pong on stream %d: %v", strm.SID(), err)
 		return err
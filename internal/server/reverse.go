@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"paqet/internal/flog"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+)
+
+// handleReverseBind serves a reverse tunnel for as long as strm stays open:
+// connections accepted on p.Addr are handed to the client on streams the
+// server opens itself.
+func (s *Server) handleReverseBind(ctx context.Context, sess *session, strm tnet.Strm, p *protocol.Proto) error {
+	addr := p.Addr.String()
+	if !s.reverseAllowed(p.Addr) {
+		s.sendBindResult(strm, protocol.StatusDenied, nil, p.Version)
+		return fmt.Errorf("reverse tunnel on %s for %s (user %s) is not in reverse_allow", addr, strm.RemoteAddr(), sess.name())
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		s.sendBindResult(strm, protocol.StatusFailed, nil, p.Version)
+		return fmt.Errorf("failed to listen on %s for reverse tunnel: %w", addr, err)
+	}
+	defer ln.Close()
+	bound, _ := tnet.NewAddr(ln.Addr().String())
+	if err := s.sendBindResult(strm, protocol.StatusOK, bound, p.Version); err != nil {
+		return fmt.Errorf("failed to confirm reverse tunnel on stream %d: %w", strm.SID(), err)
+	}
+	flog.Infof("reverse tunnel %s opened for %s (user %s)", addr, strm.RemoteAddr(), sess.name())
+
+	// Nothing more is sent on the bind stream; it only ends the tunnel.
+	done := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, strm)
+		close(done)
+	}()
+	go func() {
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			flog.Infof("reverse tunnel %s closed for %s", addr, strm.RemoteAddr())
+			return nil
+		}
+		s.wg.Go(func() {
+			defer conn.Close()
+			if err := s.serveReverse(ctx, sess, conn, p); err != nil {
+				flog.Errorf("reverse connection %s on %s closed with error: %v", conn.RemoteAddr(), addr, err)
+			} else {
+				flog.Debugf("reverse connection %s on %s closed", conn.RemoteAddr(), addr)
+			}
+		})
+	}
+}
+
+func (s *Server) serveReverse(ctx context.Context, sess *session, conn net.Conn, bind *protocol.Proto) error {
+	strm, err := sess.conn.OpenStrm()
+	if err != nil {
+		return fmt.Errorf("failed to open stream to client: %w", err)
+	}
+	defer strm.Close()
+	p := protocol.Proto{Type: protocol.PRCONN, Addr: bind.Addr, Version: bind.Version}
+	if err := p.Write(strm); err != nil {
+		return fmt.Errorf("failed to write protocol header on stream %d: %w", strm.SID(), err)
+	}
+	flog.Infof("accepted reverse connection %s on %s -> stream %d", conn.RemoteAddr(), bind.Addr, strm.SID())
+	if p.Version >= protocol.Version4 {
+		return relayTCP(ctx, conn, tnet.NewHalfStrm(strm), conn.RemoteAddr().String())
+	}
+	return relayTCP(ctx, conn, strm, conn.RemoteAddr().String())
+}
+
+func (s *Server) sendBindResult(strm tnet.Strm, status byte, bound *tnet.Addr, ver protocol.Version) error {
+	p := protocol.Proto{Type: protocol.PRBIND, Status: status, Addr: bound, Version: ver}
+	return p.Write(strm)
+}
+
+// reverseAllowed compares addr with reverse_allow after putting its host in
+// the same canonical form.
+func (s *Server) reverseAllowed(addr *tnet.Addr) bool {
+	host := addr.Host
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	} else if host != "" {
+		return false
+	}
+	for _, a := range s.cfg.ReverseAllow {
+		if a.Host == host && a.Port == addr.Port {
+			return true
+		}
+	}
+	return false
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -14,19 +15,33 @@ import (
 	"paqet/internal/socket"
 	"paqet/internal/tnet"
 	"paqet/internal/tnet/kcp"
+	"paqet/internal/tnet/quic"
+	"paqet/internal/tnet/ws"
 )
 
 type Server struct {
 	cfg   *conf.Conf
 	pConn *socket.PacketConn
 	wg    sync.WaitGroup
+	users map[string]*conf.User
+
+	mu       sync.Mutex
+	sessions map[*session]struct{}
 
 	activeSessions atomic.Int64
+	// draining is set once shutdown starts; new sessions are refused from then.
+	draining atomic.Bool
 }
 
 func New(cfg *conf.Conf) (*Server, error) {
 	s := &Server{
-		cfg: cfg,
+		cfg:   cfg,
+		users: make(map[string]*conf.User, len(cfg.Users)),
+
+		sessions: make(map[*session]struct{}),
+	}
+	for i := range cfg.Users {
+		s.users[cfg.Users[i].Name] = &cfg.Users[i]
 	}
 
 	return s, nil
@@ -40,31 +55,60 @@ func (s *Server) Start() error {
 	go func() {
 		<-sig
 		flog.Infof("Shutdown signal received, initiating graceful shutdown...")
+		s.drain(ctx, sig)
 		cancel()
 	}()
 
-	pConn, err := socket.New(ctx, &s.cfg.Network)
-	if err != nil {
-		return fmt.Errorf("could not create raw packet conn: %w", err)
-	}
-	s.pConn = pConn
+	t := &s.cfg.Transport
+	if t.Protocol != "ws" {
+		pConn, err := socket.New(ctx, &s.cfg.Network)
+		if err != nil {
+			return fmt.Errorf("could not create raw packet conn: %w", err)
+		}
+		s.pConn = pConn
 
-	listener, err := kcp.Listen(s.cfg.Transport.KCP, pConn)
-	if err != nil {
-		return fmt.Errorf("could not start KCP listener: %w", err)
+		listener, err := s.listenTransport(pConn)
+		if err != nil {
+			return fmt.Errorf("could not start %s listener: %w", strings.ToUpper(t.Protocol), err)
+		}
+		defer listener.Close()
+		flog.Infof("Server started - listening for packets on :%d", s.cfg.Listen.Addr.Port)
+
+		s.wg.Go(func() {
+			s.listen(ctx, listener)
+		})
 	}
-	defer listener.Close()
-	flog.Infof("Server started - listening for packets on :%d", s.cfg.Listen.Addr.Port)
+	if t.WS != nil {
+		listener, err := ws.Listen(t.WS)
+		if err != nil {
+			return fmt.Errorf("could not start WS listener: %w", err)
+		}
+		defer listener.Close()
+		flog.Infof("Server started - accepting WebSocket sessions on %s%s", listener.Addr(), t.WS.Path)
 
-	s.wg.Go(func() {
-		s.listen(ctx, listener)
-	})
+		s.wg.Go(func() {
+			s.listen(ctx, listener)
+		})
+	}
 
 	s.wg.Wait()
+	if st := tnet.CompressionStats(); st.In > 0 {
+		flog.Infof("compression: %s", st)
+	}
 	flog.Infof("Server shutdown completed")
 	return nil
 }
 
+func (s *Server) listenTransport(pConn *socket.PacketConn) (tnet.Listener, error) {
+	t := &s.cfg.Transport
+	switch t.Protocol {
+	case "quic":
+		return quic.Listen(t.QUIC, pConn)
+	default:
+		return kcp.Listen(t.KCP, pConn)
+	}
+}
+
 func (s *Server) listen(ctx context.Context, listener tnet.Listener) {
 	go func() {
 		<-ctx.Done()
@@ -81,7 +125,12 @@ func (s *Server) listen(ctx context.Context, listener tnet.Listener) {
 			flog.Errorf("failed to accept connection: %v", err)
 			continue
 		}
-		if max := int64(s.cfg.Transport.KCP.MaxSessions); max > 0 && s.activeSessions.Load() >= max {
+		if s.draining.Load() {
+			flog.Infof("rejecting connection from %s: server is shutting down", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		if max, _ := s.cfg.Transport.Limits(); max > 0 && s.activeSessions.Load() >= int64(max) {
 			flog.Warnf("rejecting connection from %s: max_sessions limit reached (%d)", conn.RemoteAddr(), max)
 			conn.Close()
 			continue
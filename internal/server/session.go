@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"paqet/internal/conf"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+)
+
+// session is the server side state of one client connection.
+type session struct {
+	conn tnet.Conn
+	user atomic.Pointer[conf.User]
+	ctrl atomic.Pointer[control]
+
+	// streams counts the session's open streams, the control stream included.
+	streams atomic.Int64
+}
+
+// name identifies the session's user in logs.
+func (s *session) name() string {
+	if u := s.user.Load(); u != nil {
+		return u.Name
+	}
+	return "-"
+}
+
+// allowed reports whether the session's user may reach addr. Sessions
+// without a user, and users without an allow list, may reach any address.
+func (s *session) allowed(addr netip.AddrPort) bool {
+	u := s.user.Load()
+	if u == nil || len(u.Allow) == 0 {
+		return true
+	}
+	ip := addr.Addr().Unmap()
+	for _, d := range u.Allow {
+		if d.Prefix.Contains(ip) && (d.Port == 0 || d.Port == addr.Port()) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialer returns a dialer for the session's outbound connections. It checks
+// each address after name resolution, so a host name that resolves outside
+// the user's allow list is refused with protocol.ErrDenied.
+func (s *session) dialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout: 10 * time.Second,
+		ControlContext: func(_ context.Context, _, address string, _ syscall.RawConn) error {
+			addr, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !s.allowed(addr) {
+				return protocol.ErrDenied
+			}
+			return nil
+		},
+	}
+}
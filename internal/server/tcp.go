@@ -2,22 +2,36 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"paqet/internal/flog"
 	"paqet/internal/pkg/buffer"
 	"paqet/internal/protocol"
 	"paqet/internal/tnet"
-	"time"
 )
 
-func (s *Server) handleTCPProtocol(ctx context.Context, strm tnet.Strm, p *protocol.Proto) error {
-	flog.Infof("accepted TCP stream %d: %s -> %s", strm.SID(), strm.RemoteAddr(), p.Addr.String())
-	return s.handleTCP(ctx, strm, p.Addr.String())
+func (s *Server) handleTCPProtocol(ctx context.Context, sess *session, strm tnet.Strm, p *protocol.Proto) error {
+	flog.Infof("accepted TCP stream %d: %s (user %s) -> %s", strm.SID(), strm.RemoteAddr(), sess.name(), p.Addr.String())
+	return s.handleTCP(ctx, sess, strm, p.Addr.String(), p.Version, p.Codec)
 }
 
-func (s *Server) handleTCP(ctx context.Context, strm tnet.Strm, addr string) error {
-	dialer := &net.Dialer{Timeout: 10 * time.Second}
-	conn, err := dialer.DialContext(ctx, "tcp", addr)
+func (s *Server) handleTCP(ctx context.Context, sess *session, strm tnet.Strm, addr string, ver protocol.Version, codec byte) error {
+	if ver >= protocol.Version5 && !knownCodec(codec) {
+		// The client may already be sending with it; nothing to fall back to.
+		p := protocol.Proto{Type: protocol.PTCP, Status: protocol.StatusFailed, Version: ver}
+		p.Write(strm)
+		return fmt.Errorf("unknown compression 0x%02x on stream %d", codec, strm.SID())
+	}
+	conn, err := sess.dialer().DialContext(ctx, "tcp", addr)
+	if ver < protocol.Version2 || !knownCodec(codec) {
+		codec = tnet.CodecNone
+	}
+	if ver >= protocol.Version2 {
+		if rerr := sendDialResult(strm, conn, err, ver, codec); rerr != nil && err == nil {
+			conn.Close()
+			return fmt.Errorf("failed to send dial result on stream %d: %w", strm.SID(), rerr)
+		}
+	}
 	if err != nil {
 		flog.Errorf("failed to establish TCP connection to %s for stream %d: %v", addr, strm.SID(), err)
 		return err
@@ -28,33 +42,44 @@ func (s *Server) handleTCP(ctx context.Context, strm tnet.Strm, addr string) err
 	}()
 	flog.Debugf("TCP connection established to %s for stream %d", addr, strm.SID())
 
-	errChan := make(chan error, 2)
-	go func() {
-		err := buffer.CopyT(conn, strm)
-		errChan <- err
-	}()
-	go func() {
-		err := buffer.CopyT(strm, conn)
-		errChan <- err
-	}()
+	if ver >= protocol.Version4 {
+		strm = tnet.NewHalfStrm(strm)
+	}
+	if codec != tnet.CodecNone {
+		strm = tnet.NewCompressStrm(strm, codec)
+		defer strm.Close()
+	}
+	return relayTCP(ctx, conn, strm, addr)
+}
 
-	select {
-	case err := <-errChan:
-		now := time.Now()
-		conn.SetDeadline(now)
-		strm.SetDeadline(now)
-		err2 := <-errChan
-		conn.SetDeadline(time.Time{})
-		strm.SetDeadline(time.Time{})
-		if err != nil {
-			flog.Errorf("TCP stream %d to %s failed: %v", strm.SID(), addr, err)
-			return err
+func knownCodec(codec byte) bool {
+	for _, c := range tnet.Codecs {
+		if c == codec {
+			return true
 		}
-		if err2 != nil {
-			flog.Errorf("TCP stream %d to %s failed: %v", strm.SID(), addr, err2)
-			return err2
-		}
-	case <-ctx.Done():
+	}
+	return false
+}
+
+// relayTCP copies between conn and strm until both directions are done, or
+// until either fails. addr names the far end of conn in logs.
+func relayTCP(ctx context.Context, conn net.Conn, strm tnet.Strm, addr string) error {
+	if err := buffer.RelayT(ctx, conn, strm); err != nil {
+		flog.Errorf("TCP stream %d to %s failed: %v", strm.SID(), addr, err)
+		return err
 	}
 	return nil
 }
+
+// sendDialResult tells the client how dialing its target went, and from
+// which local address and with which compression when it worked.
+func sendDialResult(strm tnet.Strm, conn net.Conn, err error, ver protocol.Version, codec byte) error {
+	p := protocol.Proto{Type: protocol.PTCP, Status: protocol.DialStatus(err), Version: ver}
+	if err == nil {
+		p.Codec = codec
+		if bound, aerr := tnet.NewAddr(conn.LocalAddr().String()); aerr == nil {
+			p.Addr = bound
+		}
+	}
+	return p.Write(strm)
+}
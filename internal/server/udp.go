@@ -2,7 +2,6 @@ package server
 
 import (
 	"context"
-	"net"
 	"paqet/internal/flog"
 	"paqet/internal/pkg/buffer"
 	"paqet/internal/protocol"
@@ -10,15 +9,20 @@ import (
 	"time"
 )
 
-func (s *Server) handleUDPProtocol(ctx context.Context, strm tnet.Strm, p *protocol.Proto) error {
-	flog.Infof("accepted UDP stream %d: %s -> %s", strm.SID(), strm.RemoteAddr(), p.Addr.String())
-	return s.handleUDP(ctx, strm, p.Addr.String())
+func (s *Server) handleUDPProtocol(ctx context.Context, sess *session, strm tnet.Strm, p *protocol.Proto) error {
+	flog.Infof("accepted UDP stream %d: %s (user %s) -> %s", strm.SID(), strm.RemoteAddr(), sess.name(), p.Addr.String())
+	if p.Version >= protocol.Version3 {
+		strm = tnet.NewDgramStrm(strm, s.cfg.Transport.MaxDatagram)
+		if dc, ok := sess.conn.(tnet.DatagramConn); ok {
+			strm, _ = dc.BindDatagrams(strm)
+		}
+		defer strm.Close()
+	}
+	return s.handleUDP(ctx, sess, strm, p.Addr.String())
 }
 
-func (s *Server) handleUDP(ctx context.Context, strm tnet.Strm, addr string) error {
-	conn, err := (&net.Dialer{
-		Timeout: 10 * time.Second,
-	}).DialContext(ctx, "udp", addr)
+func (s *Server) handleUDP(ctx context.Context, sess *session, strm tnet.Strm, addr string) error {
+	conn, err := sess.dialer().DialContext(ctx, "udp", addr)
 	if err != nil {
 		flog.Errorf("failed to establish UDP connection to %s for stream %d: %v", addr, strm.SID(), err)
 		return err
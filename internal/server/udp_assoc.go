@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"paqet/internal/flog"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+	"time"
+)
+
+// maxResolved bounds the per-association cache of resolved destinations.
+const maxResolved = 256
+
+func (s *Server) handleUDPAssociation(ctx context.Context, sess *session, strm tnet.Strm) error {
+	flog.Infof("accepted UDP association stream %d: %s (user %s)", strm.SID(), strm.RemoteAddr(), sess.name())
+
+	// Unconnected, so replies from any host and port come back: the client
+	// sees endpoint-independent (full-cone) mapping and filtering.
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		flog.Errorf("failed to open UDP socket for association stream %d: %v", strm.SID(), err)
+		return err
+	}
+	defer conn.Close()
+
+	strm = tnet.NewDgramStrm(strm, s.cfg.Transport.MaxDatagram+protocol.MaxAddrSize)
+	if dc, ok := sess.conn.(tnet.DatagramConn); ok {
+		strm, _ = dc.BindDatagrams(strm)
+	}
+	defer strm.Close()
+	flog.Debugf("UDP association stream %d bound to %s", strm.SID(), conn.LocalAddr())
+
+	errChan := make(chan error, 2)
+	go func() {
+		errChan <- s.assocSend(sess, strm, conn)
+	}()
+	go func() {
+		errChan <- s.assocRecv(strm, conn)
+	}()
+
+	select {
+	case err := <-errChan:
+		now := time.Now()
+		conn.SetDeadline(now)
+		strm.SetDeadline(now)
+		<-errChan
+		if err != nil {
+			flog.Debugf("UDP association stream %d ended: %v", strm.SID(), err)
+		}
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+// assocSend sends the client's datagrams to their destinations.
+func (s *Server) assocSend(sess *session, strm tnet.Strm, conn *net.UDPConn) error {
+	resolved := make(map[string]*net.UDPAddr)
+	buf := make([]byte, tnet.MaxFrame)
+	for {
+		n, err := strm.Read(buf)
+		if err != nil {
+			return err
+		}
+		addr, payload, err := protocol.ParseDatagram(buf[:n])
+		if err != nil {
+			flog.Debugf("dropping malformed datagram on association stream %d: %v", strm.SID(), err)
+			continue
+		}
+		dst, ok := resolved[addr.String()]
+		if !ok {
+			dst, err = net.ResolveUDPAddr("udp", addr.String())
+			if err != nil {
+				flog.Debugf("dropping datagram to %s on association stream %d: %v", addr, strm.SID(), err)
+				continue
+			}
+			if len(resolved) >= maxResolved {
+				clear(resolved)
+			}
+			resolved[addr.String()] = dst
+		}
+		if !sess.allowed(dst.AddrPort()) {
+			flog.Debugf("dropping datagram to %s on association stream %d: %v", dst, strm.SID(), protocol.ErrDenied)
+			continue
+		}
+		if _, err := conn.WriteToUDP(payload, dst); err != nil {
+			flog.Debugf("failed to send datagram to %s on association stream %d: %v", dst, strm.SID(), err)
+		}
+	}
+}
+
+// assocRecv returns datagrams from any host to the client, tagged with their
+// source.
+func (s *Server) assocRecv(strm tnet.Strm, conn *net.UDPConn) error {
+	buf := make([]byte, s.cfg.Transport.MaxDatagram)
+	frame := make([]byte, 0, protocol.MaxAddrSize+len(buf))
+	for {
+		n, from, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return err
+		}
+		src := &tnet.Addr{Host: from.Addr().Unmap().String(), Port: int(from.Port())}
+		frame, err = protocol.AppendDatagram(frame[:0], src, buf[:n])
+		if err != nil {
+			continue
+		}
+		if _, err := strm.Write(frame); err != nil && !errors.Is(err, tnet.ErrDatagramTooLarge) {
+			return err
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package socket
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+func serializeFrame(tb testing.TB, tags []uint16, ipv6 bool, payload []byte) []byte {
+	tb.Helper()
+	eth := &layers.Ethernet{
+		SrcMAC: net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC: net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+	}
+	ethType := layers.EthernetTypeIPv4
+	if ipv6 {
+		ethType = layers.EthernetTypeIPv6
+	}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 9999, PSH: true, ACK: true, Window: 65535}
+	ls := []gopacket.SerializableLayer{eth}
+	eth.EthernetType = ethType
+	switch len(tags) {
+	case 1:
+		eth.EthernetType = layers.EthernetTypeDot1Q
+		ls = append(ls, &layers.Dot1Q{VLANIdentifier: tags[0], Type: ethType})
+	case 2:
+		eth.EthernetType = layers.EthernetTypeQinQ
+		ls = append(ls, &layers.Dot1Q{VLANIdentifier: tags[0], Type: layers.EthernetTypeDot1Q})
+		ls = append(ls, &layers.Dot1Q{VLANIdentifier: tags[1], Type: ethType})
+	}
+	if ipv6 {
+		ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: net.ParseIP("fd00::1"), DstIP: net.ParseIP("fd00::2")}
+		tcp.SetNetworkLayerForChecksum(ip)
+		ls = append(ls, ip)
+	} else {
+		ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IPv4(10, 0, 0, 1), DstIP: net.IPv4(10, 0, 0, 2)}
+		tcp.SetNetworkLayerForChecksum(ip)
+		ls = append(ls, ip)
+	}
+	ls = append(ls, tcp, gopacket.Payload(payload))
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ls...); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func FuzzParseEtherIPTCP(f *testing.F) {
+	for _, tags := range [][]uint16{nil, {100}, {200, 100}} {
+		for _, ipv6 := range []bool{false, true} {
+			f.Add(serializeFrame(f, tags, ipv6, []byte("paqet")))
+			f.Add(serializeFrame(f, tags, ipv6, nil))
+		}
+	}
+	// Short frames are padded to the Ethernet minimum on the wire.
+	f.Add(append(serializeFrame(f, nil, false, []byte{1}), make([]byte, 5)...))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		var m Meta
+		payload, ok := parseEtherIPTCP(frame, &m)
+		if !ok {
+			return
+		}
+		if len(m.SrcIP) != 4 && len(m.SrcIP) != 16 {
+			t.Fatalf("source IP has length %d", len(m.SrcIP))
+		}
+		if len(payload) > len(frame) {
+			t.Fatalf("payload longer than frame: %d > %d", len(payload), len(frame))
+		}
+
+		// Cross-check against gopacket wherever it decodes the frame cleanly.
+		pkt := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+		if pkt.ErrorLayer() != nil {
+			return
+		}
+		tcp, _ := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		if tcp == nil {
+			return
+		}
+		if uint16(tcp.SrcPort) != m.SrcPort {
+			t.Fatalf("source port %d, gopacket says %d", m.SrcPort, tcp.SrcPort)
+		}
+		if tcp.RST != m.Flags.RST || tcp.SYN != m.Flags.SYN || tcp.NS != m.Flags.NS {
+			t.Fatalf("flags %+v, gopacket says %+v", m.Flags, tcp)
+		}
+		if !bytes.Equal(tcp.Payload, payload) {
+			t.Fatalf("payload %x, gopacket says %x", payload, tcp.Payload)
+		}
+	})
+}
@@ -0,0 +1,219 @@
+package socket
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"paqet/internal/conf"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type ImpairStats struct {
+	Sent       uint64
+	Dropped    uint64
+	Overflow   uint64
+	Duplicated uint64
+	Reordered  uint64
+}
+
+type impairPkt struct {
+	data []byte
+	addr *net.UDPAddr
+	at   time.Time
+	seq  uint64
+}
+
+// impairQueue is a min-heap ordered by departure time, ties broken by
+// arrival order so equal delays never reorder packets by accident.
+type impairQueue []*impairPkt
+
+func (q impairQueue) Len() int { return len(q) }
+func (q impairQueue) Less(i, j int) bool {
+	if q[i].at.Equal(q[j].at) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].at.Before(q[j].at)
+}
+func (q impairQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *impairQueue) Push(x any)   { *q = append(*q, x.(*impairPkt)) }
+func (q *impairQueue) Pop() any {
+	old := *q
+	n := len(old)
+	p := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return p
+}
+
+type impairer struct {
+	cfg    *conf.Impair
+	send   func([]byte, *net.UDPAddr) error
+	cancel context.CancelFunc
+
+	mu    sync.Mutex
+	rng   *rand.Rand
+	bad   bool
+	busy  time.Time
+	seq   uint64
+	queue impairQueue
+	wake  chan struct{}
+
+	sent       atomic.Uint64
+	dropped    atomic.Uint64
+	overflow   atomic.Uint64
+	duplicated atomic.Uint64
+	reordered  atomic.Uint64
+}
+
+func newImpairer(ctx context.Context, cfg *conf.Impair, send func([]byte, *net.UDPAddr) error) *impairer {
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	i := &impairer{
+		cfg:    cfg,
+		send:   send,
+		cancel: cancel,
+		rng:    rand.New(rand.NewSource(seed)),
+		wake:   make(chan struct{}, 1),
+	}
+	go i.run(ctx)
+	return i
+}
+
+func (i *impairer) write(data []byte, addr *net.UDPAddr) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.lose() {
+		i.dropped.Add(1)
+		return
+	}
+
+	now := time.Now()
+	at := now
+	if i.cfg.RateKbps > 0 {
+		if i.busy.Before(now) {
+			i.busy = now
+		}
+		if i.busy.Sub(now) > time.Duration(i.cfg.QueueMs)*time.Millisecond {
+			i.overflow.Add(1)
+			return
+		}
+		i.busy = i.busy.Add(time.Duration(len(data)) * 8 * time.Millisecond / time.Duration(i.cfg.RateKbps))
+		at = i.busy
+	}
+	at = at.Add(i.delay())
+	if i.chance(i.cfg.Reorder) {
+		at = at.Add(time.Duration(i.cfg.ReorderMs) * time.Millisecond)
+		i.reordered.Add(1)
+	}
+
+	i.push(data, addr, at)
+	if i.chance(i.cfg.Duplicate) {
+		i.push(data, addr, at)
+		i.duplicated.Add(1)
+	}
+}
+
+func (i *impairer) lose() bool {
+	if b := i.cfg.Burst; b.P > 0 {
+		if i.bad {
+			i.bad = !i.chance(b.R)
+		} else {
+			i.bad = i.chance(b.P)
+		}
+		loss := b.LossGood
+		if i.bad {
+			loss = b.LossBad
+		}
+		if i.chance(loss) {
+			return true
+		}
+	}
+	return i.chance(i.cfg.Loss)
+}
+
+func (i *impairer) delay() time.Duration {
+	d := time.Duration(i.cfg.DelayMs) * time.Millisecond
+	if j := i.cfg.JitterMs; j > 0 {
+		d += time.Duration(i.rng.Int63n(int64(2*j+1))-int64(j)) * time.Millisecond
+	}
+	return d
+}
+
+func (i *impairer) chance(percent float64) bool {
+	return percent > 0 && i.rng.Float64()*100 < percent
+}
+
+func (i *impairer) push(data []byte, addr *net.UDPAddr, at time.Time) {
+	i.seq++
+	heap.Push(&i.queue, &impairPkt{
+		data: append([]byte(nil), data...),
+		addr: addr,
+		at:   at,
+		seq:  i.seq,
+	})
+	select {
+	case i.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (i *impairer) run(ctx context.Context) {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	var due []*impairPkt
+	for {
+		i.mu.Lock()
+		now := time.Now()
+		for len(i.queue) > 0 && !i.queue[0].at.After(now) {
+			due = append(due, heap.Pop(&i.queue).(*impairPkt))
+		}
+		wait := time.Duration(-1)
+		if len(i.queue) > 0 {
+			wait = i.queue[0].at.Sub(now)
+		}
+		i.mu.Unlock()
+
+		for _, p := range due {
+			if err := i.send(p.data, p.addr); err == nil {
+				i.sent.Add(1)
+			}
+		}
+		clear(due)
+		due = due[:0]
+
+		if wait >= 0 {
+			timer.Reset(wait)
+		} else {
+			timer.Stop()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-i.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+func (s ImpairStats) String() string {
+	return fmt.Sprintf("%d packets sent, %d dropped, %d over the queue, %d duplicated, %d reordered", s.Sent, s.Dropped, s.Overflow, s.Duplicated, s.Reordered)
+}
+
+func (i *impairer) stats() ImpairStats {
+	return ImpairStats{
+		Sent:       i.sent.Load(),
+		Dropped:    i.dropped.Load(),
+		Overflow:   i.overflow.Load(),
+		Duplicated: i.duplicated.Load(),
+		Reordered:  i.reordered.Load(),
+	}
+}
@@ -0,0 +1,120 @@
+package socket
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"paqet/internal/conf"
+)
+
+var impairAddr = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 9999}
+
+// impairRun sends n numbered packets through an impairer and returns the
+// numbers that came out, in order, once nothing is left in flight.
+func impairRun(t *testing.T, cfg *conf.Impair, n int) []int {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	var out []int
+	im := newImpairer(ctx, cfg.WithDefaults(), func(b []byte, _ *net.UDPAddr) error {
+		mu.Lock()
+		out = append(out, int(b[0])|int(b[1])<<8)
+		mu.Unlock()
+		return nil
+	})
+	for i := range n {
+		im.write([]byte{byte(i), byte(i >> 8)}, impairAddr)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		st := im.stats()
+		if st.Sent+st.Dropped+st.Overflow == uint64(n)+st.Duplicated {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("packets still in flight: %+v", st)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return out
+}
+
+func TestImpairSeededLoss(t *testing.T) {
+	cfg := &conf.Impair{Loss: 20, Burst: conf.GilbertElliott{P: 5}, Seed: 42}
+	a := impairRun(t, cfg, 2000)
+	b := impairRun(t, cfg, 2000)
+	if len(a) != len(b) {
+		t.Fatalf("same seed delivered %d and %d packets", len(a), len(b))
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("same seed diverged at packet %d: %d vs %d", i, a[i], b[i])
+		}
+	}
+	// 20% independent loss plus bursts of ~4 packets entered at 5%.
+	if lost := 2000 - len(a); lost < 500 || lost > 900 {
+		t.Fatalf("lost %d of 2000 packets", lost)
+	}
+}
+
+func TestImpairDelayAndReorder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := (&conf.Impair{DelayMs: 50, Seed: 1}).WithDefaults()
+	arrived := make(chan time.Duration, 1)
+	start := time.Now()
+	im := newImpairer(ctx, cfg, func([]byte, *net.UDPAddr) error {
+		arrived <- time.Since(start)
+		return nil
+	})
+	im.write([]byte{0, 0}, impairAddr)
+	if d := <-arrived; d < 50*time.Millisecond {
+		t.Fatalf("packet delayed by %v, want at least 50ms", d)
+	}
+
+	out := impairRun(t, &conf.Impair{Reorder: 100, Seed: 1}, 1)
+	if len(out) != 1 {
+		t.Fatalf("reordered packet delivered %d times", len(out))
+	}
+}
+
+func TestSetImpairDefaults(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sink, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	pc, err := New(ctx, &conf.Network{Mode: "socket"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	// Only a rate: queue_ms must come from the defaults, or every packet
+	// counts as over the queue.
+	pc.SetImpair(&conf.Impair{RateKbps: 1000})
+	for range 10 {
+		if _, err := pc.WriteTo(make([]byte, 100), sink.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sink.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	for i := range 10 {
+		if _, _, err := sink.ReadFrom(buf); err != nil {
+			t.Fatalf("received %d of 10 packets: %v (%+v)", i, err, pc.ImpairStats())
+		}
+	}
+}
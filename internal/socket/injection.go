@@ -0,0 +1,160 @@
+package socket
+
+import (
+	"fmt"
+	"net"
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const maxGuardPeers = 4096
+
+type InjectionStats struct {
+	BadChecksum uint64
+	TTLMismatch uint64
+	EmptyRST    uint64
+	Dropped     uint64
+}
+
+// ttlState tracks the TTL a peer's packets normally arrive with. The baseline
+// is the most common TTL over the first LearnPackets packets, and moves only
+// when a different TTL persists for as long, as it does after a route change.
+type ttlState struct {
+	baseline  uint8
+	learned   bool
+	samples   int
+	hist      map[uint8]int
+	candidate uint8
+	streak    int
+	warned    bool
+	seen      time.Time
+}
+
+type injectionGuard struct {
+	cfg   *conf.Injection
+	mu    sync.Mutex
+	peers map[string]*ttlState
+
+	badChecksum atomic.Uint64
+	ttlMismatch atomic.Uint64
+	emptyRST    atomic.Uint64
+	dropped     atomic.Uint64
+}
+
+func newInjectionGuard(cfg *conf.Injection) *injectionGuard {
+	return &injectionGuard{cfg: cfg, peers: make(map[string]*ttlState)}
+}
+
+// check reports whether a packet with n payload bytes should be delivered.
+func (g *injectionGuard) check(m *Meta, n int) bool {
+	suspect := false
+	if *g.cfg.Checksum && !m.ChecksumOK {
+		g.badChecksum.Add(1)
+		flog.Debugf("packet from %s:%d failed checksum verification", net.IP(m.SrcIP), m.SrcPort)
+		suspect = true
+	}
+	if m.Flags.RST && n == 0 {
+		g.emptyRST.Add(1)
+		flog.Debugf("RST without payload from %s:%d (TTL %d)", net.IP(m.SrcIP), m.SrcPort, m.TTL)
+		suspect = true
+	}
+	// Only packets that look genuine otherwise are allowed to train the baseline.
+	if g.checkTTL(m, !suspect && n > 0) {
+		g.ttlMismatch.Add(1)
+		suspect = true
+	}
+
+	if suspect && g.cfg.Action == "drop" {
+		g.dropped.Add(1)
+		return false
+	}
+	return true
+}
+
+func (g *injectionGuard) checkTTL(m *Meta, learn bool) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	key := string(m.SrcIP)
+	st := g.peers[key]
+	if st == nil {
+		if len(g.peers) >= maxGuardPeers {
+			g.evict()
+		}
+		st = &ttlState{hist: make(map[uint8]int)}
+		g.peers[key] = st
+	}
+	st.seen = time.Now()
+
+	if !st.learned {
+		if learn {
+			st.hist[m.TTL]++
+			st.samples++
+			if st.samples >= g.cfg.LearnPackets {
+				for ttl, n := range st.hist {
+					if n > st.hist[st.baseline] {
+						st.baseline = ttl
+					}
+				}
+				st.learned = true
+				st.hist = nil
+				flog.Debugf("learned TTL %d for peer %s", st.baseline, net.IP(m.SrcIP))
+			}
+		}
+		return false
+	}
+
+	diff := int(m.TTL) - int(st.baseline)
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff <= g.cfg.TTLTolerance {
+		st.streak = 0
+		return false
+	}
+
+	if learn {
+		if m.TTL == st.candidate {
+			st.streak++
+		} else {
+			st.candidate, st.streak = m.TTL, 1
+		}
+		if st.streak >= g.cfg.LearnPackets {
+			flog.Infof("TTL baseline for peer %s moved from %d to %d", net.IP(m.SrcIP), st.baseline, m.TTL)
+			st.baseline, st.streak = m.TTL, 0
+			return false
+		}
+	}
+	if !st.warned {
+		flog.Warnf("suspected injected packet from %s:%d: TTL %d, expected %d", net.IP(m.SrcIP), m.SrcPort, m.TTL, st.baseline)
+		st.warned = true
+	}
+	return true
+}
+
+func (g *injectionGuard) evict() {
+	var oldest string
+	var t time.Time
+	for k, st := range g.peers {
+		if t.IsZero() || st.seen.Before(t) {
+			oldest, t = k, st.seen
+		}
+	}
+	delete(g.peers, oldest)
+}
+
+func (s InjectionStats) String() string {
+	return fmt.Sprintf("%d bad checksums, %d TTL mismatches, %d empty RSTs, %d dropped", s.BadChecksum, s.TTLMismatch, s.EmptyRST, s.Dropped)
+}
+
+func (g *injectionGuard) stats() InjectionStats {
+	return InjectionStats{
+		BadChecksum: g.badChecksum.Load(),
+		TTLMismatch: g.ttlMismatch.Load(),
+		EmptyRST:    g.emptyRST.Load(),
+		Dropped:     g.dropped.Load(),
+	}
+}
@@ -0,0 +1,195 @@
+package socket
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"paqet/internal/conf"
+	"paqet/internal/pkg/hash"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	paceFlowIdle   = 30 * time.Second
+	paceEstimateIv = 100 * time.Millisecond
+	paceEWMAWeight = 0.25
+)
+
+type PacerStats struct {
+	Flows   int
+	Queued  uint64
+	Dropped uint64
+}
+
+type pacePkt struct {
+	data []byte
+	addr *net.UDPAddr
+}
+
+// pacer keeps one queue and token bucket per destination, so a burst towards
+// one peer never waits behind another peer's backlog.
+type pacer struct {
+	cfg  *conf.Pacing
+	ctx  context.Context
+	send func([]byte, *net.UDPAddr) error
+
+	mu    sync.Mutex
+	flows map[uint64]*paceFlow
+
+	queued  atomic.Uint64
+	dropped atomic.Uint64
+
+	// limit caps the rate in bytes per second when above zero.
+	limit atomic.Int64
+}
+
+type paceFlow struct {
+	key    uint64
+	ch     chan pacePkt
+	tokens float64
+	last   time.Time
+
+	// Arrival rate estimate in bytes per second, used when no rate is configured.
+	arrived atomic.Int64
+	rate    float64
+	window  time.Time
+}
+
+func newPacer(ctx context.Context, cfg *conf.Pacing, send func([]byte, *net.UDPAddr) error) *pacer {
+	return &pacer{
+		cfg:   cfg,
+		ctx:   ctx,
+		send:  send,
+		flows: make(map[uint64]*paceFlow),
+	}
+}
+
+func (p *pacer) write(data []byte, addr *net.UDPAddr) {
+	key := hash.IPAddr(addr.IP, uint16(addr.Port))
+	pkt := pacePkt{data: append([]byte(nil), data...), addr: addr}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f := p.flows[key]
+	if f == nil {
+		now := time.Now()
+		f = &paceFlow{
+			key:    key,
+			ch:     make(chan pacePkt, p.cfg.Queue),
+			tokens: float64(p.cfg.Burst),
+			last:   now,
+			window: now,
+			rate:   float64(p.cfg.MinKbps) * 1000 / 8,
+		}
+		p.flows[key] = f
+		go p.run(f)
+	}
+	f.arrived.Add(int64(len(data)))
+	select {
+	case f.ch <- pkt:
+		p.queued.Add(1)
+	default:
+		p.dropped.Add(1)
+	}
+}
+
+func (p *pacer) run(f *paceFlow) {
+	idle := time.NewTimer(paceFlowIdle)
+	defer idle.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case pkt := <-f.ch:
+			if !p.wait(f, len(pkt.data)) {
+				return
+			}
+			p.send(pkt.data, pkt.addr)
+			idle.Reset(paceFlowIdle)
+		case <-idle.C:
+			p.mu.Lock()
+			if len(f.ch) == 0 {
+				delete(p.flows, f.key)
+				p.mu.Unlock()
+				return
+			}
+			p.mu.Unlock()
+			idle.Reset(paceFlowIdle)
+		}
+	}
+}
+
+// wait blocks until the flow's bucket holds n bytes and takes them. A frame
+// larger than the burst goes out once the bucket is full, leaving it in debt.
+func (p *pacer) wait(f *paceFlow, n int) bool {
+	burst := float64(p.cfg.Burst)
+	need := min(float64(n), burst)
+	for {
+		now := time.Now()
+		rate := p.rate(f, now)
+		f.tokens += now.Sub(f.last).Seconds() * rate
+		f.last = now
+		if f.tokens > burst {
+			f.tokens = burst
+		}
+		if f.tokens >= need {
+			f.tokens -= float64(n)
+			return true
+		}
+
+		d := time.Duration((need - f.tokens) / rate * float64(time.Second))
+		t := time.NewTimer(d)
+		select {
+		case <-p.ctx.Done():
+			t.Stop()
+			return false
+		case <-t.C:
+		}
+	}
+}
+
+// rate returns the pacing rate in bytes per second, within the limit if one
+// is set.
+func (p *pacer) rate(f *paceFlow, now time.Time) float64 {
+	rate := p.flowRate(f, now)
+	if limit := float64(p.limit.Load()); limit > 0 && rate > limit {
+		rate = limit
+	}
+	return rate
+}
+
+// flowRate returns the configured rate or, without one, the smoothed arrival
+// rate scaled by gain so the queue drains.
+func (p *pacer) flowRate(f *paceFlow, now time.Time) float64 {
+	if p.cfg.RateKbps > 0 {
+		return float64(p.cfg.RateKbps) * 1000 / 8
+	}
+	if iv := now.Sub(f.window); iv >= paceEstimateIv {
+		sample := float64(f.arrived.Swap(0)) / iv.Seconds()
+		f.rate += paceEWMAWeight * (sample - f.rate)
+		f.window = now
+	}
+	rate := f.rate * p.cfg.Gain
+	if min := float64(p.cfg.MinKbps) * 1000 / 8; rate < min {
+		rate = min
+	}
+	return rate
+}
+
+func (s PacerStats) String() string {
+	return fmt.Sprintf("%d flows, %d packets queued, %d dropped", s.Flows, s.Queued, s.Dropped)
+}
+
+func (p *pacer) stats() PacerStats {
+	p.mu.Lock()
+	flows := len(p.flows)
+	p.mu.Unlock()
+	return PacerStats{
+		Flows:   flows,
+		Queued:  p.queued.Load(),
+		Dropped: p.dropped.Load(),
+	}
+}
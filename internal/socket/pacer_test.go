@@ -0,0 +1,73 @@
+package socket
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"paqet/internal/conf"
+)
+
+func TestPacerFrameAboveBurst(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &conf.Pacing{RateKbps: 8000, MinKbps: 1000, Gain: 1.25, Burst: 1500, Queue: 16}
+	sent := make(chan int, 16)
+	p := newPacer(ctx, cfg, func(b []byte, _ *net.UDPAddr) error {
+		sent <- len(b)
+		return nil
+	})
+
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 9999}
+	for range 3 {
+		p.write(make([]byte, 1600), addr)
+	}
+	// At 1MB/s each 1600-byte frame takes 1.6ms of tokens, so all three fit
+	// well within the deadline once oversized frames may go out.
+	deadline := time.After(time.Second)
+	for i := range 3 {
+		select {
+		case n := <-sent:
+			if n != 1600 {
+				t.Fatalf("frame %d: sent %d bytes, want 1600", i, n)
+			}
+		case <-deadline:
+			t.Fatalf("only %d of 3 frames above the burst were sent", i)
+		}
+	}
+	if st := p.stats(); st.Queued != 3 || st.Dropped != 0 || st.Flows != 1 {
+		t.Fatalf("stats = %+v", st)
+	}
+}
+
+func TestPacerRate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// 800 kbit/s is 100KB/s; after the burst, 20KB must take about 200ms.
+	cfg := &conf.Pacing{RateKbps: 800, MinKbps: 1000, Gain: 1.25, Burst: 1500, Queue: 64}
+	done := make(chan struct{})
+	total := 0
+	p := newPacer(ctx, cfg, func(b []byte, _ *net.UDPAddr) error {
+		if total += len(b); total >= 21500 {
+			close(done)
+		}
+		return nil
+	})
+
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 9999}
+	start := time.Now()
+	for range 43 {
+		p.write(make([]byte, 500), addr)
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("sent %d bytes in 2s", total)
+	}
+	if d := time.Since(start); d < 150*time.Millisecond || d > time.Second {
+		t.Fatalf("20KB past the burst took %v at 100KB/s", d)
+	}
+}
@@ -13,6 +13,24 @@ import (
 
 type RecvHandle struct {
 	handle *pcap.Handle
+	vlan   *conf.VLAN
+	guard  *injectionGuard
+}
+
+// Meta carries the header fields of a received packet. SrcIP aliases the
+// capture buffer and, like the payload, is only valid until the next read.
+type Meta struct {
+	SrcIP      net.IP
+	SrcPort    uint16
+	TTL        uint8 // IPv4 TTL or IPv6 hop limit
+	IPID       uint16
+	DF         bool
+	Flags      conf.TCPF
+	Window     uint16
+	VLAN       uint16 // innermost 802.1Q tag, 0 if untagged
+	OuterVLAN  uint16 // outer QinQ tag, 0 if absent
+	ChecksumOK bool   // false only if a checksum could be checked and failed
+	Timestamp  time.Time
 }
 
 func NewRecvHandle(cfg *conf.Network) (*RecvHandle, error) {
@@ -29,97 +47,207 @@ func NewRecvHandle(cfg *conf.Network) (*RecvHandle, error) {
 	}
 
 	filter := fmt.Sprintf("tcp and dst port %d", cfg.Port)
+	if v := cfg.VLAN; v != nil {
+		filter = fmt.Sprintf("vlan %d and %s", v.ID, filter)
+		if v.OuterID != 0 {
+			filter = fmt.Sprintf("vlan %d and %s", v.OuterID, filter)
+		}
+	}
 	if err := handle.SetBPFFilter(filter); err != nil {
 		return nil, fmt.Errorf("failed to set BPF filter: %w", err)
 	}
 
-	return &RecvHandle{handle: handle}, nil
+	h := &RecvHandle{handle: handle, vlan: cfg.VLAN}
+	if cfg.Injection != nil {
+		h.guard = newInjectionGuard(cfg.Injection)
+	}
+	return h, nil
 }
 
 func (h *RecvHandle) Read() ([]byte, net.Addr, error) {
+	payload, m, err := h.ReadMeta()
+	if err != nil {
+		return nil, nil, err
+	}
+	addr := &net.UDPAddr{
+		IP:   append(net.IP(nil), m.SrcIP...),
+		Port: int(m.SrcPort),
+	}
+	return payload, addr, nil
+}
+
+func (h *RecvHandle) ReadMeta() ([]byte, Meta, error) {
+	var m Meta
 	for {
-		data, _, err := h.handle.ZeroCopyReadPacketData()
+		data, ci, err := h.handle.ZeroCopyReadPacketData()
 		if err != nil {
 			if err == pcap.NextErrorTimeoutExpired {
 				time.Sleep(100 * time.Microsecond)
 				continue
 			}
-			return nil, nil, err
+			return nil, m, err
 		}
 
-		srcIP, srcPort, payload, ok := parseEtherIPTCP(data)
-		if !ok || len(payload) == 0 {
+		payload, ok := parseEtherIPTCP(data, &m)
+		if !ok {
 			continue
 		}
-
-		addr := &net.UDPAddr{
-			IP:   append(net.IP(nil), srcIP...),
-			Port: int(srcPort),
+		if v := h.vlan; v != nil && (int(m.VLAN) != v.ID || int(m.OuterVLAN) != v.OuterID) {
+			continue
+		}
+		m.Timestamp = ci.Timestamp
+		if h.guard != nil && !h.guard.check(&m, len(payload)) {
+			continue
+		}
+		if len(payload) == 0 {
+			continue
 		}
-		return payload, addr, nil
+		return payload, m, nil
 	}
 }
 
-func parseEtherIPTCP(frame []byte) (srcIP []byte, srcPort uint16, payload []byte, ok bool) {
+func parseEtherIPTCP(frame []byte, m *Meta) (payload []byte, ok bool) {
 	if len(frame) < 14 {
-		return nil, 0, nil, false
+		return nil, false
 	}
 
 	etherType := binary.BigEndian.Uint16(frame[12:14])
 	off := 14
-	if etherType == 0x8100 || etherType == 0x88A8 {
-		if len(frame) < 18 {
-			return nil, 0, nil, false
+	var tags [2]uint16
+	nTags := 0
+	for (etherType == 0x8100 || etherType == 0x88A8) && nTags < len(tags) {
+		if len(frame) < off+4 {
+			return nil, false
 		}
-		etherType = binary.BigEndian.Uint16(frame[16:18])
+		tags[nTags] = binary.BigEndian.Uint16(frame[off:off+2]) & 0x0FFF
+		etherType = binary.BigEndian.Uint16(frame[off+2 : off+4])
 		off += 4
+		nTags++
+	}
+	m.VLAN, m.OuterVLAN = 0, 0
+	switch nTags {
+	case 1:
+		m.VLAN = tags[0]
+	case 2:
+		m.OuterVLAN, m.VLAN = tags[0], tags[1]
 	}
 
+	var tcpOff, end int
+	var sum uint32
+	verifyTCP := true
 	switch etherType {
 	case 0x0800: // IPv4
 		if len(frame) < off+20 {
-			return nil, 0, nil, false
+			return nil, false
 		}
 		ihl := int(frame[off]&0x0F) * 4
 		if ihl < 20 || len(frame) < off+ihl {
-			return nil, 0, nil, false
+			return nil, false
 		}
 		if frame[off+9] != 6 { // TCP
-			return nil, 0, nil, false
+			return nil, false
 		}
-		src := frame[off+12 : off+16]
-		tcpOff := off + ihl
-		if len(frame) < tcpOff+20 {
-			return nil, 0, nil, false
+		if binary.BigEndian.Uint16(frame[off+6:off+8])&0x3FFF != 0 { // MF or fragment offset
+			return nil, false
 		}
-		dataOff := int(frame[tcpOff+12]>>4) * 4
-		if dataOff < 20 || len(frame) < tcpOff+dataOff {
-			return nil, 0, nil, false
+		// Trim Ethernet padding; a zero total length means segmentation offload.
+		end = len(frame)
+		totalLen := int(binary.BigEndian.Uint16(frame[off+2 : off+4]))
+		if totalLen != 0 {
+			if off+totalLen > len(frame) {
+				return nil, false
+			}
+			end = off + totalLen
+		}
+		verifyTCP = totalLen != 0 && !offloaded(end-off)
+		tcpOff = off + ihl
+		if end < tcpOff+20 {
+			return nil, false
 		}
-		sport := binary.BigEndian.Uint16(frame[tcpOff : tcpOff+2])
-		return src, sport, frame[tcpOff+dataOff:], true
+		m.SrcIP = frame[off+12 : off+16]
+		m.TTL = frame[off+8]
+		m.IPID = binary.BigEndian.Uint16(frame[off+4 : off+6])
+		m.DF = frame[off+6]&0x40 != 0
+		// Offload that zeroes the total length leaves the header checksum stale.
+		m.ChecksumOK = totalLen == 0 || fold(sum16(0, frame[off:off+ihl])) == 0xFFFF
+		sum = sum16(0, frame[off+12:off+20])
+		sum += 6 + uint32(end-tcpOff)
 
 	case 0x86DD: // IPv6 (no ext header walk)
 		if len(frame) < off+40 {
-			return nil, 0, nil, false
+			return nil, false
 		}
 		if frame[off+6] != 6 { // TCP
-			return nil, 0, nil, false
+			return nil, false
 		}
-		src := frame[off+8 : off+24]
-		tcpOff := off + 40
-		if len(frame) < tcpOff+20 {
-			return nil, 0, nil, false
+		end = len(frame)
+		payloadLen := int(binary.BigEndian.Uint16(frame[off+4 : off+6]))
+		if payloadLen != 0 {
+			if off+40+payloadLen > len(frame) {
+				return nil, false
+			}
+			end = off + 40 + payloadLen
 		}
-		dataOff := int(frame[tcpOff+12]>>4) * 4
-		if dataOff < 20 || len(frame) < tcpOff+dataOff {
-			return nil, 0, nil, false
+		verifyTCP = payloadLen != 0 && !offloaded(end-off)
+		tcpOff = off + 40
+		if end < tcpOff+20 {
+			return nil, false
 		}
-		sport := binary.BigEndian.Uint16(frame[tcpOff : tcpOff+2])
-		return src, sport, frame[tcpOff+dataOff:], true
+		m.SrcIP = frame[off+8 : off+24]
+		m.TTL = frame[off+7]
+		m.IPID = 0
+		m.DF = true
+		m.ChecksumOK = true
+		sum = sum16(0, frame[off+8:off+40])
+		sum += 6 + uint32(end-tcpOff)
+
+	default:
+		return nil, false
 	}
 
-	return nil, 0, nil, false
+	dataOff := int(frame[tcpOff+12]>>4) * 4
+	if dataOff < 20 || end < tcpOff+dataOff {
+		return nil, false
+	}
+	m.SrcPort = binary.BigEndian.Uint16(frame[tcpOff : tcpOff+2])
+	fl := frame[tcpOff+13]
+	m.Flags = conf.TCPF{
+		FIN: fl&0x01 != 0, SYN: fl&0x02 != 0, RST: fl&0x04 != 0, PSH: fl&0x08 != 0,
+		ACK: fl&0x10 != 0, URG: fl&0x20 != 0, ECE: fl&0x40 != 0, CWR: fl&0x80 != 0,
+		NS: frame[tcpOff+12]&0x01 != 0,
+	}
+	m.Window = binary.BigEndian.Uint16(frame[tcpOff+14 : tcpOff+16])
+	if verifyTCP {
+		m.ChecksumOK = m.ChecksumOK && fold(sum16(sum, frame[tcpOff:end])) == 0xFFFF
+	}
+
+	return frame[tcpOff+dataOff : end], true
+}
+
+// offloaded reports whether an IP packet of n bytes is larger than one
+// Ethernet frame carries, so receive offload merged it and its TCP checksum
+// no longer matches. Jumbo frames look the same and go unchecked too.
+func offloaded(n int) bool {
+	return n > 1500
+}
+
+// sum16 adds b to a running ones' complement sum as big-endian 16-bit words.
+func sum16(sum uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+func fold(sum uint32) uint16 {
+	for sum > 0xFFFF {
+		sum = sum>>16 + sum&0xFFFF
+	}
+	return uint16(sum)
 }
 
 func (h *RecvHandle) Close() {
@@ -0,0 +1,41 @@
+package socket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestParseChecksum(t *testing.T) {
+	for _, ipv6 := range []bool{false, true} {
+		good := serializeFrame(t, nil, ipv6, []byte("paqet"))
+		var m Meta
+		if _, ok := parseEtherIPTCP(good, &m); !ok || !m.ChecksumOK {
+			t.Fatalf("ipv6=%v: intact frame parsed %v, checksum ok %v", ipv6, ok, m.ChecksumOK)
+		}
+
+		bad := append([]byte(nil), good...)
+		bad[bytes.Index(bad, []byte("paqet"))] ^= 0xFF
+		if _, ok := parseEtherIPTCP(bad, &m); !ok || m.ChecksumOK {
+			t.Fatalf("ipv6=%v: corrupted payload parsed %v, checksum ok %v", ipv6, ok, m.ChecksumOK)
+		}
+
+		// Offload that zeroes the length field leaves the checksums stale.
+		lenOff := 14 + 2
+		if ipv6 {
+			lenOff = 14 + 4
+		}
+		binary.BigEndian.PutUint16(bad[lenOff:], 0)
+		if _, ok := parseEtherIPTCP(bad, &m); !ok || !m.ChecksumOK {
+			t.Fatalf("ipv6=%v: offloaded frame parsed %v, checksum ok %v", ipv6, ok, m.ChecksumOK)
+		}
+	}
+
+	// A segment merged by receive offload is longer than any one frame.
+	merged := serializeFrame(t, nil, false, make([]byte, 3000))
+	merged[len(merged)-1] ^= 0xFF
+	var m Meta
+	if _, ok := parseEtherIPTCP(merged, &m); !ok || !m.ChecksumOK {
+		t.Fatalf("merged segment parsed %v, checksum ok %v", ok, m.ChecksumOK)
+	}
+}
@@ -30,6 +30,7 @@ type SendHandle struct {
 	srcIPv6     net.IP
 	srcIPv6RHWA net.HardwareAddr
 	srcPort     uint16
+	vlan        *conf.VLAN
 	synOptions  []layers.TCPOption
 	ackOptions  []layers.TCPOption
 	time        uint32
@@ -72,6 +73,7 @@ func NewSendHandle(cfg *conf.Network) (*SendHandle, error) {
 	sh := &SendHandle{
 		handle:     handle,
 		srcPort:    uint16(cfg.Port),
+		vlan:       cfg.VLAN,
 		synOptions: synOptions,
 		ackOptions: ackOptions,
 		tcpF:       TCPF{tcpF: iterator.Iterator[conf.TCPF]{Items: cfg.TCP.LF}, clientTCPF: make(map[uint64]*iterator.Iterator[conf.TCPF])},
@@ -191,24 +193,39 @@ func (h *SendHandle) Write(payload []byte, addr *net.UDPAddr) error {
 	defer h.tcpPool.Put(tcpLayer)
 
 	var ipLayer gopacket.SerializableLayer
+	var ethType layers.EthernetType
 	if dstIP.To4() != nil {
 		ip := h.buildIPv4Header(dstIP)
 		defer h.ipv4Pool.Put(ip)
 		ipLayer = ip
 		tcpLayer.SetNetworkLayerForChecksum(ip)
 		ethLayer.DstMAC = h.srcIPv4RHWA
-		ethLayer.EthernetType = layers.EthernetTypeIPv4
+		ethType = layers.EthernetTypeIPv4
 	} else {
 		ip := h.buildIPv6Header(dstIP)
 		defer h.ipv6Pool.Put(ip)
 		ipLayer = ip
 		tcpLayer.SetNetworkLayerForChecksum(ip)
 		ethLayer.DstMAC = h.srcIPv6RHWA
-		ethLayer.EthernetType = layers.EthernetTypeIPv6
+		ethType = layers.EthernetTypeIPv6
 	}
 
+	var ls [6]gopacket.SerializableLayer
+	stack := append(ls[:0], ethLayer)
+	ethLayer.EthernetType = ethType
+	if v := h.vlan; v != nil {
+		if v.OuterID != 0 {
+			ethLayer.EthernetType = layers.EthernetTypeQinQ
+			stack = append(stack, &layers.Dot1Q{Priority: uint8(v.OuterPriority), VLANIdentifier: uint16(v.OuterID), Type: layers.EthernetTypeDot1Q})
+		} else {
+			ethLayer.EthernetType = layers.EthernetTypeDot1Q
+		}
+		stack = append(stack, &layers.Dot1Q{Priority: uint8(v.Priority), VLANIdentifier: uint16(v.ID), Type: ethType})
+	}
+	stack = append(stack, ipLayer, tcpLayer, gopacket.Payload(payload))
+
 	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
-	if err := gopacket.SerializeLayers(buf, opts, ethLayer, ipLayer, tcpLayer, gopacket.Payload(payload)); err != nil {
+	if err := gopacket.SerializeLayers(buf, opts, stack...); err != nil {
 		return err
 	}
 	return h.handle.WritePacketData(buf.Bytes())
@@ -223,6 +240,12 @@ func (h *SendHandle) getClientTCPF(dstIP net.IP, dstPort uint16) conf.TCPF {
 	return h.tcpF.tcpF.Next()
 }
 
+func (h *SendHandle) setTCPF(f []conf.TCPF) {
+	h.tcpF.mu.Lock()
+	h.tcpF.tcpF = iterator.Iterator[conf.TCPF]{Items: f}
+	h.tcpF.mu.Unlock()
+}
+
 func (h *SendHandle) setClientTCPF(addr net.Addr, f []conf.TCPF) {
 	a := *addr.(*net.UDPAddr)
 	h.tcpF.mu.Lock()
@@ -8,16 +8,25 @@ import (
 	"net"
 	"os"
 	"paqet/internal/conf"
+	"paqet/internal/flog"
 	"strings"
 	"sync/atomic"
 	"syscall"
 	"time"
 )
 
+// statsInterval is how often a conn logs the counters of its pacing,
+// impairment and injection stages, when they have moved.
+const statsInterval = time.Minute
+
 type PacketConn struct {
-	cfg           *conf.Network
-	sendHandle    *SendHandle
-	recvHandle    *RecvHandle
+	cfg        *conf.Network
+	sendHandle *SendHandle
+	recvHandle *RecvHandle
+	// udp carries the packets instead of the handles in socket mode.
+	udp           *net.UDPConn
+	impair        atomic.Pointer[impairer]
+	pacer         atomic.Pointer[pacer]
 	readDeadline  atomic.Value
 	writeDeadline atomic.Value
 
@@ -27,6 +36,9 @@ type PacketConn struct {
 
 // &OpError{Op: "listen", Net: network, Source: nil, Addr: nil, Err: err}
 func New(ctx context.Context, cfg *conf.Network) (*PacketConn, error) {
+	if cfg.Mode == "socket" {
+		return newUDP(ctx, cfg)
+	}
 	if cfg.Port == 0 {
 		cfg.Port = 32768 + rand.Intn(32768)
 	}
@@ -42,16 +54,70 @@ func New(ctx context.Context, cfg *conf.Network) (*PacketConn, error) {
 		return nil, fmt.Errorf("failed to create receive handle on %s: %v", cfg.Interface.Name, err)
 	}
 
-	ctx, cancel := context.WithCancel(ctx)
-	conn := &PacketConn{
-		cfg:        cfg,
-		sendHandle: sendHandle,
-		recvHandle: recvHandle,
-		ctx:        ctx,
-		cancel:     cancel,
+	return newPacketConn(ctx, cfg, &PacketConn{sendHandle: sendHandle, recvHandle: recvHandle}), nil
+}
+
+// newUDP opens the ordinary UDP socket of socket mode. It binds the configured
+// address, or the wildcard address when none is; without a port, the kernel
+// picks one.
+func newUDP(ctx context.Context, cfg *conf.Network) (*PacketConn, error) {
+	network, laddr := "udp", &net.UDPAddr{Port: cfg.Port}
+	switch {
+	case cfg.IPv4.Addr != nil && cfg.IPv6.Addr == nil:
+		network, laddr.IP = "udp4", cfg.IPv4.Addr.IP
+	case cfg.IPv6.Addr != nil && cfg.IPv4.Addr == nil:
+		network, laddr.IP = "udp6", cfg.IPv6.Addr.IP
+	}
+	udp, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind UDP socket on %s: %v", laddr, err)
+	}
+	udp.SetReadBuffer(cfg.PCAP.Sockbuf)
+	udp.SetWriteBuffer(cfg.PCAP.Sockbuf)
+
+	return newPacketConn(ctx, cfg, &PacketConn{udp: udp}), nil
+}
+
+func newPacketConn(ctx context.Context, cfg *conf.Network, conn *PacketConn) *PacketConn {
+	conn.cfg = cfg
+	conn.ctx, conn.cancel = context.WithCancel(ctx)
+	if cfg.Impair != nil {
+		conn.SetImpair(cfg.Impair)
 	}
+	if cfg.Pacing != nil {
+		conn.pacer.Store(newPacer(conn.ctx, cfg.Pacing, conn.send))
+	}
+	go conn.logStats()
+	return conn
+}
 
-	return conn, nil
+// logStats logs the stage counters every statsInterval while the conn is open.
+func (c *PacketConn) logStats() {
+	t := time.NewTicker(statsInterval)
+	defer t.Stop()
+
+	var pacer PacerStats
+	var impair ImpairStats
+	var injection InjectionStats
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-t.C:
+		}
+		if st := c.PacerStats(); st != pacer {
+			flog.Infof("pacing: %s", st)
+			pacer = st
+		}
+		if st := c.ImpairStats(); st != impair {
+			flog.Infof("impairment: %s", st)
+			impair = st
+		}
+		if st := c.InjectionStats(); st != injection {
+			flog.Warnf("suspected injected packets: %s", st)
+			injection = st
+		}
+	}
 }
 
 func (c *PacketConn) ReadFrom(data []byte) (n int, addr net.Addr, err error) {
@@ -71,6 +137,13 @@ func (c *PacketConn) ReadFrom(data []byte) (n int, addr net.Addr, err error) {
 	default:
 	}
 
+	if c.udp != nil {
+		n, addr, err := c.udp.ReadFromUDP(data)
+		if err != nil {
+			return 0, nil, err
+		}
+		return n, addr, nil
+	}
 	payload, addr, err := c.recvHandle.Read()
 	if err != nil {
 		return 0, nil, err
@@ -102,22 +175,50 @@ func (c *PacketConn) WriteTo(data []byte, addr net.Addr) (n int, err error) {
 		return 0, net.InvalidAddrError("invalid address")
 	}
 
-	err = c.sendHandle.Write(data, daddr)
+	if p := c.pacer.Load(); p != nil {
+		p.write(data, daddr)
+		return len(data), nil
+	}
+	if err := c.send(data, daddr); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// send hands a packet to the impairment stage if enabled, or to the wire.
+func (c *PacketConn) send(data []byte, addr *net.UDPAddr) error {
+	if im := c.impair.Load(); im != nil {
+		im.write(data, addr)
+		return nil
+	}
+
+	err := c.write(data, addr)
 	if err != nil {
 		if errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.ENOMEM) ||
 			strings.Contains(err.Error(), "No buffer space available") ||
 			strings.Contains(err.Error(), "Cannot allocate memory") {
-			return len(data), nil
+			return nil
 		}
-		return 0, err
+		return err
 	}
+	return nil
+}
 
-	return len(data), nil
+// write puts a packet on the wire.
+func (c *PacketConn) write(data []byte, addr *net.UDPAddr) error {
+	if c.udp != nil {
+		_, err := c.udp.WriteToUDP(data, addr)
+		return err
+	}
+	return c.sendHandle.Write(data, addr)
 }
 
 func (c *PacketConn) Close() error {
 	c.cancel()
 
+	if c.udp != nil {
+		c.udp.Close()
+	}
 	if c.sendHandle != nil {
 		go c.sendHandle.Close()
 	}
@@ -129,6 +230,9 @@ func (c *PacketConn) Close() error {
 }
 
 func (c *PacketConn) LocalAddr() net.Addr {
+	if c.udp != nil {
+		return c.udp.LocalAddr()
+	}
 	return nil
 	// return &net.UDPAddr{
 	// 	IP:   append([]byte(nil), c.cfg.PrimaryAddr().IP...),
@@ -138,25 +242,95 @@ func (c *PacketConn) LocalAddr() net.Addr {
 }
 
 func (c *PacketConn) SetDeadline(t time.Time) error {
-	c.readDeadline.Store(t)
-	c.writeDeadline.Store(t)
-	return nil
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
 }
 
 func (c *PacketConn) SetReadDeadline(t time.Time) error {
 	c.readDeadline.Store(t)
+	if c.udp != nil {
+		return c.udp.SetReadDeadline(t)
+	}
 	return nil
 }
 
 func (c *PacketConn) SetWriteDeadline(t time.Time) error {
 	c.writeDeadline.Store(t)
+	if c.udp != nil {
+		return c.udp.SetWriteDeadline(t)
+	}
 	return nil
 }
 
+// SetReadBuffer and SetWriteBuffer keep the buffers pcap.sockbuf sized when
+// the conn was created. Transports such as quic-go ask for their own size.
+func (c *PacketConn) SetReadBuffer(bytes int) error  { return nil }
+func (c *PacketConn) SetWriteBuffer(bytes int) error { return nil }
+
 func (c *PacketConn) SetDSCP(dscp int) error {
 	return nil
 }
 
+// SetImpair enables synthetic loss, delay, reordering, duplication and rate
+// limiting on outgoing packets. Unset fields of cfg take their defaults; a nil
+// cfg disables impairment.
+func (c *PacketConn) SetImpair(cfg *conf.Impair) {
+	var im *impairer
+	if cfg != nil {
+		flog.Warnf("network impairment is enabled - outgoing packets will be dropped, delayed or duplicated on purpose")
+		im = newImpairer(c.ctx, cfg.WithDefaults(), c.write)
+	}
+	if old := c.impair.Swap(im); old != nil {
+		old.cancel()
+	}
+}
+
+func (c *PacketConn) ImpairStats() ImpairStats {
+	if im := c.impair.Load(); im != nil {
+		return im.stats()
+	}
+	return ImpairStats{}
+}
+
+func (c *PacketConn) PacerStats() PacerStats {
+	if p := c.pacer.Load(); p != nil {
+		return p.stats()
+	}
+	return PacerStats{}
+}
+
+func (c *PacketConn) InjectionStats() InjectionStats {
+	if c.recvHandle != nil && c.recvHandle.guard != nil {
+		return c.recvHandle.guard.stats()
+	}
+	return InjectionStats{}
+}
+
 func (c *PacketConn) SetClientTCPF(addr net.Addr, f []conf.TCPF) {
-	c.sendHandle.setClientTCPF(addr, f)
+	if c.sendHandle != nil {
+		c.sendHandle.setClientTCPF(addr, f)
+	}
+}
+
+// SetTCPF replaces the flag sets used towards destinations that have not
+// asked for their own. Socket mode sends no TCP headers, so there, like
+// SetClientTCPF, it does nothing.
+func (c *PacketConn) SetTCPF(f []conf.TCPF) {
+	if c.sendHandle != nil {
+		c.sendHandle.setTCPF(f)
+	}
+}
+
+// SetRateLimit caps the sending rate to each destination, starting a pacer
+// with default settings if none is configured. Zero lifts the cap.
+func (c *PacketConn) SetRateLimit(kbps int) {
+	p := c.pacer.Load()
+	if p == nil {
+		if kbps == 0 {
+			return
+		}
+		c.pacer.CompareAndSwap(nil, newPacer(c.ctx, conf.DefaultPacing(), c.send))
+		p = c.pacer.Load()
+	}
+	p.limit.Store(int64(kbps) * 1000 / 8)
 }
@@ -0,0 +1,38 @@
+package socks
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/txthinking/socks5"
+)
+
+func FuzzDatagram(f *testing.F) {
+	f.Add(socks5.NewDatagram(socks5.ATYPIPv4, []byte{8, 8, 8, 8}, []byte{0, 53}, []byte("query")).Bytes())
+	f.Add(socks5.NewDatagram(socks5.ATYPIPv6, make([]byte, 16), []byte{1, 187}, []byte{0}).Bytes())
+	f.Add(socks5.NewDatagram(socks5.ATYPDomain, []byte("example.com"), []byte{0, 80}, []byte("GET")).Bytes())
+	f.Add([]byte{0, 0, 1, socks5.ATYPDomain, 0})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		d, err := socks5.NewDatagramFromBytes(b)
+		if err != nil {
+			return
+		}
+		addr := d.Address()
+
+		// A reply built the way UDPHandle builds it must parse back to the
+		// same destination and payload.
+		reply := socks5.NewDatagram(d.Atyp, replyAddr(d), d.DstPort, d.Data).Bytes()
+		r, err := socks5.NewDatagramFromBytes(reply)
+		if err != nil {
+			t.Fatalf("failed to parse reply for %s: %v", addr, err)
+		}
+		if r.Address() != addr {
+			t.Fatalf("reply address %q, want %q", r.Address(), addr)
+		}
+		if !bytes.Equal(r.Data, d.Data) {
+			t.Fatalf("reply data %x, want %x", r.Data, d.Data)
+		}
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"paqet/internal/client"
 	"sync"
+	"sync/atomic"
 )
 
 var rPool = sync.Pool{
@@ -16,4 +17,9 @@ var rPool = sync.Pool{
 type Handler struct {
 	client *client.Client
 	ctx    context.Context
+
+	fullCone    bool
+	coneMissing atomic.Bool
+	codec       byte
+	zeroRTT     bool
 }
@@ -22,6 +22,9 @@ func New(client *client.Client) (*SOCKS5, error) {
 
 func (s *SOCKS5) Start(ctx context.Context, cfg conf.SOCKS5) error {
 	s.handle.ctx = ctx
+	s.handle.fullCone = cfg.UDP == "full-cone"
+	s.handle.codec = cfg.Codec
+	s.handle.zeroRTT = cfg.ZeroRTT
 	go s.listen(ctx, cfg)
 	return nil
 }
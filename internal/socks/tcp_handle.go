@@ -1,9 +1,14 @@
 package socks
 
 import (
+	"errors"
 	"net"
+	"net/netip"
+	"paqet/internal/client"
 	"paqet/internal/flog"
 	"paqet/internal/pkg/buffer"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
 
 	"github.com/txthinking/socks5"
 )
@@ -25,58 +30,105 @@ func (h *Handler) TCPHandle(server *socks5.Server, conn *net.TCPConn, r *socks5.
 
 func (h *Handler) handleTCPConnect(conn *net.TCPConn, r *socks5.Request) error {
 	flog.Infof("SOCKS5 accepted TCP connection %s -> %s", conn.RemoteAddr(), r.Address())
+	if h.zeroRTT {
+		return h.handleTCPConnectEarly(conn, r)
+	}
 
-	addr := conn.LocalAddr().(*net.TCPAddr)
-	bufp := rPool.Get().(*[]byte)
-	defer rPool.Put(bufp)
-	buf := *bufp
-	buf = append(buf, socks5.Ver)
-	buf = append(buf, socks5.RepSuccess)
-	buf = append(buf, 0x00)
-	if ip4 := addr.IP.To4(); ip4 != nil {
-		buf = append(buf, socks5.ATYPIPv4)
-		buf = append(buf, ip4...)
-	} else if ip6 := addr.IP.To16(); ip6 != nil {
-		buf = append(buf, socks5.ATYPIPv6)
-		buf = append(buf, ip6...)
-	} else {
-		host := addr.IP.String()
-		buf = append(buf, socks5.ATYPDomain)
-		buf = append(buf, byte(len(host)))
-		buf = append(buf, host...)
+	strm, bound, err := h.client.TCP(r.Address(), h.codec)
+	if err != nil {
+		flog.Errorf("SOCKS5 failed to establish stream for %s -> %s: %v", conn.RemoteAddr(), r.Address(), err)
+		rep := socks5.RepServerFailure
+		var de *client.DialError
+		if errors.As(err, &de) {
+			rep = replyCode(de.Status)
+		}
+		writeReply(conn, rep, nil)
+		return err
 	}
-	buf = append(buf, byte(addr.Port>>8), byte(addr.Port&0xff))
-	if _, err := conn.Write(buf); err != nil {
+	defer strm.Close()
+	flog.Debugf("SOCKS5 stream %d created for %s -> %s", strm.SID(), conn.RemoteAddr(), r.Address())
+
+	if err := writeReply(conn, socks5.RepSuccess, bound); err != nil {
 		return err
 	}
 
-	strm, err := h.client.TCP(r.Address())
+	if err := buffer.RelayT(h.ctx, conn, strm); err != nil {
+		flog.Errorf("SOCKS5 stream %d failed for %s -> %s: %v", strm.SID(), conn.RemoteAddr(), r.Address(), err)
+	}
+
+	flog.Debugf("SOCKS5 connection %s -> %s closed", conn.RemoteAddr(), r.Address())
+	return nil
+}
+
+// handleTCPConnectEarly replies success before the server has connected, so
+// the client's first bytes travel with the stream header. A failed connect
+// then resets the local connection instead of sending an error reply.
+func (h *Handler) handleTCPConnectEarly(conn *net.TCPConn, r *socks5.Request) error {
+	strm, err := h.client.TCPEarly(r.Address(), h.codec)
 	if err != nil {
 		flog.Errorf("SOCKS5 failed to establish stream for %s -> %s: %v", conn.RemoteAddr(), r.Address(), err)
+		writeReply(conn, socks5.RepServerFailure, nil)
 		return err
 	}
 	defer strm.Close()
-	flog.Debugf("SOCKS5 stream %d created for %s -> %s", strm.SID(), conn.RemoteAddr(), r.Address())
+	flog.Debugf("SOCKS5 early stream %d created for %s -> %s", strm.SID(), conn.RemoteAddr(), r.Address())
 
-	errCh := make(chan error, 2)
-	go func() {
-		err := buffer.CopyT(conn, strm)
-		errCh <- err
-	}()
-	go func() {
-		err := buffer.CopyT(strm, conn)
-		errCh <- err
-	}()
-
-	select {
-	case err := <-errCh:
-		if err != nil {
-			flog.Errorf("SOCKS5 stream %d failed for %s -> %s: %v", strm.SID(), conn.RemoteAddr(), r.Address(), err)
+	if err := writeReply(conn, socks5.RepSuccess, nil); err != nil {
+		return err
+	}
+
+	if err := buffer.RelayT(h.ctx, conn, strm); err != nil {
+		flog.Errorf("SOCKS5 stream %d failed for %s -> %s: %v", strm.SID(), conn.RemoteAddr(), r.Address(), err)
+		var de *client.DialError
+		if errors.As(err, &de) {
+			conn.SetLinger(0)
 		}
-	case <-h.ctx.Done():
-		flog.Debugf("SOCKS5 connection %s -> %s closed due to shutdown", conn.RemoteAddr(), r.Address())
 	}
 
 	flog.Debugf("SOCKS5 connection %s -> %s closed", conn.RemoteAddr(), r.Address())
 	return nil
 }
+
+// writeReply answers a CONNECT. The bound address is the server's end of the
+// relayed connection when the server reports it, and ours otherwise.
+func writeReply(conn *net.TCPConn, rep byte, bound *tnet.Addr) error {
+	addr := netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+	if bound != nil {
+		if ip, err := netip.ParseAddr(bound.Host); err == nil {
+			addr = netip.AddrPortFrom(ip.Unmap(), uint16(bound.Port))
+		}
+	} else if rep == socks5.RepSuccess {
+		addr = conn.LocalAddr().(*net.TCPAddr).AddrPort()
+	}
+
+	bufp := rPool.Get().(*[]byte)
+	defer rPool.Put(bufp)
+	buf := *bufp
+	buf = append(buf, socks5.Ver, rep, 0x00)
+	if ip := addr.Addr().Unmap(); ip.Is4() {
+		buf = append(buf, socks5.ATYPIPv4)
+		buf = append(buf, ip.AsSlice()...)
+	} else {
+		buf = append(buf, socks5.ATYPIPv6)
+		buf = append(buf, ip.AsSlice()...)
+	}
+	buf = append(buf, byte(addr.Port()>>8), byte(addr.Port()&0xff))
+	_, err := conn.Write(buf)
+	return err
+}
+
+// replyCode maps a server dial result to the SOCKS5 reply for it.
+func replyCode(status byte) byte {
+	switch status {
+	case protocol.StatusDenied:
+		return socks5.RepNotAllowed
+	case protocol.StatusRefused:
+		return socks5.RepConnectionRefused
+	case protocol.StatusUnreachable:
+		return socks5.RepNetworkUnreachable
+	case protocol.StatusDNS, protocol.StatusTimeout:
+		return socks5.RepHostUnreachable
+	default:
+		return socks5.RepServerFailure
+	}
+}
@@ -0,0 +1,100 @@
+package socks
+
+import (
+	"net"
+	"net/netip"
+	"paqet/internal/flog"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+	"time"
+
+	"github.com/txthinking/socks5"
+)
+
+// coneIdle is how long a UDP association lives without replies. Peers of
+// STUN and P2P traffic may stay quiet for a while, so it is longer than the
+// per-target idle time.
+const coneIdle = 60 * time.Second
+
+// handleUDPCone relays d over the client's UDP association, which carries
+// datagrams for every destination and returns replies from any source.
+func (h *Handler) handleUDPCone(server *socks5.Server, addr *net.UDPAddr, d *socks5.Datagram) error {
+	dst, err := tnet.NewAddr(d.Address())
+	if err != nil {
+		flog.Debugf("SOCKS5 dropping UDP datagram from %s to invalid address %s: %v", addr, d.Address(), err)
+		return nil
+	}
+	strm, new, k, err := h.client.UDPAssociate(addr.String())
+	if err != nil {
+		flog.Errorf("SOCKS5 failed to establish UDP association for %s: %v", addr, err)
+		return err
+	}
+	frame, err := protocol.AppendDatagram(nil, dst, d.Data)
+	if err != nil {
+		flog.Debugf("SOCKS5 dropping UDP datagram from %s -> %s: %v", addr, d.Address(), err)
+		return nil
+	}
+	strm.SetWriteDeadline(time.Now().Add(8 * time.Second))
+	_, err = strm.Write(frame)
+	strm.SetWriteDeadline(time.Time{})
+	if err != nil {
+		flog.Errorf("SOCKS5 failed to forward %d bytes from %s -> %s: %v", len(d.Data), addr, d.Address(), err)
+		h.client.CloseUDP(k)
+		return err
+	}
+
+	if new {
+		srcAddr := &net.UDPAddr{IP: append(net.IP(nil), addr.IP...), Port: addr.Port, Zone: addr.Zone}
+		flog.Infof("SOCKS5 accepted UDP association %d for %s", strm.SID(), srcAddr)
+		go h.relayCone(server, strm, k, srcAddr)
+	}
+	return nil
+}
+
+// relayCone returns replies on an association to the SOCKS5 client, each
+// tagged with the address it came from.
+func (h *Handler) relayCone(server *socks5.Server, strm tnet.Strm, k uint64, srcAddr *net.UDPAddr) {
+	buf := make([]byte, tnet.MaxFrame)
+	defer func() {
+		flog.Debugf("SOCKS5 UDP association %d closed for %s", strm.SID(), srcAddr)
+		h.client.CloseUDP(k)
+	}()
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		default:
+		}
+		strm.SetReadDeadline(time.Now().Add(coneIdle))
+		n, err := strm.Read(buf)
+		if err != nil {
+			flog.Debugf("SOCKS5 UDP association %d read error for %s: %v", strm.SID(), srcAddr, err)
+			return
+		}
+		from, payload, err := protocol.ParseDatagram(buf[:n])
+		if err != nil {
+			flog.Debugf("SOCKS5 dropping malformed datagram on association %d: %v", strm.SID(), err)
+			continue
+		}
+		atyp, host := datagramAddr(from.Host)
+		port := []byte{byte(from.Port >> 8), byte(from.Port)}
+		dd := socks5.NewDatagram(atyp, host, port, payload)
+		if _, err := server.UDPConn.WriteToUDP(dd.Bytes(), srcAddr); err != nil {
+			flog.Errorf("SOCKS5 failed to write UDP response %d bytes to %s: %v", len(dd.Bytes()), srcAddr, err)
+			return
+		}
+	}
+}
+
+// datagramAddr encodes host for socks5.NewDatagram.
+func datagramAddr(host string) (byte, []byte) {
+	ip, err := netip.ParseAddr(host)
+	switch {
+	case err != nil:
+		return socks5.ATYPDomain, []byte(host)
+	case ip.Is4():
+		return socks5.ATYPIPv4, ip.AsSlice()
+	default:
+		return socks5.ATYPIPv6, ip.AsSlice()
+	}
+}
@@ -1,8 +1,10 @@
 package socks
 
 import (
+	"errors"
 	"io"
 	"net"
+	"paqet/internal/client"
 	"paqet/internal/flog"
 	"paqet/internal/pkg/buffer"
 	"time"
@@ -11,6 +13,18 @@ import (
 )
 
 func (h *Handler) UDPHandle(server *socks5.Server, addr *net.UDPAddr, d *socks5.Datagram) error {
+	if d.Frag != 0x00 {
+		flog.Debugf("SOCKS5 dropping fragmented UDP datagram from %s -> %s", addr, d.Address())
+		return nil
+	}
+	if h.fullCone && !h.coneMissing.Load() {
+		err := h.handleUDPCone(server, addr, d)
+		if !errors.Is(err, client.ErrServerVersion) {
+			return err
+		}
+		flog.Warnf("SOCKS5 server does not support UDP associations, falling back to per-target UDP: %v", err)
+		h.coneMissing.Store(true)
+	}
 	strm, new, k, err := h.client.UDP(addr.String(), d.Address())
 	if err != nil {
 		flog.Errorf("SOCKS5 failed to establish UDP stream for %s -> %s: %v", addr, d.Address(), err)
@@ -28,7 +42,7 @@ func (h *Handler) UDPHandle(server *socks5.Server, addr *net.UDPAddr, d *socks5.
 	if new {
 		srcAddr := &net.UDPAddr{IP: append(net.IP(nil), addr.IP...), Port: addr.Port, Zone: addr.Zone}
 		dstAtyp := d.Atyp
-		dstAddr := append([]byte(nil), d.DstAddr...)
+		dstAddr := replyAddr(d)
 		dstPort := append([]byte(nil), d.DstPort...)
 		dstText := d.Address()
 
@@ -67,6 +81,16 @@ func (h *Handler) UDPHandle(server *socks5.Server, addr *net.UDPAddr, d *socks5.
 	return nil
 }
 
+// replyAddr returns the destination of d in the form socks5.NewDatagram
+// expects. Parsed domain addresses keep their length prefix, which
+// NewDatagram would otherwise add a second time.
+func replyAddr(d *socks5.Datagram) []byte {
+	if d.Atyp == socks5.ATYPDomain && len(d.DstAddr) > 0 {
+		return append([]byte(nil), d.DstAddr[1:]...)
+	}
+	return append([]byte(nil), d.DstAddr...)
+}
+
 func (h *Handler) handleUDPAssociate(conn *net.TCPConn) error {
 	addr := conn.LocalAddr().(*net.TCPAddr)
 
@@ -0,0 +1,294 @@
+package tnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"paqet/internal/flog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression codecs, numbered as on the wire.
+const (
+	CodecNone   byte = 0x00
+	CodecZstd   byte = 0x01
+	CodecSnappy byte = 0x02
+)
+
+// Codecs maps configuration names to codecs.
+var Codecs = map[string]byte{
+	"none":   CodecNone,
+	"zstd":   CodecZstd,
+	"snappy": CodecSnappy,
+}
+
+const (
+	blockRaw        byte = 0x00
+	blockCompressed byte = 0x01
+
+	// Writes shorter than this are not worth a compression attempt.
+	minCompress = 256
+	// After this many blocks in a row that did not shrink, only every
+	// probeEvery-th block is tried, so encrypted or media streams cost
+	// next to nothing.
+	incompressibleRun = 4
+	probeEvery        = 16
+)
+
+var (
+	zstdOnce sync.Once
+	zstdEnc  *zstd.Encoder
+	zstdDec  *zstd.Decoder
+)
+
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder) {
+	zstdOnce.Do(func() {
+		zstdEnc, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+		zstdDec, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecodeAllCapLimit(true))
+	})
+	return zstdEnc, zstdDec
+}
+
+// CompressStats counts what compressed streams wrote: In is payload handed
+// to Write, Out what went on the stream for it.
+type CompressStats struct {
+	In, Out    uint64
+	Compressed uint64
+	Stored     uint64
+}
+
+var compressTotals struct {
+	in, out, compressed, stored atomic.Uint64
+}
+
+// CompressionStats returns the totals of all compressed streams so far.
+func CompressionStats() CompressStats {
+	return CompressStats{
+		In:         compressTotals.in.Load(),
+		Out:        compressTotals.out.Load(),
+		Compressed: compressTotals.compressed.Load(),
+		Stored:     compressTotals.stored.Load(),
+	}
+}
+
+// Ratio is Out over In, or 1 before anything was written.
+func (s CompressStats) Ratio() float64 {
+	if s.In == 0 {
+		return 1
+	}
+	return float64(s.Out) / float64(s.In)
+}
+
+func (s CompressStats) String() string {
+	return fmt.Sprintf("%d -> %d bytes (%.1f%%), %d blocks compressed, %d stored", s.In, s.Out, 100*s.Ratio(), s.Compressed, s.Stored)
+}
+
+var errBlockTooLarge = errors.New("compressed block expands past the block limit")
+
+// CompressStrm compresses each write as a block of its own:
+//
+//	FLAG (1) | LENGTH (2) | DATA
+//
+// FLAG 0x00 carries DATA as is and 0x01 compressed with the stream's codec;
+// either way a block holds at most MaxFrame bytes of payload. Blocks that do
+// not shrink go out raw, which also keeps latency of small writes unchanged.
+type CompressStrm struct {
+	strm  Strm
+	codec byte
+
+	rmu  sync.Mutex
+	rbuf []byte
+	rpos int
+	rraw []byte
+
+	wmu     sync.Mutex
+	wbuf    []byte
+	run     int
+	skipped int
+
+	in, out atomic.Uint64
+}
+
+// compressHalfStrm passes CloseWrite through, for streams that have it.
+type compressHalfStrm struct {
+	*CompressStrm
+}
+
+func (c compressHalfStrm) CloseWrite() error {
+	return c.strm.(interface{ CloseWrite() error }).CloseWrite()
+}
+
+// NewCompressStrm wraps strm for codec, which must not be CodecNone. The
+// result can CloseWrite exactly when strm can.
+func NewCompressStrm(strm Strm, codec byte) Strm {
+	c := &CompressStrm{strm: strm, codec: codec}
+	if _, ok := strm.(interface{ CloseWrite() error }); ok {
+		return compressHalfStrm{c}
+	}
+	return c
+}
+
+func (c *CompressStrm) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for c.rpos == len(c.rbuf) {
+		if err := c.readBlock(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.rbuf[c.rpos:])
+	c.rpos += n
+	return n, nil
+}
+
+func (c *CompressStrm) readBlock() error {
+	var hdr [3]byte
+	if _, err := io.ReadFull(c.strm, hdr[:]); err != nil {
+		return err
+	}
+	n := int(binary.BigEndian.Uint16(hdr[1:]))
+	if cap(c.rraw) < n {
+		c.rraw = make([]byte, MaxFrame)
+	}
+	data := c.rraw[:n]
+	if _, err := io.ReadFull(c.strm, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	switch hdr[0] {
+	case blockRaw:
+		c.rbuf = append(c.rbuf[:0], data...)
+	case blockCompressed:
+		out, err := c.decode(c.rbuf[:0], data)
+		if err != nil {
+			return fmt.Errorf("failed to decompress block: %w", err)
+		}
+		c.rbuf = out
+	default:
+		return fmt.Errorf("unknown block flag 0x%02x", hdr[0])
+	}
+	c.rpos = 0
+	return nil
+}
+
+func (c *CompressStrm) decode(dst, src []byte) ([]byte, error) {
+	switch c.codec {
+	case CodecZstd:
+		if cap(dst) < MaxFrame {
+			dst = make([]byte, 0, MaxFrame)
+		}
+		_, dec := zstdCodec()
+		return dec.DecodeAll(src, dst[:0:MaxFrame])
+	case CodecSnappy:
+		n, err := s2.DecodedLen(src)
+		if err != nil {
+			return nil, err
+		}
+		if n > MaxFrame {
+			return nil, errBlockTooLarge
+		}
+		if cap(dst) < n {
+			dst = make([]byte, MaxFrame)
+		}
+		return s2.Decode(dst[:cap(dst)], src)
+	default:
+		return nil, fmt.Errorf("unknown codec 0x%02x", c.codec)
+	}
+}
+
+func (c *CompressStrm) encode(src []byte) []byte {
+	switch c.codec {
+	case CodecZstd:
+		enc, _ := zstdCodec()
+		return enc.EncodeAll(src, nil)
+	case CodecSnappy:
+		return s2.EncodeSnappy(nil, src)
+	default:
+		return nil
+	}
+}
+
+func (c *CompressStrm) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	written := 0
+	for len(b) > 0 {
+		n := min(len(b), MaxFrame)
+		if err := c.writeBlock(b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (c *CompressStrm) writeBlock(p []byte) error {
+	flag, data := blockRaw, p
+	if c.worthTrying(len(p)) {
+		if z := c.encode(p); z != nil && len(z) < len(p)-len(p)/16 {
+			flag, data = blockCompressed, z
+			c.run = 0
+		} else {
+			c.run++
+		}
+	}
+
+	c.wbuf = append(c.wbuf[:0], flag, 0, 0)
+	binary.BigEndian.PutUint16(c.wbuf[1:], uint16(len(data)))
+	c.wbuf = append(c.wbuf, data...)
+	if _, err := c.strm.Write(c.wbuf); err != nil {
+		return err
+	}
+
+	c.in.Add(uint64(len(p)))
+	c.out.Add(uint64(len(c.wbuf)))
+	compressTotals.in.Add(uint64(len(p)))
+	compressTotals.out.Add(uint64(len(c.wbuf)))
+	if flag == blockCompressed {
+		compressTotals.compressed.Add(1)
+	} else {
+		compressTotals.stored.Add(1)
+	}
+	return nil
+}
+
+// worthTrying backs off from compressing streams that keep not shrinking.
+func (c *CompressStrm) worthTrying(n int) bool {
+	if n < minCompress {
+		return false
+	}
+	if c.run < incompressibleRun {
+		return true
+	}
+	c.skipped++
+	if c.skipped < probeEvery {
+		return false
+	}
+	c.skipped = 0
+	return true
+}
+
+func (c *CompressStrm) Close() error {
+	if in, out := c.in.Load(), c.out.Load(); in > 0 {
+		flog.Debugf("stream %d compression: %d -> %d bytes (%.1f%%)", c.strm.SID(), in, out, 100*float64(out)/float64(in))
+	}
+	return c.strm.Close()
+}
+
+func (c *CompressStrm) SID() int                           { return c.strm.SID() }
+func (c *CompressStrm) LocalAddr() net.Addr                { return c.strm.LocalAddr() }
+func (c *CompressStrm) RemoteAddr() net.Addr               { return c.strm.RemoteAddr() }
+func (c *CompressStrm) SetDeadline(t time.Time) error      { return c.strm.SetDeadline(t) }
+func (c *CompressStrm) SetReadDeadline(t time.Time) error  { return c.strm.SetReadDeadline(t) }
+func (c *CompressStrm) SetWriteDeadline(t time.Time) error { return c.strm.SetWriteDeadline(t) }
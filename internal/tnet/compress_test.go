@@ -0,0 +1,94 @@
+package tnet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/s2"
+)
+
+func TestCompressStrmRoundTrip(t *testing.T) {
+	// Longer than one block, so it is split at MaxFrame.
+	data := bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n"), 4000)
+	for _, codec := range []byte{CodecZstd, CodecSnappy} {
+		s := &bufStrm{}
+		c := NewCompressStrm(s, codec).(*CompressStrm)
+		if n, err := c.Write(data); err != nil || n != len(data) {
+			t.Fatalf("codec %d: write %d, %v", codec, n, err)
+		}
+		if c.out.Load() >= c.in.Load()/4 {
+			t.Fatalf("codec %d: %d bytes went out for %d", codec, c.out.Load(), c.in.Load())
+		}
+		got, err := io.ReadAll(c)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("codec %d: read %d bytes, %v", codec, len(got), err)
+		}
+	}
+}
+
+func TestCompressStrmBound(t *testing.T) {
+	big := make([]byte, 2*MaxFrame)
+	zenc, _ := zstdCodec()
+	for codec, block := range map[byte][]byte{
+		CodecZstd:   zenc.EncodeAll(big, nil),
+		CodecSnappy: s2.EncodeSnappy(nil, big),
+	} {
+		// A block may only decode to MaxFrame bytes, however small it is.
+		s := &bufStrm{}
+		s.buf.WriteByte(blockCompressed)
+		binary.Write(&s.buf, binary.BigEndian, uint16(len(block)))
+		s.buf.Write(block)
+		c := NewCompressStrm(s, codec)
+		if _, err := c.Read(make([]byte, 100)); err == nil {
+			t.Fatalf("codec %d: block decoding to %d bytes was accepted", codec, len(big))
+		} else if codec == CodecSnappy && !errors.Is(err, errBlockTooLarge) {
+			t.Fatalf("codec %d: %v", codec, err)
+		}
+	}
+}
+
+func TestCompressStrmBackOff(t *testing.T) {
+	s := &bufStrm{}
+	c := NewCompressStrm(s, CodecZstd).(*CompressStrm)
+	noise := make([]byte, 1000)
+	text := bytes.Repeat([]byte("a"), 1000)
+	flags := func() []byte {
+		var f []byte
+		for s.buf.Len() > 0 {
+			var hdr [3]byte
+			s.buf.Read(hdr[:])
+			f = append(f, hdr[0])
+			s.buf.Next(int(binary.BigEndian.Uint16(hdr[1:])))
+		}
+		return f
+	}
+
+	for range incompressibleRun {
+		rand.Read(noise)
+		c.Write(noise)
+	}
+	// Short writes are never tried.
+	c.Write(text[:minCompress-1])
+	if f := flags(); !bytes.Equal(f, make([]byte, incompressibleRun+1)) {
+		t.Fatalf("incompressible and short blocks: flags %v", f)
+	}
+
+	// Backed off: only every probeEvery-th block is tried, and one that
+	// shrinks ends the back-off.
+	for range probeEvery {
+		c.Write(text)
+	}
+	want := make([]byte, probeEvery)
+	want[probeEvery-1] = blockCompressed
+	if f := flags(); !bytes.Equal(f, want) {
+		t.Fatalf("blocks after the back-off: flags %v", f)
+	}
+	c.Write(text)
+	if f := flags(); !bytes.Equal(f, []byte{blockCompressed}) {
+		t.Fatalf("block after a successful probe: flags %v", f)
+	}
+}
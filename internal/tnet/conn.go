@@ -16,3 +16,28 @@ type Conn interface {
 	SetReadDeadline(t time.Time) error
 	SetWriteDeadline(t time.Time) error
 }
+
+// DatagramConn is a Conn that can also carry unreliable datagrams.
+type DatagramConn interface {
+	Conn
+	// BindDatagrams moves the datagrams of a framed UDP stream to separate
+	// packets where they fit. It reports false when the conn has no datagram
+	// path, in which case strm is returned as is.
+	BindDatagrams(strm Strm) (Strm, bool)
+}
+
+// Binder is a Conn whose security layer names its session: both ends derive
+// the same secret binding from the session's keys, and nobody else can.
+type Binder interface {
+	Conn
+	// Binding returns the session's binding, or nil if it has none.
+	Binding() []byte
+}
+
+// Binding returns the binding of conn, or nil if it has none.
+func Binding(conn Conn) []byte {
+	if b, ok := conn.(Binder); ok {
+		return b.Binding()
+	}
+	return nil
+}
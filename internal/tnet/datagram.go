@@ -0,0 +1,84 @@
+package tnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxDatagram is the largest UDP payload over IPv4.
+	MaxDatagram = 65507
+	// MaxFrame is the largest frame a DgramStrm can carry.
+	MaxFrame = 0xFFFF
+)
+
+var ErrDatagramTooLarge = errors.New("datagram too large")
+
+// DgramStrm carries datagrams over a byte stream. Each one is sent as a
+// 2-byte big-endian length followed by the payload, so datagrams written back
+// to back come out one per Read, exactly as they went in.
+type DgramStrm struct {
+	strm Strm
+	max  int
+
+	wmu sync.Mutex
+	hdr [2]byte
+}
+
+func NewDgramStrm(strm Strm, max int) *DgramStrm {
+	return &DgramStrm{strm: strm, max: min(max, MaxFrame)}
+}
+
+// Read returns the next datagram. Like a UDP socket, it truncates datagrams
+// that do not fit b. A frame longer than the limit is a protocol error, after
+// which the stream is out of sync.
+func (d *DgramStrm) Read(b []byte) (int, error) {
+	if _, err := io.ReadFull(d.strm, d.hdr[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(d.hdr[:]))
+	if n > d.max {
+		return 0, fmt.Errorf("%w: %d bytes, limit %d", ErrDatagramTooLarge, n, d.max)
+	}
+	if n <= len(b) {
+		return io.ReadFull(d.strm, b[:n])
+	}
+	if _, err := io.ReadFull(d.strm, b); err != nil {
+		return 0, err
+	}
+	if _, err := io.CopyN(io.Discard, d.strm, int64(n-len(b))); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Write sends b as one datagram. Datagrams over the limit are rejected
+// without touching the stream, so the caller can drop them and carry on.
+func (d *DgramStrm) Write(b []byte) (int, error) {
+	if len(b) > d.max {
+		return 0, fmt.Errorf("%w: %d bytes, limit %d", ErrDatagramTooLarge, len(b), d.max)
+	}
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+	if _, err := d.strm.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (d *DgramStrm) SID() int                           { return d.strm.SID() }
+func (d *DgramStrm) Close() error                       { return d.strm.Close() }
+func (d *DgramStrm) LocalAddr() net.Addr                { return d.strm.LocalAddr() }
+func (d *DgramStrm) RemoteAddr() net.Addr               { return d.strm.RemoteAddr() }
+func (d *DgramStrm) SetDeadline(t time.Time) error      { return d.strm.SetDeadline(t) }
+func (d *DgramStrm) SetReadDeadline(t time.Time) error  { return d.strm.SetReadDeadline(t) }
+func (d *DgramStrm) SetWriteDeadline(t time.Time) error { return d.strm.SetWriteDeadline(t) }
@@ -0,0 +1,72 @@
+package tnet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+)
+
+// bufStrm is a Strm whose writes are read back from it.
+type bufStrm struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (s *bufStrm) Read(b []byte) (int, error)  { return s.buf.Read(b) }
+func (s *bufStrm) Write(b []byte) (int, error) { return s.buf.Write(b) }
+func (s *bufStrm) SID() int                    { return 1 }
+
+func TestDgramStrmFraming(t *testing.T) {
+	s := &bufStrm{}
+	d := NewDgramStrm(s, 1000)
+	sent := [][]byte{[]byte("a"), []byte("bb"), {}, bytes.Repeat([]byte{7}, 1000)}
+	for _, p := range sent {
+		if n, err := d.Write(p); err != nil || n != len(p) {
+			t.Fatalf("write of %d bytes: %d, %v", len(p), n, err)
+		}
+	}
+	buf := make([]byte, 2000)
+	for i, p := range sent {
+		n, err := d.Read(buf)
+		if err != nil || !bytes.Equal(buf[:n], p) {
+			t.Fatalf("datagram %d: read %d bytes, %v; want %d", i, n, err, len(p))
+		}
+	}
+}
+
+func TestDgramStrmTruncate(t *testing.T) {
+	s := &bufStrm{}
+	d := NewDgramStrm(s, 1000)
+	d.Write(bytes.Repeat([]byte{1}, 100))
+	d.Write([]byte("next"))
+
+	// Like a UDP socket: the rest of a datagram that does not fit is lost,
+	// and the next one comes out whole.
+	buf := make([]byte, 10)
+	if n, err := d.Read(buf); err != nil || n != 10 {
+		t.Fatalf("truncated read: %d, %v", n, err)
+	}
+	if n, err := d.Read(buf); err != nil || string(buf[:n]) != "next" {
+		t.Fatalf("read after truncation: %q, %v", buf[:n], err)
+	}
+}
+
+func TestDgramStrmLimit(t *testing.T) {
+	s := &bufStrm{}
+	d := NewDgramStrm(s, 100)
+	if _, err := d.Write(make([]byte, 101)); !errors.Is(err, ErrDatagramTooLarge) {
+		t.Fatalf("write over the limit: %v", err)
+	}
+	if s.buf.Len() != 0 {
+		t.Fatalf("rejected datagram left %d bytes on the stream", s.buf.Len())
+	}
+
+	// A peer with a higher limit: its frame is a protocol error here.
+	binary.Write(&s.buf, binary.BigEndian, uint16(101))
+	s.buf.Write(make([]byte, 101))
+	if _, err := d.Read(make([]byte, 200)); !errors.Is(err, ErrDatagramTooLarge) {
+		t.Fatalf("read over the limit: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package tnet
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// HalfStrm carries a byte stream whose two directions can end separately.
+// Data goes out in chunks of a 2-byte big-endian length followed by that many
+// bytes; an empty chunk ends the sender's direction, like a TCP FIN, while the
+// other direction keeps flowing. Closing the stream still ends both.
+type HalfStrm struct {
+	strm Strm
+
+	rmu  sync.Mutex
+	left int
+	eof  bool
+
+	wmu  sync.Mutex
+	wbuf []byte
+	shut bool
+}
+
+func NewHalfStrm(strm Strm) *HalfStrm {
+	return &HalfStrm{strm: strm}
+}
+
+// Read returns io.EOF once the peer has called CloseWrite.
+func (h *HalfStrm) Read(b []byte) (int, error) {
+	h.rmu.Lock()
+	defer h.rmu.Unlock()
+	if h.eof {
+		return 0, io.EOF
+	}
+	if h.left == 0 {
+		var hdr [2]byte
+		if _, err := io.ReadFull(h.strm, hdr[:]); err != nil {
+			if err == io.EOF {
+				// Closed without a half-close first; still the end.
+				h.eof = true
+			}
+			return 0, err
+		}
+		h.left = int(binary.BigEndian.Uint16(hdr[:]))
+		if h.left == 0 {
+			h.eof = true
+			return 0, io.EOF
+		}
+	}
+	n, err := h.strm.Read(b[:min(len(b), h.left)])
+	h.left -= n
+	if err == io.EOF && h.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (h *HalfStrm) Write(b []byte) (int, error) {
+	h.wmu.Lock()
+	defer h.wmu.Unlock()
+	if h.shut {
+		return 0, io.ErrClosedPipe
+	}
+	written := 0
+	for len(b) > 0 {
+		n := min(len(b), MaxFrame)
+		h.wbuf = binary.BigEndian.AppendUint16(h.wbuf[:0], uint16(n))
+		h.wbuf = append(h.wbuf, b[:n]...)
+		if _, err := h.strm.Write(h.wbuf); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite tells the peer nothing more will be written. Reading goes on
+// until the peer does the same.
+func (h *HalfStrm) CloseWrite() error {
+	h.wmu.Lock()
+	defer h.wmu.Unlock()
+	if h.shut {
+		return nil
+	}
+	h.shut = true
+	_, err := h.strm.Write([]byte{0, 0})
+	return err
+}
+
+func (h *HalfStrm) SID() int                           { return h.strm.SID() }
+func (h *HalfStrm) Close() error                       { return h.strm.Close() }
+func (h *HalfStrm) LocalAddr() net.Addr                { return h.strm.LocalAddr() }
+func (h *HalfStrm) RemoteAddr() net.Addr               { return h.strm.RemoteAddr() }
+func (h *HalfStrm) SetDeadline(t time.Time) error      { return h.strm.SetDeadline(t) }
+func (h *HalfStrm) SetReadDeadline(t time.Time) error  { return h.strm.SetReadDeadline(t) }
+func (h *HalfStrm) SetWriteDeadline(t time.Time) error { return h.strm.SetWriteDeadline(t) }
@@ -6,36 +6,36 @@ import (
 	"paqet/internal/protocol"
 	"paqet/internal/socket"
 	"paqet/internal/tnet"
+	"sync"
 	"time"
 
 	"github.com/xtaci/kcp-go/v5"
-	"github.com/xtaci/smux"
 )
 
 type Conn struct {
 	PacketConn *socket.PacketConn
 	UDPSession *kcp.UDPSession
-	Session    *smux.Session
+	Session    muxSession
+
+	secure  *secureClient
+	mux     *dgramMux
+	binding []byte
+
+	// done is closed by Close; only dialed conns have it.
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 func (c *Conn) OpenStrm() (tnet.Strm, error) {
-	strm, err := c.Session.OpenStream()
-	if err != nil {
-		return nil, err
-	}
-	return &Strm{strm}, nil
+	return c.Session.OpenStrm()
 }
 
 func (c *Conn) AcceptStrm() (tnet.Strm, error) {
-	strm, err := c.Session.AcceptStream()
-	if err != nil {
-		return nil, err
-	}
-	return &Strm{strm}, nil
+	return c.Session.AcceptStrm()
 }
 
 func (c *Conn) Ping(wait bool) error {
-	strm, err := c.Session.OpenStream()
+	strm, err := c.Session.OpenStrm()
 	if err != nil {
 		return fmt.Errorf("ping failed: %v", err)
 	}
@@ -68,11 +68,46 @@ func (c *Conn) Close() error {
 	if c.PacketConn != nil {
 		c.PacketConn.Close()
 	}
+	if c.done != nil {
+		c.closeOnce.Do(func() { close(c.done) })
+	}
 	return err
 }
 
-func (c *Conn) LocalAddr() net.Addr                { return c.Session.LocalAddr() }
-func (c *Conn) RemoteAddr() net.Addr               { return c.Session.RemoteAddr() }
-func (c *Conn) SetDeadline(t time.Time) error      { return c.Session.SetDeadline(t) }
+// Binding returns the binding of the x25519 handshake, or nil without it.
+func (c *Conn) Binding() []byte {
+	return c.binding
+}
+
+// ReplayStats reports packets from the server rejected by the replay filter.
+// It is zero unless the x25519 handshake is enabled.
+func (c *Conn) ReplayStats() ReplayStats {
+	if c.secure == nil {
+		return ReplayStats{}
+	}
+	return c.secure.stats()
+}
+
+// AuthStats reports packets from the server dropped for failing decryption or
+// authentication.
+func (c *Conn) AuthStats() AuthStats {
+	if c.secure == nil {
+		return authStats(nil)
+	}
+	return authStats(&c.secure.dropCounters)
+}
+
+// BindDatagrams sends the datagrams of a framed UDP stream as packets of
+// their own when udp_path is datagram.
+func (c *Conn) BindDatagrams(strm tnet.Strm) (tnet.Strm, bool) {
+	if c.mux == nil {
+		return strm, false
+	}
+	return c.mux.bind(c.UDPSession, strm), true
+}
+
+func (c *Conn) LocalAddr() net.Addr                { return c.UDPSession.LocalAddr() }
+func (c *Conn) RemoteAddr() net.Addr               { return c.UDPSession.RemoteAddr() }
+func (c *Conn) SetDeadline(t time.Time) error      { return c.UDPSession.SetDeadline(t) }
 func (c *Conn) SetReadDeadline(t time.Time) error  { return c.UDPSession.SetReadDeadline(t) }
 func (c *Conn) SetWriteDeadline(t time.Time) error { return c.UDPSession.SetWriteDeadline(t) }
@@ -0,0 +1,349 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"paqet/internal/pkg/hash"
+	"paqet/internal/tnet"
+	"sync"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// With udp_path datagram, every packet under KCP starts with a type byte, so
+// UDP payloads can travel as packets of their own next to KCP's:
+//
+//	kcp:      0x00 | KCP packet
+//	datagram: 0x01 | [block framing of] conv (4) | stream ID (4) | payload
+//
+// Datagrams are sealed with the KCP block when KCP encrypts by itself; with
+// the x25519 handshake or rotating keys, the layer below seals everything.
+const (
+	muxKCP   byte = 0x00
+	muxDgram byte = 0x01
+
+	dgramHeaderSize = 4 + 4
+	dgramBacklog    = 256
+
+	// A client starts sending as soon as it has written the stream header,
+	// so datagrams can beat the header to the server. Those are held for a
+	// little while in case the stream shows up.
+	pendingFlows   = 1024
+	pendingPerFlow = 8
+	pendingTTL     = 5 * time.Second
+)
+
+type flowKey struct {
+	addr uint64
+	conv uint32
+	sid  uint32
+}
+
+// dgramMux sits right under KCP and splits datagrams off its packets.
+type dgramMux struct {
+	net.PacketConn
+	block kcp.BlockCrypt
+	// limit is the largest payload that fits one packet.
+	limit int
+
+	mu      sync.RWMutex
+	flows   map[flowKey]*dgramStrm
+	pending map[flowKey]*pendingFlow
+
+	buf     []byte
+	scratch []byte
+}
+
+// newDgramMux wraps pc. mtu is what KCP may use per packet before the mux
+// adds its type byte.
+func newDgramMux(pc net.PacketConn, block kcp.BlockCrypt, mtu int) *dgramMux {
+	limit := mtu - dgramHeaderSize
+	if block != nil {
+		limit -= blockOverhead(block)
+	}
+	return &dgramMux{
+		PacketConn: pc,
+		block:      block,
+		limit:      limit,
+		flows:      make(map[flowKey]*dgramStrm),
+		pending:    make(map[flowKey]*pendingFlow),
+		buf:        make([]byte, 65535),
+		scratch:    make([]byte, 65535),
+	}
+}
+
+func addrKey(addr net.Addr) uint64 {
+	if ua, ok := addr.(*net.UDPAddr); ok {
+		return hash.IPAddr(ua.IP, uint16(ua.Port))
+	}
+	return 0
+}
+
+// ReadFrom is only called from KCP's single reader goroutine.
+func (m *dgramMux) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := m.PacketConn.ReadFrom(m.buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if n == 0 {
+			continue
+		}
+		switch m.buf[0] {
+		case muxKCP:
+			if len(b) < n-1 {
+				continue
+			}
+			return copy(b, m.buf[1:n]), addr, nil
+		case muxDgram:
+			m.deliver(addr, m.buf[1:n])
+		}
+	}
+}
+
+func (m *dgramMux) WriteTo(b []byte, addr net.Addr) (int, error) {
+	pkt := make([]byte, 1+len(b))
+	pkt[0] = muxKCP
+	copy(pkt[1:], b)
+	if _, err := m.PacketConn.WriteTo(pkt, addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (m *dgramMux) deliver(addr net.Addr, pkt []byte) {
+	if m.block != nil {
+		var ok bool
+		if pkt, ok = openBlock(m.block, m.scratch, pkt); !ok {
+			return
+		}
+	}
+	if len(pkt) < dgramHeaderSize {
+		return
+	}
+	key := flowKey{
+		addr: addrKey(addr),
+		conv: binary.BigEndian.Uint32(pkt[0:4]),
+		sid:  binary.BigEndian.Uint32(pkt[4:8]),
+	}
+	m.mu.RLock()
+	f := m.flows[key]
+	m.mu.RUnlock()
+	if f != nil {
+		f.push(pkt[dgramHeaderSize:])
+		return
+	}
+	m.hold(key, pkt[dgramHeaderSize:])
+}
+
+type pendingFlow struct {
+	since time.Time
+	pkts  [][]byte
+}
+
+func (m *dgramMux) hold(key flowKey, payload []byte) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.flows[key] != nil {
+		m.flows[key].push(payload)
+		return
+	}
+	p := m.pending[key]
+	if p == nil {
+		if len(m.pending) >= pendingFlows {
+			for k, old := range m.pending {
+				if now.Sub(old.since) > pendingTTL {
+					delete(m.pending, k)
+				}
+			}
+			if len(m.pending) >= pendingFlows {
+				return
+			}
+		}
+		p = &pendingFlow{since: now}
+		m.pending[key] = p
+	}
+	if len(p.pkts) < pendingPerFlow {
+		p.pkts = append(p.pkts, append([]byte(nil), payload...))
+	}
+}
+
+func (m *dgramMux) send(addr net.Addr, key flowKey, payload []byte) error {
+	inner := make([]byte, dgramHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(inner[0:4], key.conv)
+	binary.BigEndian.PutUint32(inner[4:8], key.sid)
+	copy(inner[dgramHeaderSize:], payload)
+	if m.block != nil {
+		inner = sealBlock(m.block, inner)
+	}
+	pkt := make([]byte, 1+len(inner))
+	pkt[0] = muxDgram
+	copy(pkt[1:], inner)
+	_, err := m.PacketConn.WriteTo(pkt, addr)
+	return err
+}
+
+// bind routes the datagrams of one UDP stream to a dgramStrm.
+func (m *dgramMux) bind(sess *kcp.UDPSession, strm tnet.Strm) *dgramStrm {
+	addr := sess.RemoteAddr()
+	d := &dgramStrm{
+		framed: strm,
+		mux:    m,
+		addr:   addr,
+		key:    flowKey{addr: addrKey(addr), conv: sess.GetConv(), sid: uint32(strm.SID())},
+		in:     make(chan []byte, dgramBacklog),
+		done:   make(chan struct{}),
+		wake:   make(chan struct{}),
+	}
+	m.mu.Lock()
+	m.flows[d.key] = d
+	if p := m.pending[d.key]; p != nil {
+		delete(m.pending, d.key)
+		if time.Since(p.since) < pendingTTL {
+			for _, pkt := range p.pkts {
+				d.in <- pkt
+			}
+		}
+	}
+	m.mu.Unlock()
+	go d.pump()
+	return d
+}
+
+func (m *dgramMux) unbind(key flowKey) {
+	m.mu.Lock()
+	delete(m.flows, key)
+	m.mu.Unlock()
+}
+
+// dgramStrm is a UDP stream whose datagrams go out as packets of their own.
+// Datagrams too large for one packet, and the stream's lifetime, still go
+// through the framed stream underneath.
+type dgramStrm struct {
+	framed tnet.Strm
+	mux    *dgramMux
+	addr   net.Addr
+	key    flowKey
+
+	in   chan []byte
+	done chan struct{}
+	once sync.Once
+	err  error
+
+	// Setting a read deadline closes wake, so blocked Reads pick it up.
+	dmu      sync.Mutex
+	deadline time.Time
+	wake     chan struct{}
+}
+
+// pump moves datagrams that arrive on the framed stream into in.
+func (d *dgramStrm) pump() {
+	buf := make([]byte, tnet.MaxFrame)
+	for {
+		n, err := d.framed.Read(buf)
+		if err != nil {
+			d.shutdown(err)
+			return
+		}
+		select {
+		case d.in <- append([]byte(nil), buf[:n]...):
+		case <-d.done:
+			return
+		}
+	}
+}
+
+func (d *dgramStrm) push(p []byte) {
+	select {
+	case d.in <- append([]byte(nil), p...):
+	default:
+		// Unreliable path: drop rather than stall the shared reader.
+	}
+}
+
+func (d *dgramStrm) shutdown(err error) {
+	d.once.Do(func() {
+		d.err = err
+		d.mux.unbind(d.key)
+		close(d.done)
+	})
+}
+
+func (d *dgramStrm) Read(b []byte) (int, error) {
+	for {
+		d.dmu.Lock()
+		deadline, wake := d.deadline, d.wake
+		d.dmu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+		var n int
+		var err error
+		woke := false
+		select {
+		case p := <-d.in:
+			n = copy(b, p)
+		case <-d.done:
+			err = d.err
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		case <-wake:
+			woke = true
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if !woke {
+			return n, err
+		}
+	}
+}
+
+func (d *dgramStrm) Write(b []byte) (int, error) {
+	if len(b) > d.mux.limit {
+		return d.framed.Write(b)
+	}
+	select {
+	case <-d.done:
+		return 0, d.err
+	default:
+	}
+	if err := d.mux.send(d.addr, d.key, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (d *dgramStrm) Close() error {
+	d.shutdown(io.EOF)
+	return d.framed.Close()
+}
+
+// Read deadlines apply to the datagram queue; the framed stream is always
+// being read by pump.
+func (d *dgramStrm) SetDeadline(t time.Time) error {
+	d.SetReadDeadline(t)
+	return d.framed.SetWriteDeadline(t)
+}
+
+func (d *dgramStrm) SetReadDeadline(t time.Time) error {
+	d.dmu.Lock()
+	d.deadline = t
+	close(d.wake)
+	d.wake = make(chan struct{})
+	d.dmu.Unlock()
+	return nil
+}
+
+func (d *dgramStrm) SetWriteDeadline(t time.Time) error { return d.framed.SetWriteDeadline(t) }
+func (d *dgramStrm) SID() int                           { return d.framed.SID() }
+func (d *dgramStrm) LocalAddr() net.Addr                { return d.framed.LocalAddr() }
+func (d *dgramStrm) RemoteAddr() net.Addr               { return d.framed.RemoteAddr() }
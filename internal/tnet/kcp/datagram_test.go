@@ -0,0 +1,103 @@
+package kcp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"paqet/internal/tnet"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+type pipeStrm struct {
+	net.Conn
+}
+
+func (pipeStrm) SID() int { return 3 }
+
+func TestDgramMux(t *testing.T) {
+	pa, pb := newFECPipes()
+	defer pa.Close()
+	defer pb.Close()
+	ma, mb := newDgramMux(pa, nil, 1400), newDgramMux(pb, nil, 1400)
+
+	kcpIn := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, _, err := mb.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			kcpIn <- bytes.Clone(buf[:n])
+		}
+	}()
+
+	// The sessions only name the conversation; their own packets go nowhere.
+	idle, _ := newFECPipes()
+	defer idle.Close()
+	sa, err := kcp.NewConn3(7, pb.addr, nil, 0, 0, idle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sa.Close()
+	sb, err := kcp.NewConn3(7, pa.addr, nil, 0, 0, idle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sb.Close()
+	fa, fb := net.Pipe()
+	da := ma.bind(sa, tnet.NewDgramStrm(pipeStrm{fa}, tnet.MaxFrame))
+	defer da.Close()
+
+	// A datagram that beats the stream to the other end is held for it.
+	if _, err := da.Write([]byte("early")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		mb.mu.RLock()
+		held := len(mb.pending)
+		mb.mu.RUnlock()
+		if held > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("early datagram was not held")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	db := mb.bind(sb, tnet.NewDgramStrm(pipeStrm{fb}, tnet.MaxFrame))
+	defer db.Close()
+	db.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, tnet.MaxFrame)
+	if n, err := db.Read(buf); err != nil || string(buf[:n]) != "early" {
+		t.Fatalf("held datagram: %q, %v", buf[:n], err)
+	}
+
+	// Too large for a packet of its own, so it takes the framed stream.
+	big := bytes.Repeat([]byte{9}, ma.limit+1)
+	if _, err := da.Write(big); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.Read(buf); err != nil || !bytes.Equal(buf[:n], big) {
+		t.Fatalf("large datagram: %d bytes, %v", n, err)
+	}
+
+	// KCP's own packets pass through.
+	if _, err := ma.WriteTo([]byte("kcp"), pb.addr); err != nil {
+		t.Fatal(err)
+	}
+	if p := <-kcpIn; string(p) != "kcp" {
+		t.Fatalf("KCP packet: %q", p)
+	}
+
+	db.SetReadDeadline(time.Now().Add(-time.Second))
+	if _, err := db.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read past the deadline: %v", err)
+	}
+}
@@ -9,23 +9,56 @@ import (
 	"paqet/internal/tnet"
 
 	"github.com/xtaci/kcp-go/v5"
-	"github.com/xtaci/smux"
 )
 
 func Dial(addr *net.UDPAddr, cfg *conf.KCP, pConn *socket.PacketConn) (tnet.Conn, error) {
-	conn, err := kcp.NewConn(addr.String(), cfg.Block, cfg.Dshard, cfg.Pshard, pConn)
+	warnStatic(cfg)
+	var pc net.PacketConn = pConn
+	var secure *secureClient
+	block, overhead := cfg.Block, 0
+	if cfg.Handshake == "x25519" {
+		sc, err := dialSecure(pConn, addr, cfg.PSK, cfg.ReplayWindow)
+		if err != nil {
+			return nil, err
+		}
+		pc, block, secure, overhead = sc, nil, sc, secureOverhead
+	}
+
+	var mux *dgramMux
+	if cfg.UDPPath == "datagram" {
+		overhead++
+		mux = newDgramMux(pc, block, cfg.MTU-overhead)
+		pc = mux
+	}
+
+	if cfg.FEC.Mode == "adaptive" {
+		// The FEC layer seals whole packets in place of KCP.
+		overhead += fecOverhead
+		if block != nil {
+			overhead += blockOverhead(block)
+		}
+		pc, block = newFECConn(pc, block, &cfg.FEC), nil
+	}
+
+	conn, err := kcp.NewConn(addr.String(), block, cfg.Dshard, cfg.Pshard, pc)
 	if err != nil {
 		return nil, fmt.Errorf("connection attempt failed: %v", err)
 	}
-	aplConf(conn, cfg)
-	flog.Debugf("KCP connection created, creating smux session")
+	aplConf(conn, cfg, overhead)
+	flog.Debugf("KCP connection created, creating %s session", cfg.Mux)
 
-	sess, err := smux.Client(conn, smuxConf(cfg))
+	sess, err := dialMux(conn, cfg)
 	if err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("failed to create smux session: %w", err)
+		return nil, fmt.Errorf("failed to create %s session: %w", cfg.Mux, err)
 	}
 
-	flog.Debugf("smux session created successfully")
-	return &Conn{pConn, conn, sess}, nil
+	flog.Debugf("%s session created successfully", cfg.Mux)
+	c := &Conn{PacketConn: pConn, UDPSession: conn, Session: sess, secure: secure, mux: mux, done: make(chan struct{})}
+	logBlockErrors()
+	if secure != nil {
+		c.binding = secure.sess.Load().binding
+		go logDrops(c.ReplayStats, c.AuthStats, c.done)
+	}
+	return c, nil
 }
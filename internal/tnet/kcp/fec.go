@@ -0,0 +1,740 @@
+package kcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"sync"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// With fec mode adaptive, a layer under KCP adds Reed-Solomon parity whose
+// strength follows the loss the peer reports. It sends
+//
+//	data:   0x00 | seq (4) | group (4) | index (1) | KCP packet
+//	parity: 0x01 | seq (4) | group (4) | index (1) | data (1) | parity (1) | shard
+//	report: 0x02 | received (4) | lost (4) | bursts (4)
+//	plain:  0x03 | seq (4) | KCP packet
+//	hello:  0x04 | ack (1)
+//
+// sealed with the KCP block when KCP encrypts by itself; KCP then runs
+// without one. seq counts data, plain and parity packets, so receivers see
+// what the path drops; loss is measured there, not from KCP's retransmissions,
+// whose counters kcp-go only keeps for the whole process. Data packets go out
+// as plain ones while parity is off. A group is a run of data packets
+// followed by parity packets over them. Parity packets name how many of each
+// their group has, so the sender may change both at any group. A shard is the KCP packet behind a
+// 2-byte length, zero-padded to the longest packet of its group.
+//
+// Every interval, receivers report what they received and lost since the
+// last report, and in how many bursts. The sender starts parity when the loss
+// reaches on_loss and stops it below off_loss. In between it sizes parity to
+// twice the loss rate and at least the mean burst, and shrinks groups when
+// parity is at max_pshard. It steps up at once, but down only after hold
+// reports in a row ask for less.
+//
+// Before its first packet to a peer, an end sends hellos and holds KCP's
+// packets until one comes back with ack set; the peer answers every hello
+// without it. A hello is shorter than any KCP packet, so peers without the
+// layer drop it, and after fecProbe without an answer the end sends them bare
+// KCP, which is static FEC only. A peer whose first packet is not a hello, or
+// that sends one of no type above, is given bare KCP from then on too.
+const (
+	fecData   byte = 0x00
+	fecParity byte = 0x01
+	fecReport byte = 0x02
+	fecPlain  byte = 0x03
+	fecHello  byte = 0x04
+
+	fecPlainHeader  = 1 + 4
+	fecDataHeader   = 1 + 4 + 4 + 1
+	fecParityHeader = fecDataHeader + 2
+	fecReportSize   = 1 + 4 + 4 + 4
+	fecHelloSize    = 1 + 1
+
+	// fecOverhead is the most the layer adds to a KCP packet: a parity shard
+	// is as long as the longest packet of its group, plus its length.
+	fecOverhead = fecParityHeader + 2
+
+	// fecFlushDelay is how long a group may wait for more data packets
+	// before its parity goes out.
+	fecFlushDelay = 20 * time.Millisecond
+	fecTick       = 10 * time.Millisecond
+
+	// fecGroups is how many recent groups receivers keep for recovery, and
+	// fecKeep how long after the last parity packet they keep data at all.
+	fecGroups = 32
+	fecKeep   = 2 * time.Second
+
+	// fecMinSample is the fewest packets a report must cover to be acted on.
+	fecMinSample = 64
+	fecPeerTTL   = 2 * time.Minute
+
+	// fecHelloEvery is how often hellos go out until one is answered, for at
+	// most fecProbe, and fecHeld how many KCP packets wait for the answer.
+	fecHelloEvery = 250 * time.Millisecond
+	fecProbe      = 2 * time.Second
+	fecHeld       = 128
+)
+
+// What a peer was found to speak.
+const (
+	fecUnknown = iota
+	fecFramed
+	fecBare
+)
+
+// fecConn is the PacketConn KCP runs over with adaptive FEC. ReadFrom is
+// only called from KCP's single reader goroutine.
+type fecConn struct {
+	net.PacketConn
+	cfg   *conf.FEC
+	block kcp.BlockCrypt
+
+	mu    sync.Mutex
+	peers map[uint64]*fecPeer
+
+	cmu    sync.Mutex
+	codecs map[[2]int]reedsolomon.Encoder
+
+	buf, scratch []byte
+	ready        []fecRecovered
+
+	done chan struct{}
+	once sync.Once
+}
+
+type fecRecovered struct {
+	pkt  []byte
+	addr net.Addr
+}
+
+// fecPeer is the state towards one remote address.
+type fecPeer struct {
+	addr net.Addr
+
+	mu       sync.Mutex
+	lastSeen time.Time
+
+	// mode is fecUnknown until a hello is answered or the probe gives up.
+	mode    int
+	probing time.Time
+	helloAt time.Time
+	held    [][]byte
+
+	// Sending side.
+	seq    uint32
+	group  uint32
+	shards [][]byte
+	opened time.Time
+	dshard int
+	pshard int
+	weaker int
+
+	// Receiving side.
+	rxSeq    uint32
+	rxAny    bool
+	received uint32
+	lost     uint32
+	bursts   uint32
+	parityAt time.Time
+	groups   map[uint32]*fecGroup
+	newest   uint32
+}
+
+// fecGroup is what a receiver has of one group.
+type fecGroup struct {
+	data   [][]byte
+	parity [][]byte
+	dshard int
+	size   int
+	done   bool
+}
+
+func newFECConn(pc net.PacketConn, block kcp.BlockCrypt, cfg *conf.FEC) *fecConn {
+	f := &fecConn{
+		PacketConn: pc,
+		cfg:        cfg,
+		block:      block,
+		peers:      make(map[uint64]*fecPeer),
+		codecs:     make(map[[2]int]reedsolomon.Encoder),
+		buf:        make([]byte, 65535),
+		scratch:    make([]byte, 65535),
+		done:       make(chan struct{}),
+	}
+	go f.run()
+	return f
+}
+
+func (f *fecConn) peer(addr net.Addr) *fecPeer {
+	key := addrKey(addr)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p := f.peers[key]
+	if p == nil {
+		p = &fecPeer{addr: addr, dshard: f.cfg.MaxDshard, groups: make(map[uint32]*fecGroup), lastSeen: time.Now()}
+		f.peers[key] = p
+	}
+	return p
+}
+
+func (f *fecConn) codec(data, parity int) (reedsolomon.Encoder, error) {
+	f.cmu.Lock()
+	defer f.cmu.Unlock()
+	k := [2]int{data, parity}
+	if enc := f.codecs[k]; enc != nil {
+		return enc, nil
+	}
+	enc, err := reedsolomon.New(data, parity)
+	if err != nil {
+		return nil, err
+	}
+	f.codecs[k] = enc
+	return enc, nil
+}
+
+func (f *fecConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		if len(f.ready) > 0 {
+			r := f.ready[0]
+			f.ready = f.ready[1:]
+			if len(b) < len(r.pkt) {
+				continue
+			}
+			return copy(b, r.pkt), r.addr, nil
+		}
+
+		n, addr, err := f.PacketConn.ReadFrom(f.buf)
+		if err != nil {
+			f.once.Do(func() { close(f.done) })
+			return 0, nil, err
+		}
+		pkt := f.buf[:n]
+		if f.block != nil {
+			var ok bool
+			if pkt, ok = openBlock(f.block, f.scratch, pkt); !ok {
+				continue
+			}
+		}
+		if len(pkt) == 0 {
+			continue
+		}
+
+		p := f.peer(addr)
+		if pkt[0] == fecHello {
+			if len(pkt) >= fecHelloSize {
+				p.onHello(f, pkt[1] == 1)
+			}
+			continue
+		}
+		if !p.framed(f, pkt[0]) {
+			if len(b) < len(pkt) {
+				continue
+			}
+			return copy(b, pkt), addr, nil
+		}
+		switch pkt[0] {
+		case fecData:
+			if len(pkt) < fecDataHeader || len(b) < len(pkt)-fecDataHeader {
+				continue
+			}
+			p.onData(pkt)
+			return copy(b, pkt[fecDataHeader:]), addr, nil
+		case fecPlain:
+			if len(pkt) < fecPlainHeader || len(b) < len(pkt)-fecPlainHeader {
+				continue
+			}
+			p.mu.Lock()
+			p.count(binary.BigEndian.Uint32(pkt[1:5]))
+			p.mu.Unlock()
+			return copy(b, pkt[fecPlainHeader:]), addr, nil
+		case fecParity:
+			if len(pkt) < fecParityHeader+2 {
+				continue
+			}
+			for _, r := range p.onParity(f, pkt) {
+				f.ready = append(f.ready, fecRecovered{pkt: r, addr: addr})
+			}
+		case fecReport:
+			if len(pkt) < fecReportSize {
+				continue
+			}
+			p.onReport(f.cfg,
+				binary.BigEndian.Uint32(pkt[1:5]),
+				binary.BigEndian.Uint32(pkt[5:9]),
+				binary.BigEndian.Uint32(pkt[9:13]))
+		}
+	}
+}
+
+func (f *fecConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	p := f.peer(addr)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastSeen = time.Now()
+	if p.mode == fecUnknown {
+		// KCP sends again what does not fit.
+		if len(p.held) < fecHeld {
+			p.held = append(p.held, bytes.Clone(b))
+		}
+		if p.probing.IsZero() {
+			p.probing = p.lastSeen
+			f.hello(p, false)
+		}
+		return len(b), nil
+	}
+	if err := f.write(p, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// write sends a KCP packet to p the way p's mode asks for. It is called with
+// p locked.
+func (f *fecConn) write(p *fecPeer, b []byte) error {
+	if p.mode == fecBare {
+		return f.send(b, p.addr)
+	}
+	if p.pshard == 0 {
+		if len(p.shards) > 0 {
+			f.flush(p)
+		}
+		pkt := make([]byte, fecPlainHeader+len(b))
+		pkt[0] = fecPlain
+		binary.BigEndian.PutUint32(pkt[1:5], p.seq)
+		copy(pkt[fecPlainHeader:], b)
+		p.seq++
+		return f.send(pkt, p.addr)
+	}
+
+	pkt := make([]byte, fecDataHeader+len(b))
+	pkt[0] = fecData
+	binary.BigEndian.PutUint32(pkt[1:5], p.seq)
+	binary.BigEndian.PutUint32(pkt[5:9], p.group)
+	pkt[9] = byte(len(p.shards))
+	copy(pkt[fecDataHeader:], b)
+	p.seq++
+	if err := f.send(pkt, p.addr); err != nil {
+		return err
+	}
+
+	if len(p.shards) == 0 {
+		p.opened = time.Now()
+	}
+	p.shards = append(p.shards, pkt[fecDataHeader:])
+	if len(p.shards) >= p.dshard {
+		f.flush(p)
+	}
+	return nil
+}
+
+// hello sends p a hello. It is called with p locked.
+func (f *fecConn) hello(p *fecPeer, ack bool) {
+	pkt := []byte{fecHello, 0}
+	if ack {
+		pkt[1] = 1
+	}
+	p.helloAt = time.Now()
+	f.send(pkt, p.addr)
+}
+
+// settle gives p its mode and sends what KCP sent to p meanwhile. It is
+// called with p locked.
+func (f *fecConn) settle(p *fecPeer, mode int) {
+	p.mode = mode
+	if mode == fecBare {
+		p.shards, p.pshard = nil, 0
+	}
+	held := p.held
+	p.held, p.probing = nil, time.Time{}
+	for _, b := range held {
+		if f.write(p, b) != nil {
+			return
+		}
+	}
+}
+
+func (f *fecConn) send(pkt []byte, addr net.Addr) error {
+	if f.block != nil {
+		pkt = sealBlock(f.block, pkt)
+	}
+	_, err := f.PacketConn.WriteTo(pkt, addr)
+	return err
+}
+
+// flush sends the parity of p's open group and starts the next one. It is
+// called with p locked.
+func (f *fecConn) flush(p *fecPeer) {
+	data := p.shards
+	p.shards = nil
+	group := p.group
+	p.group++
+	if len(data) == 0 || p.pshard == 0 {
+		return
+	}
+
+	size := 0
+	for _, d := range data {
+		size = max(size, 2+len(d))
+	}
+	shards := make([][]byte, len(data)+p.pshard)
+	for i, d := range data {
+		s := make([]byte, size)
+		binary.BigEndian.PutUint16(s, uint16(len(d)))
+		copy(s[2:], d)
+		shards[i] = s
+	}
+	for i := len(data); i < len(shards); i++ {
+		shards[i] = make([]byte, size)
+	}
+	enc, err := f.codec(len(data), p.pshard)
+	if err != nil {
+		flog.Debugf("FEC codec for %d+%d shards failed: %v", len(data), p.pshard, err)
+		return
+	}
+	if err := enc.Encode(shards); err != nil {
+		flog.Debugf("FEC encoding failed: %v", err)
+		return
+	}
+
+	for i := len(data); i < len(shards); i++ {
+		pkt := make([]byte, fecParityHeader+size)
+		pkt[0] = fecParity
+		binary.BigEndian.PutUint32(pkt[1:5], p.seq)
+		binary.BigEndian.PutUint32(pkt[5:9], group)
+		pkt[9] = byte(i)
+		pkt[10] = byte(len(data))
+		pkt[11] = byte(p.pshard)
+		copy(pkt[fecParityHeader:], shards[i])
+		p.seq++
+		if err := f.send(pkt, p.addr); err != nil {
+			return
+		}
+	}
+}
+
+// run flushes groups that waited too long, sends loss reports and forgets
+// idle peers, until the underlying conn fails.
+func (f *fecConn) run() {
+	tick := time.NewTicker(fecTick)
+	defer tick.Stop()
+	interval := time.Duration(f.cfg.IntervalMs) * time.Millisecond
+	nextReport := time.Now().Add(interval)
+	for {
+		select {
+		case <-f.done:
+			return
+		case now := <-tick.C:
+			report := !now.Before(nextReport)
+			if report {
+				nextReport = now.Add(interval)
+			}
+			f.mu.Lock()
+			peers := make([]*fecPeer, 0, len(f.peers))
+			for k, p := range f.peers {
+				p.mu.Lock()
+				idle := now.Sub(p.lastSeen) > fecPeerTTL
+				p.mu.Unlock()
+				if idle {
+					delete(f.peers, k)
+					continue
+				}
+				peers = append(peers, p)
+			}
+			f.mu.Unlock()
+
+			for _, p := range peers {
+				p.mu.Lock()
+				if p.mode == fecUnknown && !p.probing.IsZero() {
+					switch {
+					case now.Sub(p.probing) >= fecProbe:
+						flog.Warnf("%s does not answer the FEC hello: it has no fec mode adaptive, using static FEC towards it", p.addr)
+						f.settle(p, fecBare)
+					case now.Sub(p.helloAt) >= fecHelloEvery:
+						f.hello(p, false)
+					}
+				}
+				if len(p.shards) > 0 && now.Sub(p.opened) >= fecFlushDelay {
+					f.flush(p)
+				}
+				if report && p.mode == fecFramed && p.received+p.lost > 0 {
+					pkt := make([]byte, fecReportSize)
+					pkt[0] = fecReport
+					binary.BigEndian.PutUint32(pkt[1:5], p.received)
+					binary.BigEndian.PutUint32(pkt[5:9], p.lost)
+					binary.BigEndian.PutUint32(pkt[9:13], p.bursts)
+					p.received, p.lost, p.bursts = 0, 0, 0
+					f.send(pkt, p.addr)
+				}
+				p.mu.Unlock()
+			}
+		}
+	}
+}
+
+// count does the loss accounting for a data or parity packet. It is called
+// with p locked.
+func (p *fecPeer) count(seq uint32) {
+	p.lastSeen = time.Now()
+	if !p.rxAny {
+		p.rxAny, p.rxSeq = true, seq
+		p.received++
+		return
+	}
+	switch d := int32(seq - p.rxSeq); {
+	case d > 1<<16 || d < -(1<<16):
+		// The peer started over.
+		p.rxSeq = seq
+		p.received++
+	case d > 0:
+		if d > 1 {
+			p.lost += uint32(d - 1)
+			p.bursts++
+		}
+		p.rxSeq = seq
+		p.received++
+	case d < 0:
+		// Late, and counted as lost when the gap opened.
+		if p.lost > 0 {
+			p.lost--
+		}
+		p.received++
+	}
+}
+
+func (p *fecPeer) onData(pkt []byte) {
+	seq := binary.BigEndian.Uint32(pkt[1:5])
+	group := binary.BigEndian.Uint32(pkt[5:9])
+	index := int(pkt[9])
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.count(seq)
+	if time.Since(p.parityAt) > fecKeep {
+		return
+	}
+	g := p.groupFor(group)
+	if g == nil || g.done {
+		return
+	}
+	for len(g.data) <= index {
+		g.data = append(g.data, nil)
+	}
+	if g.data[index] == nil {
+		g.data[index] = append([]byte(nil), pkt[fecDataHeader:]...)
+	}
+}
+
+// onHello answers a hello from p, and takes it as proof that p speaks the
+// layer. An answer that comes after the probe gave up is ignored, as p may
+// have seen bare KCP since.
+func (p *fecPeer) onHello(f *fecConn, ack bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastSeen = time.Now()
+	if !ack {
+		f.hello(p, true)
+	}
+	if p.mode == fecFramed || p.mode == fecBare && ack {
+		return
+	}
+	flog.Debugf("FEC layer towards %s agreed", p.addr)
+	f.settle(p, fecFramed)
+}
+
+// framed reports whether a packet of type typ from p has the layer's framing
+// rather than being bare KCP. A peer without adaptive FEC sends bare KCP,
+// which starts with a conversation id or kcp-go's FEC header, so a first
+// packet that is not a hello, or a type that is none of the layer's, makes p
+// a bare peer.
+func (p *fecPeer) framed(f *fecConn, typ byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case p.mode == fecBare:
+		return false
+	case p.mode == fecFramed && typ <= fecPlain:
+		return true
+	case p.mode == fecFramed:
+		flog.Warnf("%s sends packets without the FEC layer: using static FEC towards it", p.addr)
+	default:
+		flog.Infof("%s has no fec mode adaptive: using static FEC towards it", p.addr)
+	}
+	f.settle(p, fecBare)
+	return false
+}
+
+// onParity stores a parity shard and returns the KCP packets of its group
+// that it makes recoverable.
+func (p *fecPeer) onParity(f *fecConn, pkt []byte) [][]byte {
+	seq := binary.BigEndian.Uint32(pkt[1:5])
+	group := binary.BigEndian.Uint32(pkt[5:9])
+	index, dshard, pshard := int(pkt[9]), int(pkt[10]), int(pkt[11])
+	shard := pkt[fecParityHeader:]
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.count(seq)
+	p.parityAt = time.Now()
+	if dshard == 0 || pshard == 0 || index < dshard || index >= dshard+pshard {
+		return nil
+	}
+	g := p.groupFor(group)
+	if g == nil || g.done {
+		return nil
+	}
+	if g.dshard == 0 {
+		g.dshard, g.size = dshard, len(shard)
+		g.parity = make([][]byte, pshard)
+	}
+	if g.dshard != dshard || len(g.parity) != pshard || g.size != len(shard) {
+		return nil
+	}
+	if g.parity[index-dshard] == nil {
+		g.parity[index-dshard] = append([]byte(nil), shard...)
+	}
+
+	have, missing := 0, 0
+	for i := 0; i < dshard; i++ {
+		if i < len(g.data) && g.data[i] != nil {
+			have++
+		} else {
+			missing++
+		}
+	}
+	if missing == 0 {
+		g.done = true
+		return nil
+	}
+	for _, s := range g.parity {
+		if s != nil {
+			have++
+		}
+	}
+	if have < dshard {
+		return nil
+	}
+
+	g.done = true
+	shards := make([][]byte, dshard+pshard)
+	for i := 0; i < dshard; i++ {
+		if i >= len(g.data) || g.data[i] == nil {
+			continue
+		}
+		if len(g.data[i])+2 > g.size {
+			return nil
+		}
+		s := make([]byte, g.size)
+		binary.BigEndian.PutUint16(s, uint16(len(g.data[i])))
+		copy(s[2:], g.data[i])
+		shards[i] = s
+	}
+	copy(shards[dshard:], g.parity)
+	enc, err := f.codec(dshard, pshard)
+	if err != nil {
+		return nil
+	}
+	if err := enc.ReconstructData(shards); err != nil {
+		flog.Debugf("FEC recovery from %s failed: %v", p.addr, err)
+		return nil
+	}
+	var recovered [][]byte
+	for i := 0; i < dshard; i++ {
+		if i < len(g.data) && g.data[i] != nil {
+			continue
+		}
+		n := int(binary.BigEndian.Uint16(shards[i]))
+		if n+2 > g.size {
+			continue
+		}
+		recovered = append(recovered, shards[i][2:2+n])
+	}
+	g.data, g.parity = nil, nil
+	return recovered
+}
+
+// groupFor returns the receiving state of group, or nil if it is too old. It
+// is called with p locked.
+func (p *fecPeer) groupFor(group uint32) *fecGroup {
+	if len(p.groups) == 0 || int32(group-p.newest) > 0 {
+		p.newest = group
+	}
+	if int32(p.newest-group) >= fecGroups {
+		return nil
+	}
+	g := p.groups[group]
+	if g == nil {
+		g = &fecGroup{}
+		p.groups[group] = g
+		if len(p.groups) > 2*fecGroups {
+			for k := range p.groups {
+				if int32(p.newest-k) >= fecGroups {
+					delete(p.groups, k)
+				}
+			}
+		}
+	}
+	return g
+}
+
+// onReport adapts the parity sent to p to the loss p reported.
+func (p *fecPeer) onReport(cfg *conf.FEC, received, lost, bursts uint32) {
+	total := uint64(received) + uint64(lost)
+	if total < fecMinSample {
+		return
+	}
+	loss := float64(lost) / float64(total) * 100
+	burst := 1.0
+	if bursts > 0 {
+		burst = float64(lost) / float64(bursts)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	dshard, pshard := fecTarget(cfg, p.pshard > 0, loss, burst)
+	switch {
+	case pshard*p.dshard > p.pshard*dshard:
+		p.weaker = 0
+	case pshard*p.dshard < p.pshard*dshard:
+		p.weaker++
+		if p.weaker < cfg.Hold {
+			return
+		}
+		p.weaker = 0
+	default:
+		p.weaker = 0
+		return
+	}
+
+	switch {
+	case p.pshard == 0:
+		flog.Infof("FEC towards %s on: %d data + %d parity shards (loss %.1f%%, mean burst %.1f)", p.addr, dshard, pshard, loss, burst)
+	case pshard == 0:
+		flog.Infof("FEC towards %s off (loss %.1f%%)", p.addr, loss)
+	default:
+		flog.Debugf("FEC towards %s now %d data + %d parity shards (loss %.1f%%, mean burst %.1f)", p.addr, dshard, pshard, loss, burst)
+	}
+	p.dshard, p.pshard = dshard, pshard
+}
+
+// fecTarget is the group shape for a loss rate in percent and a mean burst
+// length. Parity stays on down to off_loss once it is on.
+func fecTarget(cfg *conf.FEC, on bool, loss, burst float64) (dshard, pshard int) {
+	if loss < cfg.OffLoss || !on && loss < cfg.OnLoss {
+		return cfg.MaxDshard, 0
+	}
+	rate := min(2*loss/100, 0.5)
+	need := func(d int) int {
+		return max(int(math.Ceil(burst)), int(math.Ceil(float64(d)*rate/(1-rate))))
+	}
+	dshard = cfg.MaxDshard
+	for need(dshard) > cfg.MaxPshard && dshard > cfg.MinDshard {
+		dshard--
+	}
+	pshard = min(max(need(dshard), cfg.MinPshard), cfg.MaxPshard)
+	return dshard, pshard
+}
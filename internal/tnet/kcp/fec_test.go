@@ -0,0 +1,252 @@
+package kcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"paqet/internal/conf"
+)
+
+func fecTestConf() *conf.FEC {
+	return &conf.FEC{Mode: "adaptive", MinDshard: 4, MaxDshard: 16, MinPshard: 1, MaxPshard: 8,
+		OnLoss: 1, OffLoss: 0.3, IntervalMs: 1000, Hold: 5}
+}
+
+// fecPipe is one end of an in-memory packet path. drop decides which of the
+// packets written to it are lost.
+type fecPipe struct {
+	net.PacketConn
+	addr   net.Addr
+	in     chan []byte
+	peer   *fecPipe
+	drop   func(pkt []byte) bool
+	closed chan struct{}
+}
+
+func newFECPipes() (a, b *fecPipe) {
+	a = &fecPipe{addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}, in: make(chan []byte, 256), closed: make(chan struct{})}
+	b = &fecPipe{addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 2}, in: make(chan []byte, 256), closed: make(chan struct{})}
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+func (p *fecPipe) WriteTo(b []byte, _ net.Addr) (int, error) {
+	if p.drop == nil || !p.drop(b) {
+		p.peer.in <- bytes.Clone(b)
+	}
+	return len(b), nil
+}
+
+func (p *fecPipe) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-p.in:
+		return copy(b, pkt), p.peer.addr, nil
+	case <-p.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (p *fecPipe) Close() error {
+	close(p.closed)
+	return nil
+}
+
+func TestFECRecover(t *testing.T) {
+	pa, pb := newFECPipes()
+	// Lose two data packets of the second group; its parity must bring them back.
+	pa.drop = func(pkt []byte) bool {
+		return pkt[0] == fecData && binary.BigEndian.Uint32(pkt[5:9]) == 1 && (pkt[9] == 1 || pkt[9] == 2)
+	}
+	cfg := fecTestConf()
+	a, b := newFECConn(pa, nil, cfg), newFECConn(pb, nil, cfg)
+	defer pa.Close()
+	defer pb.Close()
+
+	p := a.peer(pb.addr)
+	p.mode, p.dshard, p.pshard = fecFramed, 4, 2
+	b.peer(pa.addr).mode = fecFramed
+	sent := make(map[string]bool)
+	for i := range 8 {
+		pkt := bytes.Repeat([]byte{byte(i)}, 10+7*i)
+		sent[string(pkt)] = true
+		if _, err := a.WriteTo(pkt, pb.addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := make(chan []byte)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, _, err := b.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			got <- bytes.Clone(buf[:n])
+		}
+	}()
+	for i := range 8 {
+		select {
+		case pkt := <-got:
+			if !sent[string(pkt)] {
+				t.Fatalf("received %d bytes that were not sent, or twice", len(pkt))
+			}
+			delete(sent, string(pkt))
+		case <-time.After(2 * time.Second):
+			t.Fatalf("received %d of 8 packets", i)
+		}
+	}
+}
+
+func TestFECHello(t *testing.T) {
+	pa, pb := newFECPipes()
+	sent := make(chan []byte, 16)
+	pa.drop = func(pkt []byte) bool {
+		sent <- bytes.Clone(pkt)
+		return false
+	}
+	cfg := fecTestConf()
+	a, b := newFECConn(pa, nil, cfg), newFECConn(pb, nil, cfg)
+	defer pa.Close()
+	defer pb.Close()
+	go a.ReadFrom(make([]byte, 1500))
+
+	// Held until b answers the hello, then sent plain as parity is off.
+	if _, err := a.WriteTo([]byte("kcp"), pb.addr); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, _, err := b.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "kcp" {
+		t.Fatalf("read %q, %v", buf[:n], err)
+	}
+	if pkt := <-sent; !bytes.Equal(pkt, []byte{fecHello, 0}) {
+		t.Fatalf("first packet is % x, want a hello", pkt)
+	}
+	if pkt := <-sent; pkt[0] != fecPlain || len(pkt) != fecPlainHeader+3 {
+		t.Fatalf("packet without parity is type %d, %d bytes", pkt[0], len(pkt))
+	}
+}
+
+func TestFECFallback(t *testing.T) {
+	// pb has no FEC layer, so the hello goes unanswered.
+	pa, pb := newFECPipes()
+	a := newFECConn(pa, nil, fecTestConf())
+	defer pa.Close()
+	defer pb.Close()
+
+	if _, err := a.WriteTo([]byte("kcp"), pb.addr); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	if n, _, _ := pb.ReadFrom(buf); !bytes.Equal(buf[:n], []byte{fecHello, 0}) {
+		t.Fatalf("first packet is % x, want a hello", buf[:n])
+	}
+	p := a.peer(pb.addr)
+	p.mu.Lock()
+	p.probing = p.probing.Add(-fecProbe)
+	p.mu.Unlock()
+	for {
+		n, _, _ := pb.ReadFrom(buf)
+		if string(buf[:n]) == "kcp" {
+			break
+		}
+		if buf[0] != fecHello {
+			t.Fatalf("got % x, want bare KCP after the probe", buf[:n])
+		}
+	}
+
+	if _, err := pb.WriteTo([]byte("bare"), pa.addr); err != nil {
+		t.Fatal(err)
+	}
+	n, _, err := a.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "bare" {
+		t.Fatalf("read %q, %v", buf[:n], err)
+	}
+}
+
+func TestFECCount(t *testing.T) {
+	p := &fecPeer{groups: make(map[uint32]*fecGroup)}
+	// 3 and 4 arrive late, after the gap that counted them as lost; 7 to 9
+	// never arrive.
+	for _, seq := range []uint32{0, 1, 2, 5, 6, 4, 3, 10} {
+		p.count(seq)
+	}
+	if p.received != 8 || p.lost != 3 || p.bursts != 2 {
+		t.Fatalf("received %d, lost %d in %d bursts; want 8, 3 in 2", p.received, p.lost, p.bursts)
+	}
+
+	// Across the wrap of seq, and after the peer starts over.
+	p = &fecPeer{groups: make(map[uint32]*fecGroup)}
+	for _, seq := range []uint32{1<<32 - 2, 1<<32 - 1, 1, 1 << 30, 1<<30 + 1} {
+		p.count(seq)
+	}
+	if p.received != 5 || p.lost != 1 || p.bursts != 1 {
+		t.Fatalf("received %d, lost %d in %d bursts; want 5, 1 in 1", p.received, p.lost, p.bursts)
+	}
+}
+
+func TestFECTarget(t *testing.T) {
+	cfg := fecTestConf()
+	for _, tc := range []struct {
+		on             bool
+		loss, burst    float64
+		dshard, pshard int
+	}{
+		{false, 0.5, 1, 16, 0}, // below on_loss
+		{true, 0.5, 1, 16, 1},  // on, and above off_loss
+		{true, 0.2, 1, 16, 0},  // below off_loss
+		{false, 10, 1, 16, 4},  // 2x loss: 4 parity per 16
+		{false, 10, 6, 16, 6},  // at least the mean burst
+		{false, 40, 1, 8, 8},   // parity at max_pshard shrinks the group
+	} {
+		d, p := fecTarget(cfg, tc.on, tc.loss, tc.burst)
+		if d != tc.dshard || p != tc.pshard {
+			t.Errorf("fecTarget(on=%v, loss %.1f%%, burst %.0f) = %d+%d, want %d+%d",
+				tc.on, tc.loss, tc.burst, d, p, tc.dshard, tc.pshard)
+		}
+	}
+}
+
+func TestFECReportHold(t *testing.T) {
+	cfg := fecTestConf()
+	p := &fecPeer{addr: &net.UDPAddr{}, dshard: cfg.MaxDshard}
+	shape := func() [2]int { return [2]int{p.dshard, p.pshard} }
+
+	// Up at once.
+	p.onReport(cfg, 900, 100, 100)
+	if shape() != [2]int{16, 4} {
+		t.Fatalf("after 10%% loss: %v", shape())
+	}
+	// Down only after hold reports in a row; a stronger one starts over.
+	for range cfg.Hold - 1 {
+		p.onReport(cfg, 995, 5, 5)
+	}
+	p.onReport(cfg, 900, 100, 100)
+	for range cfg.Hold - 1 {
+		p.onReport(cfg, 995, 5, 5)
+	}
+	if shape() != [2]int{16, 4} {
+		t.Fatalf("stepped down before hold reports: %v", shape())
+	}
+	p.onReport(cfg, 995, 5, 5)
+	if shape() != [2]int{16, 1} {
+		t.Fatalf("after hold reports of 0.5%% loss: %v", shape())
+	}
+	// Too few packets to act on.
+	for range cfg.Hold {
+		p.onReport(cfg, 10, 0, 0)
+	}
+	if shape() != [2]int{16, 1} {
+		t.Fatalf("acted on small reports: %v", shape())
+	}
+	for range cfg.Hold {
+		p.onReport(cfg, 1000, 0, 0)
+	}
+	if shape() != [2]int{16, 0} {
+		t.Fatalf("after hold reports without loss: %v", shape())
+	}
+}
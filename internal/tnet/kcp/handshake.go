@@ -0,0 +1,238 @@
+package kcp
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// The x25519 handshake gives every KCP session its own keys, in the spirit of
+// Noise NNpsk0: both sides contribute an ephemeral X25519 key and the shared
+// key only proves that each side is a legitimate peer. Recorded traffic stays
+// sealed even if the shared key leaks later.
+//
+//	init: 0x01 | e_c (32) | AEAD(k_init, timestamp (8), ad=e_c)
+//	resp: 0x02 | e_s (32) | AEAD(k_resp, empty, ad=e_c||e_s)
+//	data: 0x03 | counter (8) | AEAD(k_dir, payload, ad=type||counter)
+//
+// k_init is derived from the shared key salted with e_c; k_resp, the two
+// directional session keys and the session's binding from DH(e_c, e_s) and
+// the shared key, salted with both public keys.
+//
+// Data counters run through a replay window, and the init timestamp bounds
+// how long a captured init could be replayed; within that bound the server
+// remembers the ephemeral keys it has seen.
+const (
+	pktInit byte = 0x01
+	pktResp byte = 0x02
+	pktData byte = 0x03
+
+	pubSize        = 32
+	initSize       = 1 + pubSize + 8 + chacha20poly1305.Overhead
+	respSize       = 1 + pubSize + chacha20poly1305.Overhead
+	dataHeaderSize = 1 + 8
+
+	// secureOverhead is what the session layer adds to every KCP packet.
+	secureOverhead = dataHeaderSize + chacha20poly1305.Overhead
+
+	// maxClockSkew is how far a client's clock may be off from the server's.
+	maxClockSkew = 2 * time.Minute
+)
+
+var (
+	errReplayed   = errors.New("replayed packet")
+	errTooOld     = errors.New("packet older than the replay window")
+	errStaleInit  = errors.New("handshake timestamp outside the allowed clock skew")
+	errAuthFailed = errors.New("packet failed authentication")
+)
+
+// secureSession holds the keys of one handshaked peer.
+type secureSession struct {
+	send, recv cipher.AEAD
+	sendCtr    atomic.Uint64
+	window     *replayWindow
+	binding    []byte
+
+	// The server keeps the exchange so a retransmitted init gets the same reply.
+	init, resp []byte
+	lastSeen   atomic.Int64
+	confirmed  atomic.Bool
+}
+
+// clientHandshake is the initiator's state between init and resp.
+type clientHandshake struct {
+	psk  []byte
+	priv *ecdh.PrivateKey
+	init []byte
+}
+
+func newClientHandshake(psk []byte) (*clientHandshake, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	pub := priv.PublicKey().Bytes()
+	aead, err := deriveAEAD(psk, pub, "paqet init")
+	if err != nil {
+		return nil, err
+	}
+
+	init := append([]byte{pktInit}, pub...)
+	ts := binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+	init = aead.Seal(init, zeroNonce[:], ts, pub)
+	return &clientHandshake{psk: psk, priv: priv, init: init}, nil
+}
+
+// finish checks the responder's reply and derives the session keys.
+func (h *clientHandshake) finish(resp []byte, window int) (*secureSession, error) {
+	if len(resp) != respSize || resp[0] != pktResp {
+		return nil, fmt.Errorf("malformed handshake response")
+	}
+	ePub := h.priv.PublicKey().Bytes()
+	sPub := resp[1 : 1+pubSize]
+	peer, err := ecdh.X25519().NewPublicKey(sPub)
+	if err != nil {
+		return nil, err
+	}
+	dh, err := h.priv.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := append(append([]byte(nil), ePub...), sPub...)
+	ikm := append(dh, h.psk...)
+	aead, err := deriveAEAD(ikm, salt, "paqet resp")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := aead.Open(nil, zeroNonce[:], resp[1+pubSize:], salt); err != nil {
+		return nil, fmt.Errorf("handshake response failed authentication")
+	}
+	return newSecureSession(ikm, salt, true, window)
+}
+
+// respond answers a client's init, or returns an error if the init was not
+// sealed with psk or is not recent.
+func respond(psk, init []byte, now time.Time, window int) (*secureSession, error) {
+	if len(init) != initSize || init[0] != pktInit {
+		return nil, fmt.Errorf("malformed handshake init")
+	}
+	ePub := init[1 : 1+pubSize]
+	aead, err := deriveAEAD(psk, ePub, "paqet init")
+	if err != nil {
+		return nil, err
+	}
+	ts, err := aead.Open(nil, zeroNonce[:], init[1+pubSize:], ePub)
+	if err != nil {
+		return nil, errAuthFailed
+	}
+	if skew := now.Sub(time.Unix(0, int64(binary.BigEndian.Uint64(ts)))); skew > maxClockSkew || skew < -maxClockSkew {
+		return nil, errStaleInit
+	}
+
+	peer, err := ecdh.X25519().NewPublicKey(ePub)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	dh, err := priv.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	sPub := priv.PublicKey().Bytes()
+
+	salt := append(append([]byte(nil), ePub...), sPub...)
+	ikm := append(dh, psk...)
+	aead, err = deriveAEAD(ikm, salt, "paqet resp")
+	if err != nil {
+		return nil, err
+	}
+	resp := append([]byte{pktResp}, sPub...)
+	resp = aead.Seal(resp, zeroNonce[:], nil, salt)
+
+	sess, err := newSecureSession(ikm, salt, false, window)
+	if err != nil {
+		return nil, err
+	}
+	sess.init = bytes.Clone(init)
+	sess.resp = resp
+	return sess, nil
+}
+
+func newSecureSession(ikm, salt []byte, client bool, window int) (*secureSession, error) {
+	c2s, err := deriveAEAD(ikm, salt, "paqet c2s")
+	if err != nil {
+		return nil, err
+	}
+	s2c, err := deriveAEAD(ikm, salt, "paqet s2c")
+	if err != nil {
+		return nil, err
+	}
+	binding, err := hkdf.Key(sha256.New, ikm, salt, "paqet binding", 32)
+	if err != nil {
+		return nil, err
+	}
+	if client {
+		return &secureSession{send: c2s, recv: s2c, window: newReplayWindow(window), binding: binding}, nil
+	}
+	return &secureSession{send: s2c, recv: c2s, window: newReplayWindow(window), binding: binding}, nil
+}
+
+var zeroNonce [chacha20poly1305.NonceSize]byte
+
+func deriveAEAD(ikm, salt []byte, info string) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, ikm, salt, info, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
+
+// seal appends the data packet carrying payload to dst.
+func (s *secureSession) seal(dst, payload []byte) []byte {
+	ctr := s.sendCtr.Add(1)
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.BigEndian.PutUint64(nonce[4:], ctr)
+
+	var hdr [dataHeaderSize]byte
+	hdr[0] = pktData
+	binary.BigEndian.PutUint64(hdr[1:], ctr)
+	return s.send.Seal(append(dst, hdr[:]...), nonce[:], payload, hdr[:])
+}
+
+// open authenticates a data packet, checks it against the replay window and
+// appends its payload to dst. Only the session's reader goroutine may call it.
+func (s *secureSession) open(dst, pkt []byte) ([]byte, error) {
+	if len(pkt) < secureOverhead || pkt[0] != pktData {
+		return nil, errAuthFailed
+	}
+	ctr := binary.BigEndian.Uint64(pkt[1:dataHeaderSize])
+	switch s.window.check(ctr) {
+	case replayDuplicate:
+		return nil, errReplayed
+	case replayTooOld:
+		return nil, errTooOld
+	}
+
+	var nonce [chacha20poly1305.NonceSize]byte
+	copy(nonce[4:], pkt[1:dataHeaderSize])
+	payload, err := s.recv.Open(dst, nonce[:], pkt[dataHeaderSize:], pkt[:dataHeaderSize])
+	if err != nil {
+		return nil, errAuthFailed
+	}
+	s.window.update(ctr)
+	return payload, nil
+}
@@ -2,13 +2,40 @@ package kcp
 
 import (
 	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"sync"
 	"time"
 
+	"github.com/hashicorp/yamux"
 	"github.com/xtaci/kcp-go/v5"
 	"github.com/xtaci/smux"
 )
 
-func aplConf(conn *kcp.UDPSession, cfg *conf.KCP) {
+var warnStaticOnce sync.Once
+
+// warnStatic warns once per process when KCP runs without the handshake, as
+// nothing then stops captured packets from being accepted again, and AEAD
+// blocks with 96-bit nonces pick them at random under one long-lived key.
+// With the handshake it warns instead when a block was chosen, as the
+// handshake replaces it.
+func warnStatic(cfg *conf.KCP) {
+	warnStaticOnce.Do(func() {
+		if cfg.Handshake == "x25519" {
+			if cfg.Block_ != "aes" && cfg.Block_ != "none" && cfg.Block_ != "null" {
+				flog.Warnf("KCP block %s is not used with handshake x25519, which seals sessions with ChaCha20-Poly1305", cfg.Block_)
+			}
+			return
+		}
+		flog.Warnf("KCP handshake is none: replayed packets are accepted. Set handshake: x25519 on both ends to reject them")
+		if cfg.Block_ == "chacha20-poly1305" || cfg.Block_ == "aes-128-gcm" {
+			flog.Warnf("KCP block %s uses random 96-bit nonces, which are only safe for about 2^32 packets per key. Use xchacha20-poly1305 or handshake x25519", cfg.Block_)
+		}
+	})
+}
+
+// aplConf applies cfg to conn. overhead is what a wrapping PacketConn adds to
+// every packet on top of KCP's own framing.
+func aplConf(conn *kcp.UDPSession, cfg *conf.KCP, overhead int) {
 	var noDelay, interval, resend, noCongestion int
 	var wDelay, ackNoDelay bool
 	switch cfg.Mode {
@@ -31,19 +58,35 @@ func aplConf(conn *kcp.UDPSession, cfg *conf.KCP) {
 
 	conn.SetNoDelay(noDelay, interval, resend, noCongestion)
 	conn.SetWindowSize(cfg.Sndwnd, cfg.Rcvwnd)
-	conn.SetMtu(cfg.MTU)
+	conn.SetMtu(cfg.MTU - overhead)
 	conn.SetWriteDelay(wDelay)
 	conn.SetACKNoDelay(ackNoDelay)
 	conn.SetDSCP(46)
 }
 
-func smuxConf(cfg *conf.KCP) *smux.Config {
+// smuxConf is the smux configuration for version; servers take it from the
+// client's first frame.
+func smuxConf(cfg *conf.KCP, version int) *smux.Config {
 	var sconf = smux.DefaultConfig()
-	sconf.Version = 2
-	sconf.KeepAliveInterval = 2 * time.Second
-	sconf.KeepAliveTimeout = 8 * time.Second
-	sconf.MaxFrameSize = 65535
+	sconf.Version = version
+	sconf.KeepAliveInterval = time.Duration(cfg.KeepaliveMs) * time.Millisecond
+	sconf.KeepAliveTimeout = time.Duration(cfg.KeepaliveTimeoutMs) * time.Millisecond
+	sconf.MaxFrameSize = cfg.MaxFrame
 	sconf.MaxReceiveBuffer = cfg.Smuxbuf
 	sconf.MaxStreamBuffer = cfg.Streambuf
 	return sconf
 }
+
+// yamuxConf maps the smux settings onto yamux. A yamux keepalive fails when
+// the pong is later than the write timeout, so that is what is left of the
+// keepalive timeout after one interval.
+func yamuxConf(cfg *conf.KCP) *yamux.Config {
+	yconf := yamux.DefaultConfig()
+	yconf.KeepAliveInterval = time.Duration(cfg.KeepaliveMs) * time.Millisecond
+	yconf.ConnectionWriteTimeout = max(time.Duration(cfg.KeepaliveTimeoutMs-cfg.KeepaliveMs)*time.Millisecond, time.Second)
+	yconf.MaxStreamWindowSize = uint32(cfg.Streambuf)
+	yconf.StreamCloseTimeout = 30 * time.Second
+	yconf.LogOutput = nil
+	yconf.Logger = yamuxLogger{}
+	return yconf
+}
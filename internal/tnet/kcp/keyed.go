@@ -0,0 +1,203 @@
+package kcp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/hash"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// kcp-go's framing for non-AEAD blocks: a random nonce and a CRC32 of the
+// payload, encrypted together with it.
+const (
+	blockNonceSize  = 16
+	blockHeaderSize = blockNonceSize + 4
+)
+
+// aeadBlock matches kcp-go's AEAD BlockCrypts, which frame packets as
+// nonce | sealed payload instead.
+type aeadBlock interface {
+	NonceSize() int
+	Overhead() int
+	Seal(dst, nonce, plaintext, additionalData []byte) []byte
+	Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error)
+}
+
+func blockOverhead(block kcp.BlockCrypt) int {
+	if a, ok := block.(aeadBlock); ok {
+		return a.NonceSize() + a.Overhead()
+	}
+	return blockHeaderSize
+}
+
+// sealBlock frames payload the way a kcp-go session using block would.
+func sealBlock(block kcp.BlockCrypt, payload []byte) []byte {
+	if a, ok := block.(aeadBlock); ok {
+		ns := a.NonceSize()
+		buf := make([]byte, ns, ns+len(payload)+a.Overhead())
+		rand.Read(buf)
+		return a.Seal(buf, buf[:ns], payload, nil)
+	}
+	buf := make([]byte, blockHeaderSize+len(payload))
+	rand.Read(buf[:blockNonceSize])
+	copy(buf[blockHeaderSize:], payload)
+	binary.LittleEndian.PutUint32(buf[blockNonceSize:], crc32.ChecksumIEEE(buf[blockHeaderSize:]))
+	block.Encrypt(buf, buf)
+	return buf
+}
+
+// openBlock decrypts pkt into scratch and returns the payload, or false if
+// pkt was not sealed with block.
+func openBlock(block kcp.BlockCrypt, scratch, pkt []byte) ([]byte, bool) {
+	if a, ok := block.(aeadBlock); ok {
+		ns := a.NonceSize()
+		if len(pkt) < ns+a.Overhead() {
+			return nil, false
+		}
+		payload, err := a.Open(scratch[:0], pkt[:ns], pkt[ns:], nil)
+		return payload, err == nil
+	}
+	if len(pkt) < blockHeaderSize {
+		return nil, false
+	}
+	buf := scratch[:len(pkt)]
+	block.Decrypt(buf, pkt)
+	if crc32.ChecksumIEEE(buf[blockHeaderSize:]) != binary.LittleEndian.Uint32(buf[blockNonceSize:]) {
+		return nil, false
+	}
+	return buf[blockHeaderSize:], true
+}
+
+// keyedClient is the key a client address was last seen using.
+type keyedClient struct {
+	key      *conf.Key
+	lastSeen atomic.Int64
+}
+
+// keyedServer lets a server accept several keys at once. It decrypts in front
+// of KCP, which then runs without a block, and pins each client address to
+// the key its packets decrypt with. Validity windows only gate new clients;
+// a pinned client keeps its key after the key expires.
+type keyedServer struct {
+	net.PacketConn
+	keys []conf.Key
+
+	mu        sync.RWMutex
+	clients   map[uint64]*keyedClient
+	lastSweep time.Time
+	buf       []byte
+	scratch   []byte
+
+	dropCounters
+}
+
+func listenKeyed(pc net.PacketConn, keys []conf.Key) *keyedServer {
+	return &keyedServer{
+		PacketConn: pc,
+		keys:       keys,
+		clients:    make(map[uint64]*keyedClient),
+		lastSweep:  time.Now(),
+		buf:        make([]byte, 65535),
+		scratch:    make([]byte, 65535),
+	}
+}
+
+// ReadFrom is only called from KCP's single reader goroutine.
+func (s *keyedServer) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := s.PacketConn.ReadFrom(s.buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		ua, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		now := time.Now()
+		if now.Sub(s.lastSweep) > time.Minute {
+			s.sweep(now)
+		}
+
+		id := hash.IPAddr(ua.IP, uint16(ua.Port))
+		s.mu.RLock()
+		client := s.clients[id]
+		s.mu.RUnlock()
+
+		var payload []byte
+		opened := false
+		if client != nil {
+			payload, opened = openBlock(client.key.Block, s.scratch, s.buf[:n])
+		}
+		if !opened {
+			client = s.trial(id, ua, s.buf[:n], now)
+			if client == nil {
+				s.authFailed.Add(1)
+				continue
+			}
+			payload, _ = openBlock(client.key.Block, s.scratch, s.buf[:n])
+		}
+		if len(b) < len(payload) {
+			continue
+		}
+		client.lastSeen.Store(now.UnixNano())
+		return copy(b, payload), addr, nil
+	}
+}
+
+// trial looks for a currently valid key that decrypts pkt and pins addr to it.
+func (s *keyedServer) trial(id uint64, addr *net.UDPAddr, pkt []byte, now time.Time) *keyedClient {
+	for i := range s.keys {
+		key := &s.keys[i]
+		if !key.Valid(now) {
+			continue
+		}
+		if _, ok := openBlock(key.Block, s.scratch, pkt); !ok {
+			continue
+		}
+		client := &keyedClient{key: key}
+		s.mu.Lock()
+		s.clients[id] = client
+		s.mu.Unlock()
+		flog.Infof("client %s uses key %q", addr, key.Name)
+		return client
+	}
+	return nil
+}
+
+func (s *keyedServer) sweep(now time.Time) {
+	s.lastSweep = now
+	cutoff := now.Add(-secureSessionIdle).UnixNano()
+	s.mu.Lock()
+	for id, client := range s.clients {
+		if client.lastSeen.Load() < cutoff {
+			delete(s.clients, id)
+		}
+	}
+	s.mu.Unlock()
+}
+
+func (s *keyedServer) WriteTo(b []byte, addr net.Addr) (int, error) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, net.InvalidAddrError("invalid address")
+	}
+	s.mu.RLock()
+	client := s.clients[hash.IPAddr(ua.IP, uint16(ua.Port))]
+	s.mu.RUnlock()
+	if client == nil {
+		return 0, fmt.Errorf("no key for %s", addr)
+	}
+	if _, err := s.PacketConn.WriteTo(sealBlock(client.key.Block, b), addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -3,40 +3,112 @@ package kcp
 import (
 	"net"
 	"paqet/internal/conf"
+	"paqet/internal/flog"
 	"paqet/internal/socket"
 	"paqet/internal/tnet"
 
 	"github.com/xtaci/kcp-go/v5"
-	"github.com/xtaci/smux"
 )
 
 type Listener struct {
 	packetConn *socket.PacketConn
 	cfg        *conf.KCP
 	listener   *kcp.Listener
+	secure     *secureServer
+	drops      *dropCounters
+	mux        *dgramMux
+	overhead   int
+
+	conns chan tnet.Conn
+	done  chan struct{}
+	err   error
 }
 
 func Listen(cfg *conf.KCP, pConn *socket.PacketConn) (tnet.Listener, error) {
-	l, err := kcp.ServeConn(cfg.Block, cfg.Dshard, cfg.Pshard, pConn)
+	warnStatic(cfg)
+	var pc net.PacketConn = pConn
+	var secure *secureServer
+	var drops *dropCounters
+	block, overhead := cfg.Block, 0
+	switch {
+	case cfg.Handshake == "x25519":
+		secure = listenSecure(pConn, cfg.Keys, cfg.ReplayWindow)
+		pc, block, drops, overhead = secure, nil, &secure.dropCounters, secureOverhead
+	case cfg.Rotating():
+		keyed := listenKeyed(pConn, cfg.Keys)
+		pc, block, drops, overhead = keyed, nil, &keyed.dropCounters, blockOverhead(cfg.Block)
+	}
+
+	var mux *dgramMux
+	if cfg.UDPPath == "datagram" {
+		overhead++
+		mux = newDgramMux(pc, block, cfg.MTU-overhead)
+		pc = mux
+	}
+
+	if cfg.FEC.Mode == "adaptive" {
+		// The FEC layer seals whole packets in place of KCP.
+		overhead += fecOverhead
+		if block != nil {
+			overhead += blockOverhead(block)
+		}
+		pc, block = newFECConn(pc, block, &cfg.FEC), nil
+	}
+
+	l, err := kcp.ServeConn(block, cfg.Dshard, cfg.Pshard, pc)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Listener{packetConn: pConn, cfg: cfg, listener: l}, nil
+	ln := &Listener{packetConn: pConn, cfg: cfg, listener: l, secure: secure, drops: drops, mux: mux, overhead: overhead,
+		conns: make(chan tnet.Conn), done: make(chan struct{})}
+	go ln.serve()
+	logBlockErrors()
+	if drops != nil {
+		go logDrops(ln.ReplayStats, ln.AuthStats, ln.done)
+	}
+	return ln, nil
 }
 
-func (l *Listener) Accept() (tnet.Conn, error) {
-	conn, err := l.listener.AcceptKCP()
-	if err != nil {
-		return nil, err
+// serve accepts KCP sessions and sets up their muxers in the background, as
+// that waits for the client's first bytes.
+func (l *Listener) serve() {
+	for {
+		conn, err := l.listener.AcceptKCP()
+		if err != nil {
+			l.err = err
+			close(l.done)
+			return
+		}
+		go func() {
+			aplConf(conn, l.cfg, l.overhead)
+			sess, err := acceptMux(conn, l.cfg)
+			if err != nil {
+				flog.Debugf("dropping KCP session from %s: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			c := &Conn{UDPSession: conn, Session: sess, mux: l.mux}
+			if l.secure != nil {
+				c.binding = l.secure.binding(conn.RemoteAddr())
+			}
+			select {
+			case l.conns <- c:
+			case <-l.done:
+				sess.Close()
+				conn.Close()
+			}
+		}()
 	}
-	aplConf(conn, l.cfg)
-	sess, err := smux.Server(conn, smuxConf(l.cfg))
-	if err != nil {
-		conn.Close()
-		return nil, err
+}
+
+func (l *Listener) Accept() (tnet.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
 	}
-	return &Conn{nil, conn, sess}, nil
 }
 
 func (l *Listener) Close() error {
@@ -52,3 +124,17 @@ func (l *Listener) Close() error {
 func (l *Listener) Addr() net.Addr {
 	return l.listener.Addr()
 }
+
+// ReplayStats reports packets rejected by the replay filter. It is zero
+// unless the x25519 handshake is enabled.
+func (l *Listener) ReplayStats() ReplayStats {
+	if l.secure == nil {
+		return ReplayStats{}
+	}
+	return l.secure.stats()
+}
+
+// AuthStats reports packets dropped for failing decryption or authentication.
+func (l *Listener) AuthStats() AuthStats {
+	return authStats(l.drops)
+}
@@ -0,0 +1,184 @@
+package kcp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/tnet"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+)
+
+// A client that wants a muxer other than smux opens the KCP session with
+//
+//	muxHello (1) | muxer (1)
+//
+// and the server answers with the same two bytes, naming the muxer it runs.
+// Without a hello the session is smux from the first byte, and the version
+// field of that first frame tells the server which smux protocol to speak.
+const (
+	muxHello byte = 0xfa
+	muxSmux  byte = 0x00
+	muxYamux byte = 0x01
+
+	// muxTimeout bounds the hello exchange, and how long a server waits for
+	// the first byte of a new session.
+	muxTimeout = 10 * time.Second
+)
+
+// muxSession is the stream multiplexer running over a KCP session.
+type muxSession interface {
+	OpenStrm() (tnet.Strm, error)
+	AcceptStrm() (tnet.Strm, error)
+	Close() error
+}
+
+type smuxSession struct{ *smux.Session }
+
+func (s smuxSession) OpenStrm() (tnet.Strm, error) {
+	strm, err := s.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return &Strm{strm}, nil
+}
+
+func (s smuxSession) AcceptStrm() (tnet.Strm, error) {
+	strm, err := s.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return &Strm{strm}, nil
+}
+
+type yamuxSession struct{ *yamux.Session }
+
+func (s yamuxSession) OpenStrm() (tnet.Strm, error) {
+	strm, err := s.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return &yamuxStrm{strm}, nil
+}
+
+func (s yamuxSession) AcceptStrm() (tnet.Strm, error) {
+	strm, err := s.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return &yamuxStrm{strm}, nil
+}
+
+// yamuxLogger sends yamux's log lines to the debug log.
+type yamuxLogger struct{}
+
+func (yamuxLogger) Print(v ...any)                 { flog.Debugf("%s", fmt.Sprint(v...)) }
+func (yamuxLogger) Printf(format string, v ...any) { flog.Debugf(format, v...) }
+func (yamuxLogger) Println(v ...any)               { flog.Debugf("%s", fmt.Sprint(v...)) }
+
+// dialMux starts the client side of the configured muxer on conn.
+func dialMux(conn *kcp.UDPSession, cfg *conf.KCP) (muxSession, error) {
+	if cfg.Mux == "smux" {
+		sess, err := smux.Client(conn, smuxConf(cfg, cfg.SmuxVersion))
+		if err != nil {
+			return nil, err
+		}
+		return smuxSession{sess}, nil
+	}
+
+	conn.SetDeadline(time.Now().Add(muxTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write([]byte{muxHello, muxYamux}); err != nil {
+		return nil, fmt.Errorf("failed to send muxer hello: %w", err)
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return nil, fmt.Errorf("no muxer hello from server, it may predate %s support: %w", cfg.Mux, err)
+	}
+	if reply[0] != muxHello {
+		return nil, fmt.Errorf("invalid muxer hello from server")
+	}
+	switch reply[1] {
+	case muxYamux:
+		sess, err := yamux.Client(conn, yamuxConf(cfg))
+		if err != nil {
+			return nil, err
+		}
+		return yamuxSession{sess}, nil
+	case muxSmux:
+		flog.Infof("server at %s declined %s, using smux", conn.RemoteAddr(), cfg.Mux)
+		sess, err := smux.Client(conn, smuxConf(cfg, cfg.SmuxVersion))
+		if err != nil {
+			return nil, err
+		}
+		return smuxSession{sess}, nil
+	default:
+		return nil, fmt.Errorf("server picked unknown muxer %d", reply[1])
+	}
+}
+
+// acceptMux starts the server side of whichever muxer the client opened
+// conn with.
+func acceptMux(conn *kcp.UDPSession, cfg *conf.KCP) (muxSession, error) {
+	conn.SetReadDeadline(time.Now().Add(muxTimeout))
+	r := bufio.NewReaderSize(conn, 2)
+	first, err := r.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("no data on new session: %w", err)
+	}
+	rwc := &peekedConn{Reader: r, UDPSession: conn}
+
+	switch first[0] {
+	case 1, 2:
+		sess, err := smux.Server(rwc, smuxConf(cfg, int(first[0])))
+		if err != nil {
+			return nil, err
+		}
+		return smuxSession{sess}, nil
+	case muxHello:
+	default:
+		return nil, fmt.Errorf("session starts with unknown byte %#x", first[0])
+	}
+
+	var hello [2]byte
+	conn.SetReadDeadline(time.Now().Add(muxTimeout))
+	_, err = io.ReadFull(r, hello[:])
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read muxer hello: %w", err)
+	}
+	pick := muxSmux
+	if hello[1] == muxYamux {
+		pick = muxYamux
+	}
+	if _, err := conn.Write([]byte{muxHello, pick}); err != nil {
+		return nil, fmt.Errorf("failed to answer muxer hello: %w", err)
+	}
+	if pick == muxYamux {
+		sess, err := yamux.Server(rwc, yamuxConf(cfg))
+		if err != nil {
+			return nil, err
+		}
+		return yamuxSession{sess}, nil
+	}
+	sess, err := smux.Server(rwc, smuxConf(cfg, cfg.SmuxVersion))
+	if err != nil {
+		return nil, err
+	}
+	return smuxSession{sess}, nil
+}
+
+// peekedConn reads through the buffer that looked at the session's first
+// bytes.
+type peekedConn struct {
+	io.Reader
+	*kcp.UDPSession
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) { return c.Reader.Read(b) }
@@ -0,0 +1,160 @@
+package kcp
+
+import (
+	"paqet/internal/flog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// statsInterval is how often counts of rejected packets are logged, when
+// they have moved.
+const statsInterval = time.Minute
+
+// ReplayStats counts packets rejected by the session layer's replay filter.
+type ReplayStats struct {
+	Replayed        uint64
+	TooOld          uint64
+	StaleHandshakes uint64
+}
+
+// AuthStats counts packets dropped because they failed decryption or
+// authentication: corrupted in transit, sealed with another key, or forged.
+type AuthStats struct {
+	// Block counts kcp-go's checksum and AEAD failures. kcp-go keeps a single
+	// counter per process, so it covers every session.
+	Block uint64
+	// Session counts packets rejected in front of KCP, by the x25519 session
+	// layer or by a server matching packets against rotating keys.
+	Session uint64
+}
+
+// dropCounters counts packets a PacketConn wrapper rejects before KCP.
+type dropCounters struct {
+	replayed        atomic.Uint64
+	tooOld          atomic.Uint64
+	staleHandshakes atomic.Uint64
+	authFailed      atomic.Uint64
+}
+
+func (c *dropCounters) stats() ReplayStats {
+	return ReplayStats{
+		Replayed:        c.replayed.Load(),
+		TooOld:          c.tooOld.Load(),
+		StaleHandshakes: c.staleHandshakes.Load(),
+	}
+}
+
+func authStats(c *dropCounters) AuthStats {
+	st := AuthStats{Block: atomic.LoadUint64(&kcp.DefaultSnmp.InCsumErrors)}
+	if c != nil {
+		st.Session = c.authFailed.Load()
+	}
+	return st
+}
+
+var logBlockOnce sync.Once
+
+// logBlockErrors starts logging kcp-go's count of packets that failed the
+// block's checksum or authentication. The count is per process, so one
+// goroutine reports it for every session.
+func logBlockErrors() {
+	logBlockOnce.Do(func() {
+		go func() {
+			var logged uint64
+			for range time.Tick(statsInterval) {
+				if n := authStats(nil).Block; n != logged {
+					flog.Warnf("dropped %d KCP packets that failed decryption since the last report", n-logged)
+					logged = n
+				}
+			}
+		}()
+	})
+}
+
+// logDrops logs what a session layer rejected in front of KCP until done is
+// closed.
+func logDrops(replay func() ReplayStats, auth func() AuthStats, done <-chan struct{}) {
+	t := time.NewTicker(statsInterval)
+	defer t.Stop()
+
+	var logged ReplayStats
+	var loggedAuth uint64
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		if st := replay(); st != logged {
+			flog.Warnf("rejected %d replayed packets, %d outside the replay window and %d stale handshakes since the last report",
+				st.Replayed-logged.Replayed, st.TooOld-logged.TooOld, st.StaleHandshakes-logged.StaleHandshakes)
+			logged = st
+		}
+		if failed := auth().Session; failed != loggedAuth {
+			flog.Warnf("dropped %d packets that failed authentication since the last report", failed-loggedAuth)
+			loggedAuth = failed
+		}
+	}
+}
+
+const (
+	replayOK = iota
+	replayDuplicate
+	replayTooOld
+)
+
+// replayWindow is a sliding bitmap over received packet counters, as in
+// RFC 6479: counters up to size below the highest one seen are accepted once,
+// in any order. It is only used from a session's single reader goroutine.
+type replayWindow struct {
+	top  uint64
+	bits []uint64
+}
+
+func newReplayWindow(size int) *replayWindow {
+	// One spare word, so advancing never clears bits still inside the window.
+	return &replayWindow{bits: make([]uint64, (size+63)/64+1)}
+}
+
+func (w *replayWindow) size() uint64 {
+	return uint64(len(w.bits)-1) * 64
+}
+
+// check reports whether ctr may be accepted, without recording it. Counters
+// are only recorded after the packet authenticates, so forged packets cannot
+// advance the window.
+func (w *replayWindow) check(ctr uint64) int {
+	if ctr == 0 {
+		return replayTooOld
+	}
+	if ctr > w.top {
+		return replayOK
+	}
+	if w.top-ctr >= w.size() {
+		return replayTooOld
+	}
+	n := uint64(len(w.bits))
+	if w.bits[(ctr/64)%n]&(1<<(ctr%64)) != 0 {
+		return replayDuplicate
+	}
+	return replayOK
+}
+
+func (w *replayWindow) update(ctr uint64) {
+	n := uint64(len(w.bits))
+	if ctr > w.top {
+		cur, next := w.top/64, ctr/64
+		if next-cur >= n {
+			clear(w.bits)
+		} else {
+			for i := cur + 1; i <= next; i++ {
+				w.bits[i%n] = 0
+			}
+		}
+		w.top = ctr
+	}
+	w.bits[(ctr/64)%n] |= 1 << (ctr % 64)
+}
@@ -0,0 +1,331 @@
+package kcp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/hash"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	handshakeTimeout = 5 * time.Second
+	handshakeResend  = time.Second
+
+	secureSessionIdle = 5 * time.Minute
+	maxSecureSessions = 65536
+)
+
+// secureClient is the PacketConn a handshaked client hands to KCP. A reader
+// goroutine owns the underlying conn, since it has to watch for the
+// handshake response before KCP starts reading.
+type secureClient struct {
+	net.PacketConn
+	server *net.UDPAddr
+	sess   atomic.Pointer[secureSession]
+	resp   chan []byte
+	data   chan []byte
+	done   chan struct{}
+	window int
+	dropCounters
+}
+
+func dialSecure(pc net.PacketConn, server *net.UDPAddr, psk []byte, window int) (*secureClient, error) {
+	hs, err := newClientHandshake(psk)
+	if err != nil {
+		return nil, err
+	}
+	c := &secureClient{
+		PacketConn: pc,
+		server:     server,
+		resp:       make(chan []byte, 1),
+		data:       make(chan []byte, 1024),
+		done:       make(chan struct{}),
+		window:     window,
+	}
+	go c.readLoop()
+
+	deadline := time.NewTimer(handshakeTimeout)
+	defer deadline.Stop()
+	resend := time.NewTicker(handshakeResend)
+	defer resend.Stop()
+	for {
+		if _, err := pc.WriteTo(hs.init, server); err != nil {
+			return nil, fmt.Errorf("failed to send handshake: %w", err)
+		}
+		select {
+		case resp := <-c.resp:
+			sess, err := hs.finish(resp, c.window)
+			if err != nil {
+				flog.Debugf("ignoring handshake response from %s: %v", server, err)
+				continue
+			}
+			c.sess.Store(sess)
+			flog.Debugf("session keys established with %s", server)
+			return c, nil
+		case <-resend.C:
+		case <-deadline.C:
+			return nil, fmt.Errorf("handshake with %s timed out (is the server's handshake setting and key the same?)", server)
+		case <-c.done:
+			return nil, net.ErrClosed
+		}
+	}
+}
+
+func (c *secureClient) readLoop() {
+	defer close(c.done)
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if ua, ok := addr.(*net.UDPAddr); !ok || !ua.IP.Equal(c.server.IP) || ua.Port != c.server.Port || n == 0 {
+			continue
+		}
+		switch buf[0] {
+		case pktResp:
+			select {
+			case c.resp <- append([]byte(nil), buf[:n]...):
+			default:
+			}
+		case pktData:
+			sess := c.sess.Load()
+			if sess == nil {
+				continue
+			}
+			payload, err := sess.open(nil, buf[:n])
+			if err != nil {
+				c.count(err)
+				continue
+			}
+			select {
+			case c.data <- payload:
+			case <-c.done:
+				return
+			}
+		}
+	}
+}
+
+func (c *dropCounters) count(err error) {
+	switch {
+	case errors.Is(err, errReplayed):
+		c.replayed.Add(1)
+	case errors.Is(err, errTooOld):
+		c.tooOld.Add(1)
+	case errors.Is(err, errStaleInit):
+		c.staleHandshakes.Add(1)
+	case errors.Is(err, errAuthFailed):
+		c.authFailed.Add(1)
+	}
+}
+
+func (c *secureClient) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-c.data:
+		return copy(b, p), c.server, nil
+	case <-c.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *secureClient) WriteTo(b []byte, addr net.Addr) (int, error) {
+	sess := c.sess.Load()
+	if sess == nil {
+		return 0, fmt.Errorf("session keys not established")
+	}
+	if _, err := c.PacketConn.WriteTo(sess.seal(nil, b), addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// secureServer answers handshakes and keeps one key set per client address.
+// An init may be sealed with any of the shared keys valid at the time.
+type secureServer struct {
+	net.PacketConn
+	keys   []conf.Key
+	window int
+
+	mu        sync.RWMutex
+	sessions  map[uint64]*secureSession
+	lastSweep time.Time
+	buf       []byte
+
+	// Ephemeral keys of recent inits; anything older fails the clock check.
+	seenInits map[[pubSize]byte]time.Time
+
+	dropCounters
+}
+
+func listenSecure(pc net.PacketConn, keys []conf.Key, window int) *secureServer {
+	return &secureServer{
+		PacketConn: pc,
+		keys:       keys,
+		window:     window,
+		sessions:   make(map[uint64]*secureSession),
+		lastSweep:  time.Now(),
+		buf:        make([]byte, 65535),
+		seenInits:  make(map[[pubSize]byte]time.Time),
+	}
+}
+
+// ReadFrom is only called from KCP's single reader goroutine; handshakes are
+// answered inline and never reach KCP.
+func (s *secureServer) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := s.PacketConn.ReadFrom(s.buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		ua, ok := addr.(*net.UDPAddr)
+		if !ok || n == 0 {
+			continue
+		}
+		now := time.Now()
+		if now.Sub(s.lastSweep) > time.Minute {
+			s.sweep(now)
+		}
+
+		key := hash.IPAddr(ua.IP, uint16(ua.Port))
+		switch s.buf[0] {
+		case pktInit:
+			s.handleInit(key, ua, s.buf[:n], now)
+		case pktData:
+			s.mu.RLock()
+			sess := s.sessions[key]
+			s.mu.RUnlock()
+			if sess == nil || len(b) < n-secureOverhead {
+				continue
+			}
+			payload, err := sess.open(b[:0], s.buf[:n])
+			if err != nil {
+				s.count(err)
+				continue
+			}
+			sess.lastSeen.Store(now.UnixNano())
+			sess.confirmed.Store(true)
+			return len(payload), addr, nil
+		}
+	}
+}
+
+func (s *secureServer) handleInit(key uint64, addr *net.UDPAddr, init []byte, now time.Time) {
+	s.mu.RLock()
+	old := s.sessions[key]
+	s.mu.RUnlock()
+	if old != nil && string(old.init) == string(init) {
+		// Our response was lost; a fresh one would desync the client. Once the
+		// client has sent data the init can only be a replay.
+		if !old.confirmed.Load() {
+			s.PacketConn.WriteTo(old.resp, addr)
+		} else {
+			s.replayed.Add(1)
+		}
+		return
+	}
+
+	// A replayed init is dropped before any key is tried on it. Inits only
+	// enter seenInits once authenticated, so this cannot be used to block one.
+	if len(init) != initSize {
+		return
+	}
+	ePub := [pubSize]byte(init[1 : 1+pubSize])
+	if _, ok := s.seenInits[ePub]; ok {
+		s.replayed.Add(1)
+		flog.Debugf("dropping replayed handshake from %s", addr)
+		return
+	}
+
+	var sess *secureSession
+	var used *conf.Key
+	err := errAuthFailed
+	for i := range s.keys {
+		if !s.keys[i].Valid(now) {
+			continue
+		}
+		if sess, err = respond(s.keys[i].PSK, init, now, s.window); !errors.Is(err, errAuthFailed) {
+			used = &s.keys[i]
+			break
+		}
+	}
+	if err != nil {
+		s.count(err)
+		flog.Debugf("dropping handshake from %s: %v", addr, err)
+		return
+	}
+	s.seenInits[ePub] = now
+	sess.lastSeen.Store(now.UnixNano())
+
+	s.mu.Lock()
+	if len(s.sessions) >= maxSecureSessions && s.sessions[key] == nil {
+		s.mu.Unlock()
+		flog.Warnf("dropping handshake from %s: %d sessions in use", addr, maxSecureSessions)
+		return
+	}
+	s.sessions[key] = sess
+	s.mu.Unlock()
+
+	if _, err := s.PacketConn.WriteTo(sess.resp, addr); err != nil {
+		flog.Debugf("failed to answer handshake from %s: %v", addr, err)
+		return
+	}
+	flog.Debugf("session keys established with %s", addr)
+	if len(s.keys) > 1 {
+		flog.Infof("client %s uses key %q", addr, used.Name)
+	}
+}
+
+// binding returns the binding of the session with addr, or nil if there is
+// none.
+func (s *secureServer) binding(addr net.Addr) []byte {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if sess := s.sessions[hash.IPAddr(ua.IP, uint16(ua.Port))]; sess != nil {
+		return sess.binding
+	}
+	return nil
+}
+
+func (s *secureServer) sweep(now time.Time) {
+	s.lastSweep = now
+	cutoff := now.Add(-secureSessionIdle).UnixNano()
+	s.mu.Lock()
+	for k, sess := range s.sessions {
+		if sess.lastSeen.Load() < cutoff {
+			delete(s.sessions, k)
+		}
+	}
+	s.mu.Unlock()
+	for k, t := range s.seenInits {
+		if now.Sub(t) > 2*maxClockSkew {
+			delete(s.seenInits, k)
+		}
+	}
+}
+
+func (s *secureServer) WriteTo(b []byte, addr net.Addr) (int, error) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, net.InvalidAddrError("invalid address")
+	}
+	s.mu.RLock()
+	sess := s.sessions[hash.IPAddr(ua.IP, uint16(ua.Port))]
+	s.mu.RUnlock()
+	if sess == nil {
+		return 0, fmt.Errorf("no session keys for %s", addr)
+	}
+	if _, err := s.PacketConn.WriteTo(sess.seal(nil, b), addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -1,6 +1,7 @@
 package kcp
 
 import (
+	"github.com/hashicorp/yamux"
 	"github.com/xtaci/smux"
 )
 
@@ -11,3 +12,11 @@ type Strm struct {
 func (s *Strm) SID() int {
 	return int(s.ID())
 }
+
+type yamuxStrm struct {
+	*yamux.Stream
+}
+
+func (s *yamuxStrm) SID() int {
+	return int(s.StreamID())
+}
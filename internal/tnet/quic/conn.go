@@ -0,0 +1,110 @@
+package quic
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"paqet/internal/protocol"
+	"paqet/internal/socket"
+	"paqet/internal/tnet"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+type Conn struct {
+	PacketConn *socket.PacketConn
+	Transport  *quic.Transport
+	Session    *quic.Conn
+
+	mux *dgramMux
+}
+
+func newConn(sess *quic.Conn, datagrams bool) *Conn {
+	c := &Conn{Session: sess}
+	if datagrams && sess.ConnectionState().SupportsDatagrams.Remote {
+		c.mux = newDgramMux(sess)
+	}
+	return c
+}
+
+// OpenStrm waits while the peer's stream limit is reached.
+func (c *Conn) OpenStrm() (tnet.Strm, error) {
+	strm, err := c.Session.OpenStreamSync(c.Session.Context())
+	if err != nil {
+		return nil, err
+	}
+	return &Strm{Stream: strm, conn: c.Session}, nil
+}
+
+func (c *Conn) AcceptStrm() (tnet.Strm, error) {
+	strm, err := c.Session.AcceptStream(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &Strm{Stream: strm, conn: c.Session}, nil
+}
+
+func (c *Conn) Ping(wait bool) error {
+	strm, err := c.OpenStrm()
+	if err != nil {
+		return fmt.Errorf("ping failed: %v", err)
+	}
+	defer strm.Close()
+	if wait {
+		p := protocol.Proto{Type: protocol.PPING}
+		err = p.Write(strm)
+		if err != nil {
+			return fmt.Errorf("strm ping write failed: %v", err)
+		}
+		err = p.Read(strm)
+		if err != nil {
+			return fmt.Errorf("strm ping read failed: %v", err)
+		}
+		if p.Type != protocol.PPONG {
+			return fmt.Errorf("strm pong failed: %v", err)
+		}
+	}
+	return nil
+}
+
+func (c *Conn) Close() error {
+	if c.Session != nil {
+		c.Session.CloseWithError(0, "")
+	}
+	if c.Transport != nil {
+		c.Transport.Close()
+	}
+	if c.PacketConn != nil {
+		c.PacketConn.Close()
+	}
+	return nil
+}
+
+// BindDatagrams sends the datagrams of a framed UDP stream as QUIC datagrams
+// when both ends have udp_path datagram.
+func (c *Conn) BindDatagrams(strm tnet.Strm) (tnet.Strm, bool) {
+	if c.mux == nil {
+		return strm, false
+	}
+	return c.mux.bind(strm), true
+}
+
+// Binding is exported from the TLS session keys, so it differs on every
+// connection and only its two ends know it.
+func (c *Conn) Binding() []byte {
+	tls := c.Session.ConnectionState().TLS
+	b, err := tls.ExportKeyingMaterial("paqet binding", nil, 32)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.Session.LocalAddr() }
+func (c *Conn) RemoteAddr() net.Addr { return c.Session.RemoteAddr() }
+
+// QUIC has no deadlines on the connection as a whole; idle_ms bounds it.
+func (c *Conn) SetDeadline(t time.Time) error      { return nil }
+func (c *Conn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *Conn) SetWriteDeadline(t time.Time) error { return nil }
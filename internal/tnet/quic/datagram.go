@@ -0,0 +1,260 @@
+package quic
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"paqet/internal/tnet"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// With udp_path datagram on both ends, the payloads of a UDP stream travel as
+// QUIC datagrams:
+//
+//	stream ID (4) | payload
+//
+// Payloads too large for one datagram still go through the stream.
+const (
+	dgramHeaderSize = 4
+	dgramBacklog    = 256
+
+	// Datagrams can beat the stream header to the server; those are held for
+	// a little while in case the stream shows up.
+	pendingFlows   = 1024
+	pendingPerFlow = 8
+	pendingTTL     = 5 * time.Second
+)
+
+// dgramMux hands the datagrams of one session to the streams bound to them.
+type dgramMux struct {
+	sess *quic.Conn
+
+	mu      sync.Mutex
+	flows   map[uint32]*dgramStrm
+	pending map[uint32]*pendingFlow
+}
+
+type pendingFlow struct {
+	since time.Time
+	pkts  [][]byte
+}
+
+func newDgramMux(sess *quic.Conn) *dgramMux {
+	m := &dgramMux{
+		sess:    sess,
+		flows:   make(map[uint32]*dgramStrm),
+		pending: make(map[uint32]*pendingFlow),
+	}
+	go m.run()
+	return m
+}
+
+func (m *dgramMux) run() {
+	for {
+		pkt, err := m.sess.ReceiveDatagram(context.Background())
+		if err != nil {
+			return
+		}
+		if len(pkt) < dgramHeaderSize {
+			continue
+		}
+		m.deliver(binary.BigEndian.Uint32(pkt), pkt[dgramHeaderSize:])
+	}
+}
+
+func (m *dgramMux) deliver(sid uint32, payload []byte) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f := m.flows[sid]; f != nil {
+		f.push(payload)
+		return
+	}
+	p := m.pending[sid]
+	if p == nil {
+		if len(m.pending) >= pendingFlows {
+			for k, old := range m.pending {
+				if now.Sub(old.since) > pendingTTL {
+					delete(m.pending, k)
+				}
+			}
+			if len(m.pending) >= pendingFlows {
+				return
+			}
+		}
+		p = &pendingFlow{since: now}
+		m.pending[sid] = p
+	}
+	if len(p.pkts) < pendingPerFlow {
+		p.pkts = append(p.pkts, payload)
+	}
+}
+
+// bind routes the datagrams of one UDP stream to a dgramStrm.
+func (m *dgramMux) bind(strm tnet.Strm) *dgramStrm {
+	d := &dgramStrm{
+		framed: strm,
+		mux:    m,
+		sid:    uint32(strm.SID()),
+		in:     make(chan []byte, dgramBacklog),
+		done:   make(chan struct{}),
+		wake:   make(chan struct{}),
+	}
+	m.mu.Lock()
+	m.flows[d.sid] = d
+	if p := m.pending[d.sid]; p != nil {
+		delete(m.pending, d.sid)
+		if time.Since(p.since) < pendingTTL {
+			for _, pkt := range p.pkts {
+				d.in <- pkt
+			}
+		}
+	}
+	m.mu.Unlock()
+	go d.pump()
+	return d
+}
+
+func (m *dgramMux) unbind(sid uint32) {
+	m.mu.Lock()
+	delete(m.flows, sid)
+	m.mu.Unlock()
+}
+
+// dgramStrm is a UDP stream whose datagrams go out as QUIC datagrams. The
+// framed stream underneath carries oversized ones and the stream's lifetime.
+type dgramStrm struct {
+	framed tnet.Strm
+	mux    *dgramMux
+	sid    uint32
+
+	in   chan []byte
+	done chan struct{}
+	once sync.Once
+	err  error
+
+	// Setting a read deadline closes wake, so blocked Reads pick it up.
+	dmu      sync.Mutex
+	deadline time.Time
+	wake     chan struct{}
+}
+
+// pump moves datagrams that arrive on the framed stream into in.
+func (d *dgramStrm) pump() {
+	buf := make([]byte, tnet.MaxFrame)
+	for {
+		n, err := d.framed.Read(buf)
+		if err != nil {
+			d.shutdown(err)
+			return
+		}
+		select {
+		case d.in <- append([]byte(nil), buf[:n]...):
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// push is called with the mux locked.
+func (d *dgramStrm) push(p []byte) {
+	select {
+	case d.in <- p:
+	default:
+		// Unreliable path: drop rather than stall the shared reader.
+	}
+}
+
+func (d *dgramStrm) shutdown(err error) {
+	d.once.Do(func() {
+		d.err = err
+		d.mux.unbind(d.sid)
+		close(d.done)
+	})
+}
+
+func (d *dgramStrm) Read(b []byte) (int, error) {
+	for {
+		d.dmu.Lock()
+		deadline, wake := d.deadline, d.wake
+		d.dmu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+		var n int
+		var err error
+		woke := false
+		select {
+		case p := <-d.in:
+			n = copy(b, p)
+		case <-d.done:
+			err = d.err
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		case <-wake:
+			woke = true
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if !woke {
+			return n, err
+		}
+	}
+}
+
+func (d *dgramStrm) Write(b []byte) (int, error) {
+	select {
+	case <-d.done:
+		return 0, d.err
+	default:
+	}
+	pkt := make([]byte, dgramHeaderSize+len(b))
+	binary.BigEndian.PutUint32(pkt, d.sid)
+	copy(pkt[dgramHeaderSize:], b)
+	err := d.mux.sess.SendDatagram(pkt)
+	var tooLarge *quic.DatagramTooLargeError
+	if errors.As(err, &tooLarge) {
+		return d.framed.Write(b)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (d *dgramStrm) Close() error {
+	d.shutdown(io.EOF)
+	return d.framed.Close()
+}
+
+// Read deadlines apply to the datagram queue; the framed stream is always
+// being read by pump.
+func (d *dgramStrm) SetDeadline(t time.Time) error {
+	d.SetReadDeadline(t)
+	return d.framed.SetWriteDeadline(t)
+}
+
+func (d *dgramStrm) SetReadDeadline(t time.Time) error {
+	d.dmu.Lock()
+	d.deadline = t
+	close(d.wake)
+	d.wake = make(chan struct{})
+	d.dmu.Unlock()
+	return nil
+}
+
+func (d *dgramStrm) SetWriteDeadline(t time.Time) error { return d.framed.SetWriteDeadline(t) }
+func (d *dgramStrm) SID() int                           { return d.framed.SID() }
+func (d *dgramStrm) LocalAddr() net.Addr                { return d.framed.LocalAddr() }
+func (d *dgramStrm) RemoteAddr() net.Addr               { return d.framed.RemoteAddr() }
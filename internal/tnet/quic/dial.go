@@ -0,0 +1,37 @@
+package quic
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/socket"
+	"paqet/internal/tnet"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const handshakeTimeout = 10 * time.Second
+
+func Dial(addr *net.UDPAddr, cfg *conf.QUIC, pConn *socket.PacketConn) (tnet.Conn, error) {
+	tlsConfig, err := tlsConf(cfg.PSK)
+	if err != nil {
+		return nil, err
+	}
+	tr := &quic.Transport{Conn: pConn}
+
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	sess, err := tr.Dial(ctx, addr, tlsConfig, quicConf(cfg))
+	if err != nil {
+		tr.Close()
+		return nil, fmt.Errorf("connection attempt failed: %v", err)
+	}
+	flog.Debugf("QUIC connection established with %s", addr)
+
+	c := newConn(sess, cfg.UDPPath == "datagram")
+	c.PacketConn, c.Transport = pConn, tr
+	return c, nil
+}
@@ -0,0 +1,58 @@
+package quic
+
+import (
+	"context"
+	"net"
+	"paqet/internal/conf"
+	"paqet/internal/socket"
+	"paqet/internal/tnet"
+
+	"github.com/quic-go/quic-go"
+)
+
+type Listener struct {
+	packetConn *socket.PacketConn
+	cfg        *conf.QUIC
+	transport  *quic.Transport
+	listener   *quic.Listener
+}
+
+func Listen(cfg *conf.QUIC, pConn *socket.PacketConn) (tnet.Listener, error) {
+	tlsConfig, err := tlsConf(cfg.PSK)
+	if err != nil {
+		return nil, err
+	}
+	tr := &quic.Transport{Conn: pConn}
+	l, err := tr.Listen(tlsConfig, quicConf(cfg))
+	if err != nil {
+		tr.Close()
+		return nil, err
+	}
+
+	return &Listener{packetConn: pConn, cfg: cfg, transport: tr, listener: l}, nil
+}
+
+func (l *Listener) Accept() (tnet.Conn, error) {
+	sess, err := l.listener.Accept(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return newConn(sess, l.cfg.UDPPath == "datagram"), nil
+}
+
+func (l *Listener) Close() error {
+	if l.listener != nil {
+		l.listener.Close()
+	}
+	if l.transport != nil {
+		l.transport.Close()
+	}
+	if l.packetConn != nil {
+		l.packetConn.Close()
+	}
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
+}
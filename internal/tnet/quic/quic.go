@@ -0,0 +1,77 @@
+package quic
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"paqet/internal/conf"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const alpn = "paqet"
+
+// quicConf maps cfg onto quic-go's settings. Path MTU discovery is off: the
+// raw socket adds a TCP header quic-go does not know about.
+func quicConf(cfg *conf.QUIC) *quic.Config {
+	return &quic.Config{
+		MaxIdleTimeout:             time.Duration(cfg.IdleMs) * time.Millisecond,
+		KeepAlivePeriod:            time.Duration(cfg.KeepaliveMs) * time.Millisecond,
+		InitialPacketSize:          uint16(cfg.MTU),
+		DisablePathMTUDiscovery:    true,
+		MaxStreamReceiveWindow:     uint64(cfg.Streambuf),
+		MaxConnectionReceiveWindow: uint64(cfg.Connbuf),
+		MaxIncomingStreams:         int64(cfg.MaxStreamsPerSession),
+		MaxIncomingUniStreams:      -1,
+		EnableDatagrams:            cfg.UDPPath == "datagram",
+	}
+}
+
+// tlsConf returns a TLS config in which both ends present the same
+// certificate, derived from the shared key, and accept only a peer that
+// presents it too. No CA is involved.
+func tlsConf(psk []byte) (*tls.Config, error) {
+	priv := ed25519.NewKeyFromSeed(psk[:ed25519.SeedSize])
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: alpn},
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, priv.Public(), priv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create QUIC certificate: %w", err)
+	}
+	pub := priv.Public().(ed25519.PublicKey)
+
+	return &tls.Config{
+		Certificates:       []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}},
+		ClientAuth:         tls.RequireAnyClientCert,
+		InsecureSkipVerify: true,
+		ServerName:         alpn,
+		NextProtos:         []string{alpn},
+		MinVersion:         tls.VersionTLS13,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) == 0 {
+				return errors.New("peer sent no certificate")
+			}
+			cert, err := x509.ParseCertificate(raw[0])
+			if err != nil {
+				return err
+			}
+			if key, ok := cert.PublicKey.(ed25519.PublicKey); !ok || !bytes.Equal(key, pub) {
+				return errors.New("peer does not hold the QUIC key")
+			}
+			return nil
+		},
+	}, nil
+}
@@ -0,0 +1,89 @@
+package quic
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"paqet/internal/conf"
+	"paqet/internal/socket"
+	"paqet/internal/tnet"
+)
+
+func TestLoopback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg, err := conf.Load([]byte(`role: "server"
+listen:
+  addr: ":9999"
+network:
+  mode: "socket"
+transport:
+  protocol: "quic"
+  quic:
+    key: "secret"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spc, err := socket.New(ctx, &conf.Network{Mode: "socket"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := Listen(cfg.Transport.QUIC, spc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan tnet.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	cpc, err := socket.New(ctx, &conf.Network{Mode: "socket"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: spc.LocalAddr().(*net.UDPAddr).Port}
+	client, err := Dial(addr, cfg.Transport.QUIC, cpc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, ok := <-accepted
+	if !ok {
+		t.Fatal("accept failed")
+	}
+	defer server.Close()
+
+	cb, sb := tnet.Binding(client), tnet.Binding(server)
+	if len(cb) == 0 || !bytes.Equal(cb, sb) {
+		t.Fatalf("bindings differ: %x and %x", cb, sb)
+	}
+
+	strm, err := client.OpenStrm()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("paqet"), 10000)
+	go func() {
+		strm.Write(data)
+		strm.Close()
+	}()
+	peer, err := server.AcceptStrm()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(peer)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("server read %d of %d bytes: %v", len(got), len(data), err)
+	}
+}
@@ -0,0 +1,26 @@
+package quic
+
+import (
+	"net"
+
+	"github.com/quic-go/quic-go"
+)
+
+type Strm struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (s *Strm) SID() int {
+	return int(s.StreamID())
+}
+
+// Close ends both directions. Closing a QUIC stream only ends the sending
+// one, which would leave the peer blocked on flow control if it kept writing.
+func (s *Strm) Close() error {
+	s.CancelRead(0)
+	return s.Stream.Close()
+}
+
+func (s *Strm) LocalAddr() net.Addr  { return s.conn.LocalAddr() }
+func (s *Strm) RemoteAddr() net.Addr { return s.conn.RemoteAddr() }
@@ -0,0 +1,72 @@
+package ws
+
+import (
+	"fmt"
+	"net"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/xtaci/smux"
+)
+
+type Conn struct {
+	WS      *websocket.Conn
+	Session *smux.Session
+}
+
+func (c *Conn) OpenStrm() (tnet.Strm, error) {
+	strm, err := c.Session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return &Strm{strm}, nil
+}
+
+func (c *Conn) AcceptStrm() (tnet.Strm, error) {
+	strm, err := c.Session.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return &Strm{strm}, nil
+}
+
+func (c *Conn) Ping(wait bool) error {
+	strm, err := c.Session.OpenStream()
+	if err != nil {
+		return fmt.Errorf("ping failed: %v", err)
+	}
+	defer strm.Close()
+	if wait {
+		p := protocol.Proto{Type: protocol.PPING}
+		err = p.Write(strm)
+		if err != nil {
+			return fmt.Errorf("strm ping write failed: %v", err)
+		}
+		err = p.Read(strm)
+		if err != nil {
+			return fmt.Errorf("strm ping read failed: %v", err)
+		}
+		if p.Type != protocol.PPONG {
+			return fmt.Errorf("strm pong failed: %v", err)
+		}
+	}
+	return nil
+}
+
+func (c *Conn) Close() error {
+	if c.Session != nil {
+		c.Session.Close()
+	}
+	if c.WS != nil {
+		c.WS.Close()
+	}
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr                { return c.WS.LocalAddr() }
+func (c *Conn) RemoteAddr() net.Addr               { return c.WS.RemoteAddr() }
+func (c *Conn) SetDeadline(t time.Time) error      { return c.Session.SetDeadline(t) }
+func (c *Conn) SetReadDeadline(t time.Time) error  { return c.WS.SetReadDeadline(t) }
+func (c *Conn) SetWriteDeadline(t time.Time) error { return c.WS.SetWriteDeadline(t) }
@@ -0,0 +1,43 @@
+package ws
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"paqet/internal/conf"
+	"paqet/internal/tnet"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/xtaci/smux"
+)
+
+const handshakeTimeout = 10 * time.Second
+
+// Dial upgrades a connection to cfg.URL and starts a smux client session on
+// it. HTTP(S)_PROXY from the environment is honoured.
+func Dial(cfg *conf.WS) (tnet.Conn, error) {
+	d := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: handshakeTimeout,
+		TLSClientConfig: &tls.Config{
+			ServerName:         cfg.SNI,
+			InsecureSkipVerify: cfg.Insecure,
+			MinVersion:         tls.VersionTLS12,
+		},
+	}
+	header := http.Header{}
+	if cfg.Host != "" {
+		header.Set("Host", cfg.Host)
+	}
+	c, _, err := d.Dial(cfg.URL.String(), header)
+	if err != nil {
+		return nil, fmt.Errorf("websocket handshake with %s failed: %w", cfg.URL.Redacted(), err)
+	}
+	sess, err := smux.Client(&wsConn{Conn: c}, smuxConf(cfg))
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("smux session creation failed: %w", err)
+	}
+	return &Conn{WS: c, Session: sess}, nil
+}
@@ -0,0 +1,105 @@
+package ws
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/tnet"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/xtaci/smux"
+)
+
+type Listener struct {
+	cfg      *conf.WS
+	ln       net.Listener
+	srv      *http.Server
+	upgrader websocket.Upgrader
+
+	conns chan tnet.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+// Listen serves WebSocket upgrades on cfg.Path. Every other request gets a
+// 404, so probes see an ordinary web server.
+func Listen(cfg *conf.WS) (tnet.Listener, error) {
+	ln, err := net.Listen("tcp", cfg.Listen.String())
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.CertKey)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		ln = tls.NewListener(ln, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+			NextProtos:   []string{"http/1.1"},
+		})
+	}
+	l := &Listener{
+		cfg: cfg,
+		ln:  ln,
+		upgrader: websocket.Upgrader{
+			HandshakeTimeout: handshakeTimeout,
+			// Proxies rewrite or drop Origin; the path is what gates access.
+			CheckOrigin: func(*http.Request) bool { return true },
+		},
+		conns: make(chan tnet.Conn),
+		done:  make(chan struct{}),
+	}
+	l.srv = &http.Server{Handler: l, ReadHeaderTimeout: handshakeTimeout}
+	go l.srv.Serve(ln)
+	return l, nil
+}
+
+func (l *Listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != l.cfg.Path || !websocket.IsWebSocketUpgrade(r) {
+		http.NotFound(w, r)
+		return
+	}
+	c, err := l.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		flog.Debugf("websocket upgrade from %s failed: %v", r.RemoteAddr, err)
+		return
+	}
+	sess, err := smux.Server(&wsConn{Conn: c}, smuxConf(l.cfg))
+	if err != nil {
+		flog.Debugf("smux session for %s failed: %v", r.RemoteAddr, err)
+		c.Close()
+		return
+	}
+	select {
+	case l.conns <- &Conn{WS: c, Session: sess}:
+	case <-l.done:
+		sess.Close()
+		c.Close()
+	}
+}
+
+func (l *Listener) Accept() (tnet.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.srv.Close()
+	})
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
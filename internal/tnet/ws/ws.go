@@ -0,0 +1,71 @@
+package ws
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"paqet/internal/conf"
+
+	"github.com/gorilla/websocket"
+	"github.com/xtaci/smux"
+)
+
+// wsConn presents a WebSocket as the byte stream smux runs over. Each write
+// goes out as one binary message; reads run across message boundaries.
+type wsConn struct {
+	*websocket.Conn
+	r   io.Reader
+	wmu sync.Mutex
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for {
+		if c.r == nil {
+			typ, r, err := c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if typ != websocket.BinaryMessage {
+				continue
+			}
+			c.r = r
+		}
+		n, err := c.r.Read(b)
+		if err == io.EOF {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := c.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func smuxConf(cfg *conf.WS) *smux.Config {
+	var sconf = smux.DefaultConfig()
+	sconf.Version = 2
+	sconf.KeepAliveInterval = 10 * time.Second
+	sconf.KeepAliveTimeout = 30 * time.Second
+	sconf.MaxFrameSize = 65535
+	sconf.MaxReceiveBuffer = cfg.Smuxbuf
+	sconf.MaxStreamBuffer = cfg.Streambuf
+	return sconf
+}
@@ -0,0 +1,76 @@
+package ws
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"paqet/internal/conf"
+	"paqet/internal/tnet"
+)
+
+func TestLoopback(t *testing.T) {
+	cfg := &conf.WS{
+		Listen:    &tnet.Addr{Host: "127.0.0.1", Port: 0},
+		Path:      "/tunnel",
+		Smuxbuf:   4 * 1024 * 1024,
+		Streambuf: 256 * 1024,
+	}
+	ln, err := Listen(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan tnet.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	// Anything but an upgrade on the path looks like an ordinary web server.
+	resp, err := http.Get(fmt.Sprintf("http://%s/tunnel", ln.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("plain request got status %d", resp.StatusCode)
+	}
+
+	cfg.URL = &url.URL{Scheme: "ws", Host: ln.Addr().String(), Path: cfg.Path}
+	client, err := Dial(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, ok := <-accepted
+	if !ok {
+		t.Fatal("accept failed")
+	}
+	defer server.Close()
+
+	strm, err := client.OpenStrm()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("paqet"), 100000)
+	go func() {
+		strm.Write(data)
+		strm.Close()
+	}()
+	peer, err := server.AcceptStrm()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(peer)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("server read %d of %d bytes: %v", len(got), len(data), err)
+	}
+}